@@ -1,39 +1,132 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
 
-	"go.podman.io/storage/pkg/reexec"
 	"github.com/vanilla-os/albius/core"
+	"github.com/vanilla-os/albius/core/util"
+	"go.podman.io/storage/pkg/reexec"
 )
 
-func main() {
-	if reexec.Init() { // needed for subprocesses
-		panic("Failed to initialize reexec")
+// Exit codes, documented in README.md. Frontends rely on them, so existing
+// values must never change.
+const (
+	exitOK       = 0
+	exitFailure  = 1  // Unexpected failure outside of a recipe stage
+	exitUsage    = 2  // Invalid command line
+	exitRecipe   = 3  // Recipe could not be read or parsed
+	exitInvalid  = 4  // Recipe failed validation
+	exitSetup    = 5  // A setup step failed
+	exitMount    = 6  // Mounting the target partitions failed
+	exitInstall  = 7  // Copying or configuring the system image failed
+	exitPost     = 8  // A post-installation step failed
+	exitTeardown = 9  // Teardown could not undo everything
+	exitState    = 10 // No state to resume from, or it does not match
+)
+
+var stageExitCodes = map[albius.Stage]int{
+	albius.StageSetup:   exitSetup,
+	albius.StageMount:   exitMount,
+	albius.StageInstall: exitInstall,
+	albius.StagePost:    exitPost,
+}
+
+type command struct {
+	usage string
+	help  string
+	run   func(args []string) int
+}
+
+var commands = map[string]command{}
+
+// commandOrder is the order commands are listed in the usage text
+var commandOrder = []string{"run", "resume", "validate", "plan", "list-disks", "inspect-disk", "gen-fstab", "teardown"}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: albius <command> [options] [arguments]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, name := range commandOrder {
+		fmt.Fprintf(os.Stderr, "  %-40s %s\n", commands[name].usage, commands[name].help)
 	}
+	fmt.Fprintln(os.Stderr, "\nRun 'albius <command> -h' for the options of each command.")
+}
 
-	recipe, err := albius.ReadRecipe(os.Args[1])
-	if err != nil {
-		panic(err)
+// fail prints err and returns code, so commands can simply `return fail(...)`
+func fail(code int, err error) int {
+	fmt.Fprintln(os.Stderr, "albius:", util.MaskSecrets(err.Error()))
+	return code
+}
+
+// stageExitCode returns the exit code for an error returned by one of the
+// recipe stages.
+func stageExitCode(err error) int {
+	var stageErr *albius.StageError
+	if errors.As(err, &stageErr) {
+		return stageExitCodes[stageErr.Stage]
+	}
+	if errors.Is(err, albius.ErrInvalidRunOptions) {
+		return exitUsage
 	}
+	if errors.Is(err, albius.ErrNoState) || errors.Is(err, albius.ErrStateMismatch) {
+		return exitState
+	}
+
+	return exitFailure
+}
 
-	err = recipe.RunSetup()
+// readRecipe reads the recipe at path, sets its variables from the command
+// line and, if validate is set, validates it.
+func readRecipe(path string, validate bool, vars variableFlags) (*albius.Recipe, int) {
+	recipe, err := albius.ReadRecipe(path)
 	if err != nil {
-		panic(err)
+		return nil, fail(exitRecipe, err)
 	}
 
-	err = recipe.SetupMountpoints()
+	err = recipe.SetVariables(vars.sources())
 	if err != nil {
-		panic(err)
+		return nil, fail(exitUsage, err)
 	}
 
-	err = recipe.Install()
-	if err != nil {
-		panic(err)
+	if validate {
+		err = recipe.Validate()
+		if err != nil {
+			return nil, fail(exitInvalid, err)
+		}
 	}
 
-	err = recipe.RunPostInstall()
-	if err != nil {
-		panic(err)
+	return recipe, exitOK
+}
+
+func main() {
+	if reexec.Init() { // needed for subprocesses
+		panic("Failed to initialize reexec")
+	}
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	name, args := os.Args[1], os.Args[2:]
+	if name == "-h" || name == "--help" || name == "help" {
+		usage()
+		os.Exit(exitOK)
 	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		// Albius used to take the recipe as its only argument, keep
+		// accepting it as a shorthand for `albius run <recipe>`
+		if _, err := os.Stat(name); err == nil && len(args) == 0 {
+			os.Exit(commands["run"].run(os.Args[1:]))
+		}
+
+		fmt.Fprintf(os.Stderr, "albius: unknown command %q\n\n", name)
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	os.Exit(cmd.run(args))
 }
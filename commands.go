@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/vanilla-os/albius/core"
+	"github.com/vanilla-os/albius/core/disk"
+	"golang.org/x/term"
+)
+
+func init() {
+	commands["run"] = command{"run [options] <recipe>", "Validate and apply a recipe", runCmd}
+	commands["resume"] = command{"resume [options] <recipe>", "Continue a run which failed", resumeCmd}
+	commands["validate"] = command{"validate [options] <recipe>", "Check a recipe for errors without applying it", validateCmd}
+	commands["plan"] = command{"plan [options] <recipe>", "Print every command a recipe would execute", planCmd}
+	commands["list-disks"] = command{"list-disks [options]", "List the disks available for installation", listDisksCmd}
+	commands["inspect-disk"] = command{"inspect-disk <disk>", "Print a disk's partition table as JSON", inspectDiskCmd}
+	commands["gen-fstab"] = command{"gen-fstab [options] <recipe>", "Print the fstab for a recipe's mountpoints", genFstabCmd}
+	commands["teardown"] = command{"teardown [options] <recipe>", "Unmount and close everything left by a failed run", teardownCmd}
+}
+
+// parseArgs parses the flags in args and checks that exactly nArgs
+// positional arguments remain. If it returns false, the command must exit
+// with code.
+func parseArgs(fs *flag.FlagSet, args []string, nArgs int) (ok bool, code int) {
+	cmd := commands[fs.Name()]
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: albius %s\n\n%s\n", cmd.usage, cmd.help)
+		fs.PrintDefaults()
+	}
+
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return false, exitOK
+	} else if err != nil {
+		return false, exitUsage
+	}
+
+	if fs.NArg() != nArgs {
+		fs.Usage()
+		return false, exitUsage
+	}
+
+	return true, exitOK
+}
+
+// eventFlags are the flags of the commands which can report events to a
+// frontend.
+type eventFlags struct {
+	fd     *int
+	socket *string
+}
+
+func addEventFlags(fs *flag.FlagSet) eventFlags {
+	return eventFlags{
+		fd:     fs.Int("events-fd", -1, "write progress events as JSON lines to file descriptor `N`"),
+		socket: fs.String("events-socket", "", "write progress events as JSON lines to the Unix socket at `path`"),
+	}
+}
+
+// attach makes recipe report its events to the file descriptor or socket
+// given on the command line, if any. The returned function must be called
+// once the recipe is done.
+func (f eventFlags) attach(recipe *albius.Recipe) (close func(), err error) {
+	var w io.WriteCloser
+	switch {
+	case *f.fd >= 0 && *f.socket != "":
+		return nil, errors.New("--events-fd and --events-socket cannot be used together")
+	case *f.fd >= 0:
+		file := os.NewFile(uintptr(*f.fd), "events")
+		if file == nil {
+			return nil, fmt.Errorf("invalid file descriptor %d", *f.fd)
+		}
+		w = file
+	case *f.socket != "":
+		w, err = net.Dial("unix", *f.socket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to events socket: %s", err)
+		}
+	default:
+		return func() {}, nil
+	}
+
+	recipe.OnEvent = albius.NewJSONEventWriter(w)
+	return func() { w.Close() }, nil
+}
+
+// keyValueFlag collects the NAME=VALUE pairs given to a repeatable flag.
+type keyValueFlag map[string]string
+
+func (f keyValueFlag) String() string {
+	return ""
+}
+
+func (f keyValueFlag) Set(value string) error {
+	name, val, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected NAME=VALUE, got %q", value)
+	}
+	f[name] = val
+	return nil
+}
+
+// variableFlags are the flags giving values to the variables of a recipe.
+type variableFlags struct {
+	values keyValueFlag
+	files  keyValueFlag
+	prompt *bool
+}
+
+func addVariableFlags(fs *flag.FlagSet) variableFlags {
+	f := variableFlags{values: keyValueFlag{}, files: keyValueFlag{}}
+	fs.Var(f.values, "var", "set a recipe variable, as `NAME=VALUE` (repeatable)")
+	fs.Var(f.files, "var-file", "set a recipe variable to the content of a file, as `NAME=PATH` (repeatable)")
+	f.prompt = fs.Bool("prompt", false, "ask on the terminal for the variables given no value")
+	return f
+}
+
+func (f variableFlags) sources() albius.VariableSources {
+	sources := albius.VariableSources{Values: f.values, Files: f.files}
+	if *f.prompt {
+		sources.Prompt = promptVariable
+	}
+	return sources
+}
+
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// promptVariable asks for the value of a variable on the terminal, without
+// echoing secrets.
+func promptVariable(name string, variable albius.Variable) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", errors.New("standard input is not a terminal")
+	}
+
+	label := name
+	if variable.Description != "" {
+		label = fmt.Sprintf("%s (%s)", variable.Description, name)
+	}
+	fmt.Fprintf(os.Stderr, "%s: ", label)
+
+	if variable.Type == albius.VariableSecret {
+		value, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(value), err
+	}
+
+	line, err := stdinReader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func runCmd(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	stagesFlag := fs.String("stages", "", "comma-separated `list` of stages to run, out of setup, mount, install and post (default all)")
+	fromStep := fs.Int("from-step", 0, "skip the steps before index `N` in the first selected stage")
+	statePath := fs.String("state", albius.DefaultStatePath, "save progress to `file` for resume, or nowhere if empty")
+	noRollback := fs.Bool("no-rollback", false, "leave everything mounted and open if a stage fails")
+	events := addEventFlags(fs)
+	vars := addVariableFlags(fs)
+	if ok, code := parseArgs(fs, args, 1); !ok {
+		return code
+	}
+
+	opts := albius.RunOptions{FromStep: *fromStep, StatePath: *statePath, NoRollback: *noRollback}
+	if *stagesFlag != "" {
+		for _, name := range strings.Split(*stagesFlag, ",") {
+			stage, err := albius.ParseStage(strings.TrimSpace(name))
+			if err != nil {
+				return fail(exitUsage, err)
+			}
+			opts.Stages = append(opts.Stages, stage)
+		}
+	}
+
+	recipe, code := readRecipe(fs.Arg(0), true, vars)
+	if recipe == nil {
+		return code
+	}
+
+	closeEvents, err := events.attach(recipe)
+	if err != nil {
+		return fail(exitUsage, err)
+	}
+	defer closeEvents()
+
+	err = recipe.Run(opts)
+	if err != nil {
+		return fail(stageExitCode(err), err)
+	}
+
+	return exitOK
+}
+
+func resumeCmd(args []string) int {
+	fs := flag.NewFlagSet("resume", flag.ContinueOnError)
+	statePath := fs.String("state", albius.DefaultStatePath, "read and save progress to `file`")
+	noRollback := fs.Bool("no-rollback", false, "leave everything mounted and open if a stage fails")
+	events := addEventFlags(fs)
+	vars := addVariableFlags(fs)
+	if ok, code := parseArgs(fs, args, 1); !ok {
+		return code
+	}
+
+	recipe, code := readRecipe(fs.Arg(0), true, vars)
+	if recipe == nil {
+		return code
+	}
+
+	closeEvents, err := events.attach(recipe)
+	if err != nil {
+		return fail(exitUsage, err)
+	}
+	defer closeEvents()
+
+	err = recipe.Resume(albius.RunOptions{StatePath: *statePath, NoRollback: *noRollback})
+	if err != nil {
+		return fail(stageExitCode(err), err)
+	}
+
+	return exitOK
+}
+
+func validateCmd(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	vars := addVariableFlags(fs)
+	if ok, code := parseArgs(fs, args, 1); !ok {
+		return code
+	}
+
+	_, code := readRecipe(fs.Arg(0), true, vars)
+	if code != exitOK {
+		return code
+	}
+
+	fmt.Println("Recipe is valid")
+	return exitOK
+}
+
+func planCmd(args []string) int {
+	fs := flag.NewFlagSet("plan", flag.ContinueOnError)
+	vars := addVariableFlags(fs)
+	if ok, code := parseArgs(fs, args, 1); !ok {
+		return code
+	}
+
+	recipe, code := readRecipe(fs.Arg(0), true, vars)
+	if recipe == nil {
+		return code
+	}
+
+	plan, err := recipe.Plan()
+	if plan != nil {
+		fmt.Print(plan)
+	}
+	if err != nil {
+		return fail(exitFailure, err)
+	}
+
+	return exitOK
+}
+
+func listDisksCmd(args []string) int {
+	fs := flag.NewFlagSet("list-disks", flag.ContinueOnError)
+	jsonOutput := fs.Bool("json", false, "print the disks and their partitions as JSON")
+	if ok, code := parseArgs(fs, args, 0); !ok {
+		return code
+	}
+
+	disks, err := disk.ListDisks()
+	if err != nil {
+		return fail(exitFailure, err)
+	}
+
+	if *jsonOutput {
+		out, err := json.MarshalIndent(disks, "", "  ")
+		if err != nil {
+			return fail(exitFailure, err)
+		}
+		fmt.Println(string(out))
+		return exitOK
+	}
+
+	fmt.Printf("%-16s %-12s %-8s %-10s %s\n", "PATH", "SIZE", "LABEL", "TRANSPORT", "MODEL")
+	for _, target := range disks {
+		transport := target.Transport
+		if target.Removable {
+			transport += " (rm)"
+		}
+		fmt.Printf("%-16s %-12s %-8s %-10s %s\n", target.Path, target.Size, target.Label, transport, target.Model)
+	}
+
+	return exitOK
+}
+
+func inspectDiskCmd(args []string) int {
+	fs := flag.NewFlagSet("inspect-disk", flag.ContinueOnError)
+	if ok, code := parseArgs(fs, args, 1); !ok {
+		return code
+	}
+
+	target, err := disk.LocateDisk(fs.Arg(0))
+	if err != nil {
+		return fail(exitFailure, err)
+	}
+
+	out, err := json.MarshalIndent(target, "", "  ")
+	if err != nil {
+		return fail(exitFailure, err)
+	}
+	fmt.Println(string(out))
+
+	return exitOK
+}
+
+func genFstabCmd(args []string) int {
+	fs := flag.NewFlagSet("gen-fstab", flag.ContinueOnError)
+	output := fs.String("o", "", "write the fstab to `file` instead of stdout")
+	vars := addVariableFlags(fs)
+	if ok, code := parseArgs(fs, args, 1); !ok {
+		return code
+	}
+
+	recipe, code := readRecipe(fs.Arg(0), false, vars)
+	if recipe == nil {
+		return code
+	}
+
+	fstab, err := recipe.Fstab()
+	if err != nil {
+		return fail(exitFailure, err)
+	}
+
+	if *output == "" {
+		fmt.Print(string(fstab))
+		return exitOK
+	}
+
+	err = os.WriteFile(*output, fstab, 0o644)
+	if err != nil {
+		return fail(exitFailure, err)
+	}
+
+	return exitOK
+}
+
+func teardownCmd(args []string) int {
+	fs := flag.NewFlagSet("teardown", flag.ContinueOnError)
+	vars := addVariableFlags(fs)
+	if ok, code := parseArgs(fs, args, 1); !ok {
+		return code
+	}
+
+	recipe, code := readRecipe(fs.Arg(0), false, vars)
+	if recipe == nil {
+		return code
+	}
+
+	err := recipe.Teardown()
+	if err != nil {
+		return fail(exitTeardown, err)
+	}
+
+	return exitOK
+}
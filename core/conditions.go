@@ -0,0 +1,377 @@
+package albius
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/vanilla-os/albius/core/disk"
+	"github.com/vanilla-os/albius/core/util"
+)
+
+// FactValues are the values a fact is compared with. They are written as a
+// single string or a list of strings.
+type FactValues []string
+
+func (values *FactValues) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*values = FactValues{single}
+		return nil
+	}
+
+	var list []string
+	err := json.Unmarshal(data, &list)
+	if err != nil {
+		return fmt.Errorf("invalid fact values %s: expected a string or a list of strings", data)
+	}
+	*values = list
+	return nil
+}
+
+// match returns whether fact matches values: it must be one of the values,
+// if any, and none of the values prefixed with ! (e.g. "!none"). Facts are
+// compared case-insensitively.
+func (values FactValues) match(fact string) bool {
+	positive := false
+	for _, value := range values {
+		negated, ok := strings.CutPrefix(value, "!")
+		if ok {
+			if strings.EqualFold(negated, fact) {
+				return false
+			}
+			continue
+		}
+
+		if strings.EqualFold(value, fact) {
+			return true
+		}
+		positive = true
+	}
+
+	return !positive
+}
+
+// Condition is the when clause of a step, which is only run if every fact it
+// tests matches.
+type Condition struct {
+	// Firmware is either disk.EFI or disk.BIOS
+	Firmware FactValues `json:",omitempty"`
+	// Arch is the machine architecture, as printed by uname -m (e.g. x86_64
+	// or aarch64)
+	Arch FactValues `json:",omitempty"`
+	// Virtualization is the hypervisor or container the system runs in, as
+	// printed by systemd-detect-virt (e.g. kvm), or "none"
+	Virtualization FactValues `json:",omitempty"`
+	// ExistingOS tests whether os-prober finds other operating systems
+	ExistingOS *bool `json:",omitempty"`
+
+	// Disk is the disk tested by Transport, MinSize and MaxSize. It defaults
+	// to the disk of setup steps, and is required for post-installation
+	// steps.
+	Disk string `json:",omitempty"`
+	// Transport is how the disk is connected, as reported by parted (e.g.
+	// nvme, scsi, usb or virtblk)
+	Transport FactValues `json:",omitempty"`
+	// MinSize and MaxSize are absolute sizes (see util.ParseSize) the size
+	// of the disk must be within
+	MinSize interface{} `json:",omitempty"`
+	MaxSize interface{} `json:",omitempty"`
+}
+
+// UnmarshalJSON rejects unknown facts, which would otherwise be silently
+// ignored and always match.
+func (cond *Condition) UnmarshalJSON(data []byte) error {
+	type plainCondition Condition
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode((*plainCondition)(cond))
+}
+
+// testsDisk tells whether cond tests facts about a disk.
+func (cond *Condition) testsDisk() bool {
+	return len(cond.Transport) > 0 || cond.MinSize != nil || cond.MaxSize != nil
+}
+
+// Facts describe the machine steps' conditions are tested against.
+type Facts struct {
+	// Firmware is the firmware the system booted with, see
+	// disk.DetectFirmware
+	Firmware disk.Firmware `json:"firmware"`
+	// Arch is the output of uname -m
+	Arch string `json:"arch"`
+	// Virtualization is the output of systemd-detect-virt
+	Virtualization string `json:"virtualization"`
+	// ExistingOSes are the names of the operating systems found by
+	// os-prober. It is only detected if some step tests ExistingOS.
+	ExistingOSes []string `json:"existingOSes,omitempty"`
+}
+
+// DetectFacts detects the facts of the machine Albius runs on. Detecting the
+// existing operating systems is slow and requires os-prober, so it is only
+// done if withOSes is set.
+func DetectFacts(withOSes bool) (*Facts, error) {
+	facts := &Facts{Firmware: disk.DetectFirmware()}
+
+	arch, err := util.OutputCommand("uname", "-m")
+	if err != nil {
+		return nil, fmt.Errorf("failed to detect the architecture: %s", err)
+	}
+	facts.Arch = arch
+
+	// systemd-detect-virt prints "none" and fails when not virtualized
+	virt, err := util.OutputCommand("systemd-detect-virt")
+	if virt == "" {
+		return nil, fmt.Errorf("failed to detect virtualization: %s", err)
+	}
+	facts.Virtualization = virt
+
+	if withOSes {
+		output, err := util.OutputCommand("os-prober")
+		if err != nil {
+			return nil, fmt.Errorf("failed to detect existing operating systems: %s", err)
+		}
+		// Lines look like /dev/sda1:Windows Boot Manager:Windows:efi
+		for _, line := range strings.Split(output, "\n") {
+			fields := strings.Split(line, ":")
+			if len(fields) >= 2 {
+				facts.ExistingOSes = append(facts.ExistingOSes, fields[1])
+			}
+		}
+	}
+
+	return facts, nil
+}
+
+// conditions returns the when clauses of every step.
+func (recipe *Recipe) conditions() []*Condition {
+	conditions := []*Condition{}
+	for _, step := range recipe.Setup {
+		if step.When != nil {
+			conditions = append(conditions, step.When)
+		}
+	}
+	for _, step := range recipe.PostInstallation {
+		if step.When != nil {
+			conditions = append(conditions, step.When)
+		}
+	}
+
+	return conditions
+}
+
+// detectFacts detects the facts the steps' conditions need, unless they
+// were given in Facts or already detected. Runs detect them before the
+// first step, as steps may change them (e.g. by erasing an existing OS).
+func (recipe *Recipe) detectFacts() error {
+	conditions := recipe.conditions()
+	if recipe.Facts != nil || recipe.detectedFacts != nil || len(conditions) == 0 {
+		return nil
+	}
+
+	withOSes := slices.ContainsFunc(conditions, func(cond *Condition) bool { return cond.ExistingOS != nil })
+	facts, err := DetectFacts(withOSes)
+	if err != nil {
+		return err
+	}
+	recipe.detectedFacts = facts
+
+	if recipe.checkpoint != nil {
+		recipe.checkpoint.state.Facts = facts
+	}
+
+	return nil
+}
+
+// firmware returns the firmware the steps are run for: the one in Facts if
+// set, or else the detected one.
+func (recipe *Recipe) firmware() disk.Firmware {
+	switch {
+	case recipe.Facts != nil:
+		return recipe.Facts.Firmware
+	case recipe.detectedFacts != nil:
+		return recipe.detectedFacts.Firmware
+	default:
+		return disk.DetectFirmware()
+	}
+}
+
+// unmetCondition tests the when clause of a step whose disk is stepDisk,
+// if any. If the step must be skipped, the reason is returned.
+func (recipe *Recipe) unmetCondition(cond *Condition, stepDisk string) (string, error) {
+	if cond == nil {
+		return "", nil
+	}
+
+	err := recipe.detectFacts()
+	if err != nil {
+		return "", err
+	}
+	facts := recipe.Facts
+	if facts == nil {
+		facts = recipe.detectedFacts
+	}
+
+	for _, fact := range []struct {
+		name, value string
+		values      FactValues
+	}{
+		{"firmware", string(facts.Firmware), cond.Firmware},
+		{"arch", facts.Arch, cond.Arch},
+		{"virtualization", facts.Virtualization, cond.Virtualization},
+	} {
+		if len(fact.values) > 0 && !fact.values.match(fact.value) {
+			return fmt.Sprintf("%s is %s, expected %s", fact.name, fact.value, strings.Join(fact.values, " or ")), nil
+		}
+	}
+
+	if cond.ExistingOS != nil && *cond.ExistingOS != (len(facts.ExistingOSes) > 0) {
+		if *cond.ExistingOS {
+			return "no existing operating system was found", nil
+		}
+		return fmt.Sprintf("found existing operating systems (%s)", strings.Join(facts.ExistingOSes, ", ")), nil
+	}
+
+	if !cond.testsDisk() {
+		return "", nil
+	}
+
+	diskRef := cond.Disk
+	if diskRef == "" {
+		diskRef = stepDisk
+	}
+	diskPath, err := recipe.resolveDevice(diskRef)
+	if err != nil {
+		return "", err
+	}
+	target, err := disk.LocateDisk(diskPath)
+	if err != nil {
+		return "", err
+	}
+
+	if len(cond.Transport) > 0 && !cond.Transport.match(target.Transport) {
+		return fmt.Sprintf("%s transport is %s, expected %s", diskPath, target.Transport, strings.Join(cond.Transport, " or ")), nil
+	}
+
+	size, err := util.ParseSize(target.Size)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the size of %s: %s", diskPath, err)
+	}
+	for _, bound := range []struct {
+		value any
+		min   bool
+	}{{cond.MinSize, true}, {cond.MaxSize, false}} {
+		if bound.value == nil {
+			continue
+		}
+		limit, err := util.ParseSize(bound.value)
+		if err != nil {
+			return "", err
+		}
+		if bound.min && size.Bytes < limit.Bytes {
+			return fmt.Sprintf("%s is smaller than %v", diskPath, bound.value), nil
+		}
+		if !bound.min && size.Bytes > limit.Bytes {
+			return fmt.Sprintf("%s is larger than %v", diskPath, bound.value), nil
+		}
+	}
+
+	return "", nil
+}
+
+// validateCondition checks the when clause of a step. hasDisk tells whether
+// the step has a disk disk facts can default to.
+func (v *validator) validateCondition(section string, step int, operation string, cond *Condition, hasDisk bool) {
+	if cond == nil {
+		return
+	}
+
+	for _, fact := range []struct {
+		name   string
+		values FactValues
+	}{
+		{"firmware", cond.Firmware},
+		{"arch", cond.Arch},
+		{"virtualization", cond.Virtualization},
+		{"transport", cond.Transport},
+	} {
+		for _, value := range fact.values {
+			if strings.TrimPrefix(value, "!") == "" {
+				v.addError(section, step, operation, "when: %s values cannot be empty", fact.name)
+			}
+		}
+	}
+	for _, value := range cond.Firmware {
+		firmware := strings.ToLower(strings.TrimPrefix(value, "!"))
+		if firmware != "" && firmware != string(disk.EFI) && firmware != string(disk.BIOS) {
+			v.addError(section, step, operation, "when: unknown firmware %q, expected %s or %s", value, disk.EFI, disk.BIOS)
+		}
+	}
+
+	for _, bound := range []struct {
+		name  string
+		value any
+	}{{"minSize", cond.MinSize}, {"maxSize", cond.MaxSize}} {
+		if bound.value == nil {
+			continue
+		}
+		size, err := util.ParseSize(bound.value)
+		if err != nil {
+			v.addError(section, step, operation, "when: %s: %s", bound.name, err)
+		} else if size.Kind != util.SizeAbsolute || size.Bytes <= 0 {
+			v.addError(section, step, operation, "when: %s must be a positive absolute size, got %v", bound.name, bound.value)
+		}
+	}
+
+	if cond.Disk != "" {
+		if !disk.IsDeviceRef(cond.Disk) && !refExpr.MatchString(cond.Disk) {
+			v.addError(section, step, operation, "when: disk %q is not a device path or reference", cond.Disk)
+		}
+	} else if cond.testsDisk() && !hasDisk {
+		v.addError(section, step, operation, "when: transport, minSize and maxSize require a disk")
+	}
+}
+
+// skipped tells whether the when clause cond can never match the firmware
+// and architecture the recipe is validated for. The step is still checked,
+// but it is not run, so what it would change must be undone with snapshot
+// and restore (e.g. a label step for another firmware).
+func (v *validator) skipped(cond *Condition) bool {
+	if cond == nil {
+		return false
+	}
+	if len(cond.Firmware) > 0 && !cond.Firmware.match(string(v.firmware)) {
+		return true
+	}
+
+	return v.arch != "" && len(cond.Arch) > 0 && !cond.Arch.match(v.arch)
+}
+
+// snapshot returns a copy of the disks, devices and ids v tracks, which
+// restore brings back.
+func (v *validator) snapshot() validator {
+	saved := *v
+	saved.disks = map[string]*diskState{}
+	for path, state := range v.disks {
+		copied := *state
+		copied.partitions = slices.Clone(state.partitions)
+		copied.biosBoot = slices.Clone(state.biosBoot)
+		saved.disks[path] = &copied
+	}
+	saved.partitions = maps.Clone(v.partitions)
+	saved.vgs, saved.removedVgs = maps.Clone(v.vgs), maps.Clone(v.removedVgs)
+	saved.lvs, saved.removedLvs = maps.Clone(v.lvs), maps.Clone(v.removedLvs)
+	saved.ids = maps.Clone(v.ids)
+
+	return saved
+}
+
+// restore undoes the changes made since saved was taken with snapshot,
+// keeping the errors found since.
+func (v *validator) restore(saved validator) {
+	saved.errs = v.errs
+	*v = saved
+}
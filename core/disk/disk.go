@@ -7,10 +7,10 @@ import (
 	"os"
 	"reflect"
 	"slices"
-	"strconv"
 	"strings"
 	"time"
 
+	luks "github.com/vanilla-os/albius/core/disk/luks"
 	"github.com/vanilla-os/albius/core/lvm"
 	"github.com/vanilla-os/albius/core/util"
 )
@@ -33,50 +33,157 @@ type Disk struct {
 	PhysicalSectorSize           int `json:"physical-sector-size"`
 	MaxPartitions                int `json:"max-partitions"`
 	Partitions                   []Partition
+
+	// The fields below are only filled by ListDisks
+
+	Serial string `json:"serial,omitempty"`
+	// Removable tells whether the disk is removable media (e.g. a USB drive)
+	Removable bool `json:"removable"`
+	// Rotational tells whether the disk is a spinning hard drive
+	Rotational bool `json:"rotational"`
 }
 
+// AvailableSectors returns the free regions of the disk, in MiB.
+//
+// Deprecated: use FreeRegions, which reports sizes in bytes.
 func (disk *Disk) AvailableSectors() ([]Sector, error) {
+	regions, err := disk.FreeRegions()
+	if err != nil {
+		return []Sector{}, err
+	}
+
 	sectors := []Sector{}
+	for _, region := range regions {
+		sectors = append(sectors, Sector{int(region.Start.Bytes / util.MiB), int(region.End.Bytes / util.MiB)})
+	}
 
-	for i, part := range disk.Partitions {
-		endInt, err := strconv.Atoi(part.End[:len(part.End)-3])
-		if err != nil {
-			return []Sector{}, fmt.Errorf("failed to retrieve end position of partition: %s", err)
+	return sectors, nil
+}
+
+// partitionAlignment is the boundary free regions, and the partitions
+// created in them, are aligned to
+const partitionAlignment = util.MiB
+
+// gptBackupSectors is the number of sectors at the end of a GPT disk holding
+// the backup header and partition entries
+const gptBackupSectors = 33
+
+func alignUp(n int64) int64 {
+	return (n + partitionAlignment - 1) / partitionAlignment * partitionAlignment
+}
+
+func alignDown(n int64) int64 {
+	return n / partitionAlignment * partitionAlignment
+}
+
+// FreeRegion is an unallocated area of a disk where a partition can be
+// created.
+type FreeRegion struct {
+	Start util.Size `json:"start"`
+	End   util.Size `json:"end"`
+}
+
+// Size returns the size of the region.
+func (region FreeRegion) Size() util.Size {
+	return util.Size{Bytes: region.End.Bytes - region.Start.Bytes}
+}
+
+func (region FreeRegion) String() string {
+	return fmt.Sprintf("%s to %s (%s)", region.Start, region.End, region.Size())
+}
+
+// FreeRegions returns the unallocated areas of the disk, in order. Regions
+// are aligned to 1MiB, and exclude the space used by the partition table
+// (including the backup GPT header at the end of GPT disks). A disk with no
+// partitions has a single region spanning the whole disk.
+func (disk *Disk) FreeRegions() ([]FreeRegion, error) {
+	diskSize, err := disk.sizeBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	usableEnd := diskSize
+	if disk.Label == GPT {
+		sectorSize := int64(disk.LogicalSectorSize)
+		if sectorSize == 0 {
+			sectorSize = 512
 		}
+		usableEnd -= gptBackupSectors * sectorSize
+	}
+	usableEnd = alignDown(usableEnd)
 
-		if i < len(disk.Partitions)-1 {
-			nextStart := disk.Partitions[i+1].Start
-			nextStartInt, err := strconv.Atoi(nextStart[:len(nextStart)-3])
-			if err != nil {
-				return []Sector{}, fmt.Errorf("failed to retrieve start position of next partition: %s", err)
-			}
+	type extent struct{ start, end int64 }
+	used := []extent{}
+	for _, part := range disk.Partitions {
+		start, err := partedMiB(part.Start)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve start position of partition %d: %s", part.Number, err)
+		}
+		end, err := partedMiB(part.End)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve end position of partition %d: %s", part.Number, err)
+		}
+		used = append(used, extent{int64(start * float64(util.MiB)), int64(end * float64(util.MiB))})
+	}
+	slices.SortFunc(used, func(a, b extent) int { return cmp.Compare(a.start, b.start) })
 
-			if endInt != nextStartInt {
-				sectors = append(sectors, Sector{endInt, nextStartInt})
-			}
+	regions := []FreeRegion{}
+	addRegion := func(start, end int64) {
+		start, end = alignUp(start), min(alignDown(end), usableEnd)
+		if start < end {
+			regions = append(regions, FreeRegion{util.Size{Bytes: start}, util.Size{Bytes: end}})
 		}
 	}
 
-	// Handle empty space after last partition
-	lastPartitionEndStr := disk.Partitions[len(disk.Partitions)-1].End
-	lastPartitionEnd, err := strconv.Atoi(lastPartitionEndStr[:len(lastPartitionEndStr)-3])
+	// The first MiB holds the partition table
+	pos := partitionAlignment
+	for _, ext := range used {
+		addRegion(pos, ext.start)
+		// Logical partitions are inside the extended one
+		pos = max(pos, ext.end)
+	}
+	addRegion(pos, usableEnd)
+
+	return regions, nil
+}
+
+// LargestFreeRegion returns the largest unallocated area of the disk, see
+// FreeRegions.
+func (disk *Disk) LargestFreeRegion() (FreeRegion, error) {
+	regions, err := disk.FreeRegions()
 	if err != nil {
-		return []Sector{}, fmt.Errorf("failed to retrieve end position of last partition: %s", err)
+		return FreeRegion{}, err
 	}
-	diskEnd, err := strconv.Atoi(disk.Size[:len(disk.Size)-3])
+	if len(regions) == 0 {
+		return FreeRegion{}, fmt.Errorf("no free space left on %s", disk.Path)
+	}
+
+	return slices.MaxFunc(regions, func(a, b FreeRegion) int {
+		return cmp.Compare(a.Size().Bytes, b.Size().Bytes)
+	}), nil
+}
+
+// FreeRegionWithin returns the first unallocated area of the disk inside
+// bounds, clipped to them.
+func (disk *Disk) FreeRegionWithin(bounds FreeRegion) (FreeRegion, error) {
+	regions, err := disk.FreeRegions()
 	if err != nil {
-		return []Sector{}, fmt.Errorf("failed to retrieve disk end")
+		return FreeRegion{}, err
 	}
-	if lastPartitionEnd < diskEnd {
-		sectors = append(sectors, Sector{lastPartitionEnd, diskEnd})
+
+	for _, region := range regions {
+		start := max(region.Start.Bytes, bounds.Start.Bytes)
+		end := min(region.End.Bytes, bounds.End.Bytes)
+		if start < end {
+			return FreeRegion{util.Size{Bytes: start}, util.Size{Bytes: end}}, nil
+		}
 	}
 
-	return sectors, nil
+	return FreeRegion{}, fmt.Errorf("no free space left between %s and %s on %s", bounds.Start, bounds.End, disk.Path)
 }
 
 func LocateDisk(diskname string) (*Disk, error) {
-	findPartitionCmd := "parted -sj %s unit MiB print"
-	output, err := util.OutputCommand(fmt.Sprintf(findPartitionCmd, diskname))
+	output, err := util.OutputCommand("parted", "-sj", diskname, "unit", "MiB", "print")
 	// If disk is unformatted, parted returns the expected json but also throws an error.
 	// We can assume we have all the necessary information if output isn't empty.
 	if err != nil && output == "" {
@@ -125,18 +232,13 @@ func (disk *Disk) Update() error {
 // inform the OS of changes to the partition table (using `partprobe`) and
 // ensure the system is aware of it before proceeding.
 func (disk *Disk) waitForNewPartition() error {
-	err := util.RunCommand(fmt.Sprintf("partprobe %s", disk.Path))
+	err := util.RunCommand("partprobe", disk.Path)
 	if err != nil {
 		return err
 	}
 
 	for {
-		output, err := util.OutputCommand(fmt.Sprintf("lsblk -nro NAME %s | wc -l", disk.Path))
-		if err != nil {
-			return err
-		}
-
-		count, err := strconv.Atoi(strings.TrimSpace(output))
+		count, err := countBlockDevices(disk.Path)
 		if err != nil {
 			return err
 		}
@@ -147,9 +249,22 @@ func (disk *Disk) waitForNewPartition() error {
 	}
 }
 
-func (disk *Disk) LabelDisk(label DiskLabel) error {
-	labelDiskCmd := "parted -s %s mklabel %s"
+// countBlockDevices returns the number of block devices in path, which
+// includes the device itself and all of its partitions.
+func countBlockDevices(path string) (int, error) {
+	output, err := util.OutputCommand("lsblk", "-nro", "NAME", path)
+	if err != nil {
+		return 0, err
+	}
+
+	if output == "" {
+		return 0, nil
+	}
+
+	return len(strings.Split(output, "\n")), nil
+}
 
+func (disk *Disk) LabelDisk(label DiskLabel) error {
 	// Unmount partitions
 	for _, part := range disk.Partitions {
 		if err := part.UnmountPartition(); err != nil {
@@ -182,7 +297,7 @@ func (disk *Disk) LabelDisk(label DiskLabel) error {
 		}
 	}
 
-	err = util.RunCommand(fmt.Sprintf(labelDiskCmd, disk.Path, label))
+	err = util.RunCommand("parted", "-s", disk.Path, "mklabel", string(label))
 	if err != nil {
 		return fmt.Errorf("failed to label disk: %s", err)
 	}
@@ -190,35 +305,82 @@ func (disk *Disk) LabelDisk(label DiskLabel) error {
 	return nil
 }
 
+// sizeBytes returns the size of the disk in bytes.
+func (target *Disk) sizeBytes() (int64, error) {
+	size, err := partedMiB(target.Size)
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve disk size: %s", err)
+	}
+
+	return int64(size * float64(util.MiB)), nil
+}
+
+// partedPosition converts pos into a position in MiB within target, as
+// passed to parted. Positions are rounded down to whole MiB, which keeps
+// partitions aligned.
+func (target *Disk) partedPosition(pos util.Size) (string, error) {
+	if pos.Kind == util.SizeRest {
+		return "100%", nil
+	}
+
+	diskSize, err := target.sizeBytes()
+	if err != nil {
+		return "", err
+	}
+	bytes, err := pos.Resolve(diskSize)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprint(bytes / util.MiB), nil
+}
+
 // NewPartition creates a new partition on Disk with the provided name,
-// filesystem type, and start and end locations.
+// filesystem type, and start and end locations. Positions relative to the
+// end of the disk or percentages refer to the whole disk, and an end of
+// util.RestSize() uses all the remaining space.
 //
 // If fsType is an empty string, the function will skip creating the filesystem.
 // This can be useful when creating LUKS-encrypted partitions, where the format
 // operation needs to be executed first.
-func (target *Disk) NewPartition(name string, fsType PartitionFs, start, end int) (*Partition, error) {
-	createPartCmd := "parted -s %s unit MiB mkpart%s%s %s %d %s"
-
-	var partType string
+func (target *Disk) NewPartition(name string, fsType PartitionFs, start, end util.Size) (*Partition, error) {
+	args := []string{"-s", target.Path, "unit", "MiB", "mkpart"}
 	if target.Label == MSDOS {
-		partType = " primary"
-	} else {
-		partType = ""
+		args = append(args, "primary")
 	}
 
-	var endStr string
-	if end == -1 {
-		endStr = "100%"
-	} else {
-		endStr = fmt.Sprint(end)
+	if start.Kind == util.SizeRest {
+		return nil, fmt.Errorf("failed to create partition: start position cannot be %s", start)
+	}
+	startStr, err := target.partedPosition(start)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create partition: invalid start position: %s", err)
+	}
+	endStr, err := target.partedPosition(end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create partition: invalid end position: %s", err)
 	}
 
-	partName := ""
 	if name != "" {
-		partName = fmt.Sprintf(" \"%s\"", name)
+		partName, err := quotePartedString(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create partition: %s", err)
+		}
+		args = append(args, partName)
+	}
+
+	if fsType != "" {
+		args = append(args, string(fsType))
 	}
 
-	err := util.RunCommand(fmt.Sprintf(createPartCmd, target.Path, partType, partName, fsType, start, endStr))
+	// parted uses the lowest free number, which is not necessarily the
+	// highest one once partitions were removed
+	oldNumbers := []int{}
+	for _, part := range target.Partitions {
+		oldNumbers = append(oldNumbers, part.Number)
+	}
+
+	err = util.RunCommand("parted", append(args, startStr, endStr)...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create partition: %s", err)
 	}
@@ -235,7 +397,11 @@ func (target *Disk) NewPartition(name string, fsType PartitionFs, start, end int
 		return nil, fmt.Errorf("failed to create partition: %s", err)
 	}
 
-	newPartition := &target.Partitions[len(target.Partitions)-1]
+	idx := slices.IndexFunc(target.Partitions, func(part Partition) bool { return !slices.Contains(oldNumbers, part.Number) })
+	if idx < 0 {
+		return nil, fmt.Errorf("failed to create partition: no new partition found on %s", target.Path)
+	}
+	newPartition := &target.Partitions[idx]
 	newPartition.FillPath(target.Path)
 
 	// Create filesystem
@@ -263,6 +429,45 @@ func (target *Disk) NewPartition(name string, fsType PartitionFs, start, end int
 	return newPartition, nil
 }
 
+// NewEncryptedPartition creates a new partition on Disk like NewPartition,
+// but encrypts it with LUKS2 using password before creating the fsType
+// filesystem inside it. The encrypted device is left open.
+func (target *Disk) NewEncryptedPartition(name string, fsType PartitionFs, start, end util.Size, password string) (*Partition, error) {
+	part, err := target.NewPartition(name, "", start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	err = luks.LuksFormat(part, password)
+	if err != nil {
+		return nil, err
+	}
+
+	// lsblk seems to take a few milliseconds to update the partition's
+	// UUID, so we loop until it gives us one
+	part.WaitUntilAvailable()
+	uuid, err := part.GetUUID()
+	if err != nil {
+		return nil, err
+	}
+	err = luks.LuksOpen(part, fmt.Sprintf("luks-%s", uuid), password)
+	if err != nil {
+		return nil, err
+	}
+
+	part.Filesystem = fsType
+	err = LUKSMakeFs(*part)
+	if err != nil {
+		return nil, err
+	}
+	err = LUKSSetLabel(part, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return part, nil
+}
+
 // GetPartition attempts to locate a partition by its number. For instance, partition 3
 // will normally point to `/dev/sda3`, but this might not be the case if partitions have
 // been deleted (see [Issue #44]). This function searches all partitions in target for
@@ -316,23 +521,23 @@ func setField(obj interface{}, name string, value interface{}) error {
 // This is particularly useful to make sure a recently modified disk
 // is recognized by the system.
 func (disk *Disk) WaitUntilAvailable() error {
+	// Nothing was actually modified
+	if util.DryRun() {
+		return nil
+	}
+
 	printedAlready := false
 	for i := 0; i < 600; i++ {
 		_, err := os.Stat(disk.Path)
 		if os.IsNotExist(err) {
 			if !printedAlready {
-				fmt.Println("Disk not found, retrying...")
+				util.Logf("Disk not found, retrying...")
 			}
 			time.Sleep(50 * time.Millisecond)
 			continue
 		}
 
-		output, err := util.OutputCommand(fmt.Sprintf("lsblk -nro NAME %s | wc -l", disk.Path))
-		if err != nil {
-			return err
-		}
-
-		count, err := strconv.Atoi(strings.TrimSpace(output))
+		count, err := countBlockDevices(disk.Path)
 		if err != nil {
 			return err
 		}
@@ -342,7 +547,7 @@ func (disk *Disk) WaitUntilAvailable() error {
 		}
 
 		if !printedAlready {
-			fmt.Println("Disk not valid, retrying...")
+			util.Logf("Disk not valid, retrying...")
 		}
 		time.Sleep(50 * time.Millisecond)
 	}
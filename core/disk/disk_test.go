@@ -6,10 +6,12 @@ import (
 	"os/exec"
 	"os/user"
 	"runtime"
+	"slices"
 	"strings"
 	"testing"
 
 	luks "github.com/vanilla-os/albius/core/disk/luks"
+	"github.com/vanilla-os/albius/core/util"
 )
 
 var diskPath string
@@ -76,12 +78,12 @@ func TestNewPartition(t *testing.T) {
 		t.Error(err)
 	}
 
-	_, err = d.NewPartition("", EXT4, 1, 25)
+	_, err = d.NewPartition("", EXT4, util.MiBSize(1), util.MiBSize(25))
 	if err != nil {
 		t.Error(err)
 	}
 
-	_, err = d.NewPartition("", EXT4, 26, -1)
+	_, err = d.NewPartition("", EXT4, util.MiBSize(26), util.RestSize())
 	if err != nil {
 		t.Error(err)
 	}
@@ -150,3 +152,45 @@ func TestLuksClose(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestFreeRegions(t *testing.T) {
+	mib := func(start, end float64) FreeRegion {
+		return FreeRegion{Start: util.MiBSize(start), End: util.MiBSize(end)}
+	}
+
+	target := &Disk{Path: "/dev/sda", Size: "20480MiB", Label: GPT, LogicalSectorSize: 512}
+	regions, err := target.FreeRegions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The backup GPT header takes the last MiB once aligned
+	if !slices.Equal(regions, []FreeRegion{mib(1, 20479)}) {
+		t.Errorf("unexpected free regions on an empty disk: %v", regions)
+	}
+
+	target.Partitions = []Partition{
+		{Number: 2, Start: "2048MiB", End: "4096MiB"},
+		{Number: 1, Start: "1.00MiB", End: "1025MiB"},
+	}
+	regions, err = target.FreeRegions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(regions, []FreeRegion{mib(1025, 2048), mib(4096, 20479)}) {
+		t.Errorf("unexpected free regions: %v", regions)
+	}
+
+	largest, err := target.LargestFreeRegion()
+	if err != nil || largest != mib(4096, 20479) {
+		t.Errorf("unexpected largest free region %s (%v)", largest, err)
+	}
+
+	target.Label = MSDOS
+	sectors, err := target.AvailableSectors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(sectors, []Sector{{Start: 1025, End: 2048}, {Start: 4096, End: 20480}}) {
+		t.Errorf("unexpected available sectors: %v", sectors)
+	}
+}
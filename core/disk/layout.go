@@ -0,0 +1,289 @@
+package disk
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/vanilla-os/albius/core/util"
+)
+
+// Firmware is the kind of firmware the installed system boots with.
+type Firmware string
+
+const (
+	EFI  Firmware = "efi"
+	BIOS Firmware = "bios"
+)
+
+// EFIFirmwareDir only exists when the running system booted with UEFI
+const EFIFirmwareDir = "/sys/firmware/efi"
+
+// DetectFirmware returns the firmware the running system booted with.
+func DetectFirmware() Firmware {
+	if _, err := os.Stat(EFIFirmwareDir); err == nil {
+		return EFI
+	}
+
+	return BIOS
+}
+
+// LayoutPartition describes a partition created by an automatic layout.
+type LayoutPartition struct {
+	Name string `json:"name"`
+	// Filesystem is created in the partition, unless empty
+	Filesystem PartitionFs `json:"filesystem,omitempty"`
+	// Mountpoint is where the partition is mounted in the installed system,
+	// if anywhere
+	Mountpoint string `json:"mountpoint,omitempty"`
+	// Min is the smallest size the partition can have
+	Min util.Size `json:"min"`
+	// Max is the largest size the partition can have, or zero for no limit
+	Max util.Size `json:"max,omitempty"`
+	// Weight is the share of the space left after every partition got its
+	// Min size that goes to this partition. Partitions with no weight keep
+	// their Min size.
+	Weight int `json:"weight,omitempty"`
+	// Encrypt tells whether the partition is encrypted with LUKS when the
+	// layout is applied with a password
+	Encrypt bool `json:"encrypt,omitempty"`
+	// Flags are set on the partition, see SetPartitionFlag
+	Flags []string `json:"flags,omitempty"`
+	// Firmware restricts the partition to systems booting with it, if set
+	Firmware Firmware `json:"firmware,omitempty"`
+}
+
+// LayoutPolicy describes the partitions created by an automatic layout, in
+// order.
+type LayoutPolicy struct {
+	Partitions []LayoutPartition `json:"partitions"`
+}
+
+// DefaultLayoutPolicy returns the standard Vanilla OS layout: a boot
+// partition, an EFI system partition (or a BIOS boot partition), the A and B
+// roots and home, with the roots and home encrypted if requested.
+func DefaultLayoutPolicy() LayoutPolicy {
+	fixed := func(mib float64) (util.Size, util.Size) {
+		return util.MiBSize(mib), util.MiBSize(mib)
+	}
+	boot := LayoutPartition{Name: "boot", Filesystem: EXT4, Mountpoint: "/boot"}
+	boot.Min, boot.Max = fixed(1024)
+	efi := LayoutPartition{Name: "efi", Filesystem: FAT32, Mountpoint: "/boot/efi", Flags: []string{"esp"}, Firmware: EFI}
+	efi.Min, efi.Max = fixed(512)
+	biosBoot := LayoutPartition{Name: "bios", Flags: []string{"bios_grub"}, Firmware: BIOS}
+	biosBoot.Min, biosBoot.Max = fixed(1)
+
+	root := func(name string) LayoutPartition {
+		return LayoutPartition{
+			Name:       name,
+			Filesystem: BTRFS,
+			Mountpoint: "/",
+			Min:        util.MiBSize(12 * 1024),
+			Max:        util.MiBSize(32 * 1024),
+			Weight:     1,
+			Encrypt:    true,
+		}
+	}
+
+	return LayoutPolicy{Partitions: []LayoutPartition{
+		boot,
+		efi,
+		biosBoot,
+		root("a"),
+		root("b"),
+		{Name: "home", Filesystem: BTRFS, Mountpoint: "/home", Min: util.MiBSize(8 * 1024), Weight: 4, Encrypt: true},
+	}}
+}
+
+// ForFirmware returns the partitions of the policy created on systems
+// booting with firmware. The first one is partition number 1, and so on.
+func (policy LayoutPolicy) ForFirmware(firmware Firmware) []LayoutPartition {
+	partitions := []LayoutPartition{}
+	for _, part := range policy.Partitions {
+		if part.Firmware == "" || part.Firmware == firmware {
+			partitions = append(partitions, part)
+		}
+	}
+
+	return partitions
+}
+
+// Check ensures the policy can be laid out on some disk.
+func (policy LayoutPolicy) Check() error {
+	if len(policy.Partitions) == 0 {
+		return fmt.Errorf("layout policy has no partitions")
+	}
+
+	for _, part := range policy.Partitions {
+		if part.Name == "" {
+			return fmt.Errorf("layout partitions must have a name")
+		}
+		if part.Firmware != "" && part.Firmware != EFI && part.Firmware != BIOS {
+			return fmt.Errorf("partition %s: unsupported firmware %q", part.Name, part.Firmware)
+		}
+		if part.Min.Kind != util.SizeAbsolute || part.Max.Kind != util.SizeAbsolute {
+			return fmt.Errorf("partition %s: min and max must be absolute sizes", part.Name)
+		}
+		if part.Min.Bytes <= 0 {
+			return fmt.Errorf("partition %s: min must be greater than zero", part.Name)
+		}
+		if part.Max.Bytes != 0 && part.Max.Bytes < part.Min.Bytes {
+			return fmt.Errorf("partition %s: max (%s) is smaller than min (%s)", part.Name, part.Max, part.Min)
+		}
+		if part.Weight < 0 {
+			return fmt.Errorf("partition %s: weight cannot be negative", part.Name)
+		}
+	}
+
+	return nil
+}
+
+// LayoutEntry is a partition placed on disk by ComputeLayout.
+type LayoutEntry struct {
+	LayoutPartition
+	Number int `json:"number"`
+	// Start and End are the partition's boundaries, in bytes
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	// Encrypted tells whether the partition will be encrypted with LUKS
+	Encrypted bool `json:"encrypted"`
+}
+
+// Layout is the partition table computed for a disk by ComputeLayout.
+type Layout struct {
+	Label      DiskLabel     `json:"label"`
+	Partitions []LayoutEntry `json:"partitions"`
+}
+
+// ComputeLayout places the partitions of policy for firmware on a disk of
+// diskSize bytes. Every partition gets its Min size, and the remaining space
+// is split by weight without exceeding Max sizes. Partitions are aligned to
+// 1MiB, and the space which cannot be given to any partition is left free at
+// the end of the disk.
+func ComputeLayout(diskSize int64, firmware Firmware, encrypt bool, policy LayoutPolicy) (*Layout, error) {
+	if firmware != EFI && firmware != BIOS {
+		return nil, fmt.Errorf("unsupported firmware %q, expected %q or %q", firmware, EFI, BIOS)
+	}
+	err := policy.Check()
+	if err != nil {
+		return nil, err
+	}
+
+	partitions := policy.ForFirmware(firmware)
+	sizes := make([]int64, len(partitions))
+	var needed int64
+	for i, part := range partitions {
+		sizes[i] = alignUp(part.Min.Bytes)
+		needed += sizes[i]
+	}
+
+	// Keep the first MiB for the partition table, and the last for the
+	// backup GPT header
+	start := partitionAlignment
+	available := alignDown(diskSize-partitionAlignment) - start
+	if needed > available {
+		return nil, fmt.Errorf("disk is too small for the layout: need at least %s, got %s", util.Size{Bytes: needed + 2*partitionAlignment}, util.Size{Bytes: diskSize})
+	}
+
+	// Hand out the remaining space by weight. Partitions reaching their Max
+	// size stop growing, so repeat until nothing more can be given.
+	extra := available - needed
+	for extra >= partitionAlignment {
+		growable := []int{}
+		totalWeight := 0
+		for i, part := range partitions {
+			if part.Weight > 0 && (part.Max.Bytes == 0 || sizes[i] < alignDown(part.Max.Bytes)) {
+				growable = append(growable, i)
+				totalWeight += part.Weight
+			}
+		}
+		if len(growable) == 0 {
+			break
+		}
+
+		var given int64
+		for _, i := range growable {
+			share := alignDown(extra * int64(partitions[i].Weight) / int64(totalWeight))
+			if maxSize := alignDown(partitions[i].Max.Bytes); maxSize != 0 && sizes[i]+share > maxSize {
+				share = maxSize - sizes[i]
+			}
+			sizes[i] += share
+			given += share
+		}
+		if given == 0 {
+			// The space left is too small to be split, so give it away one
+			// alignment unit at a time
+			sizes[growable[0]] += partitionAlignment
+			given = partitionAlignment
+		}
+		extra -= given
+	}
+
+	layout := &Layout{Label: GPT}
+	for i, part := range partitions {
+		layout.Partitions = append(layout.Partitions, LayoutEntry{
+			LayoutPartition: part,
+			Number:          i + 1,
+			Start:           start,
+			End:             start + sizes[i],
+			Encrypted:       encrypt && part.Encrypt && part.Filesystem != "",
+		})
+		start += sizes[i]
+	}
+
+	return layout, nil
+}
+
+// ApplyLayout replaces the partition table of target with layout, creating
+// the filesystems and setting the flags of every partition. Encrypted
+// partitions use luksPassword.
+func (target *Disk) ApplyLayout(layout *Layout, luksPassword string) error {
+	err := target.LabelDisk(layout.Label)
+	if err != nil {
+		return err
+	}
+	err = target.Update()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range layout.Partitions {
+		start := util.Size{Bytes: entry.Start}
+		end := util.Size{Bytes: entry.End}
+
+		var part *Partition
+		if entry.Encrypted {
+			part, err = target.NewEncryptedPartition(entry.Name, entry.Filesystem, start, end, luksPassword)
+		} else {
+			part, err = target.NewPartition(entry.Name, entry.Filesystem, start, end)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create partition %s: %s", entry.Name, err)
+		}
+
+		for _, flag := range entry.Flags {
+			err = part.SetPartitionFlag(flag, true)
+			if err != nil {
+				return fmt.Errorf("failed to set flag %s on partition %s: %s", flag, entry.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// AutoLayout computes the layout of policy for target (see ComputeLayout)
+// and applies it. If luksPassword is not empty, the partitions of the policy
+// meant to be encrypted are encrypted with it.
+func (target *Disk) AutoLayout(firmware Firmware, luksPassword string, policy LayoutPolicy) (*Layout, error) {
+	diskSize, err := target.sizeBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	layout, err := ComputeLayout(diskSize, firmware, luksPassword != "", policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return layout, target.ApplyLayout(layout, luksPassword)
+}
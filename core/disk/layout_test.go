@@ -0,0 +1,58 @@
+package disk
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/vanilla-os/albius/core/util"
+)
+
+func TestComputeLayout(t *testing.T) {
+	layout, err := ComputeLayout(64*util.GiB, EFI, true, DefaultLayoutPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	end := util.MiB
+	for i, part := range layout.Partitions {
+		names = append(names, part.Name)
+		if part.Number != i+1 || part.Start != end || part.Start%util.MiB != 0 || part.End%util.MiB != 0 {
+			t.Errorf("partition %s is misplaced: %+v", part.Name, part)
+		}
+		if part.End-part.Start < part.Min.Bytes || (part.Max.Bytes != 0 && part.End-part.Start > part.Max.Bytes) {
+			t.Errorf("partition %s does not respect its limits: %+v", part.Name, part)
+		}
+		end = part.End
+	}
+	if !slices.Equal(names, []string{"boot", "efi", "a", "b", "home"}) {
+		t.Fatalf("unexpected partitions %v", names)
+	}
+	if free := 64*util.GiB - end; free < util.MiB || free >= 2*util.MiB {
+		t.Errorf("expected the whole disk to be used, %d bytes are left", free)
+	}
+	if !layout.Partitions[2].Encrypted || layout.Partitions[0].Encrypted {
+		t.Errorf("unexpected encryption: %+v", layout.Partitions)
+	}
+	// The roots share the space by weight with home
+	if rootA, home := layout.Partitions[2], layout.Partitions[4]; (home.End-home.Start)-home.Min.Bytes != 4*((rootA.End-rootA.Start)-rootA.Min.Bytes) {
+		t.Errorf("space was not split by weight: %+v", layout.Partitions)
+	}
+
+	// Roots stop growing at their max size
+	layout, err = ComputeLayout(util.TiB, BIOS, false, DefaultLayoutPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bios := layout.Partitions[1]; bios.Name != "bios" || !slices.Contains(bios.Flags, "bios_grub") {
+		t.Errorf("expected a BIOS boot partition, got %+v", bios)
+	}
+	if rootA := layout.Partitions[2]; rootA.End-rootA.Start != 32*util.GiB || rootA.Encrypted {
+		t.Errorf("unexpected root partition %+v", rootA)
+	}
+
+	_, err = ComputeLayout(20*util.GiB, EFI, false, DefaultLayoutPolicy())
+	if err == nil {
+		t.Error("expected an error for a disk too small for the layout")
+	}
+}
@@ -0,0 +1,129 @@
+package disk
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/vanilla-os/albius/core/lvm"
+	"github.com/vanilla-os/albius/core/util"
+)
+
+// lsblkColumns are the columns ListDisks reads from lsblk
+const lsblkColumns = "NAME,PATH,TYPE,SIZE,SERIAL,RM,ROTA,FSTYPE,LABEL,UUID,PARTLABEL,PARTUUID,MOUNTPOINTS"
+
+// lsblkBool reads boolean columns, which older versions of lsblk print as
+// "0" or "1".
+type lsblkBool bool
+
+func (b *lsblkBool) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case "true", `"1"`, "1":
+		*b = true
+	case "false", `"0"`, "0", "null":
+		*b = false
+	default:
+		return fmt.Errorf("invalid boolean %s", data)
+	}
+
+	return nil
+}
+
+type lsblkDevice struct {
+	Path        string        `json:"path"`
+	Type        string        `json:"type"`
+	Size        int64         `json:"size"`
+	Serial      string        `json:"serial"`
+	Removable   lsblkBool     `json:"rm"`
+	Rotational  lsblkBool     `json:"rota"`
+	FsType      string        `json:"fstype"`
+	Label       string        `json:"label"`
+	UUID        string        `json:"uuid"`
+	PartLabel   string        `json:"partlabel"`
+	PartUUID    string        `json:"partuuid"`
+	Mountpoints []string      `json:"mountpoints"`
+	Children    []lsblkDevice `json:"children"`
+}
+
+// mountpoints returns where dev and every device stacked on it are mounted.
+func (dev lsblkDevice) mountpoints() []string {
+	mountpoints := []string{}
+	for _, mnt := range dev.Mountpoints {
+		// lsblk reports null for unmounted devices
+		if mnt != "" {
+			mountpoints = append(mountpoints, mnt)
+		}
+	}
+	for _, child := range dev.Children {
+		mountpoints = append(mountpoints, child.mountpoints()...)
+	}
+
+	return mountpoints
+}
+
+// ListDisks returns every disk on the system which could be an installation
+// target, like LocateDisk would, along with details useful to choose one:
+// their serial number, whether they are removable or rotational, and the
+// labels, UUIDs, mountpoints, LUKS encryption and LVM volume group of their
+// partitions. Empty devices (e.g. card readers with no card) are skipped.
+func ListDisks() ([]Disk, error) {
+	output, err := util.OutputCommand("lsblk", "-J", "-b", "-o", lsblkColumns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list block devices: %s", err)
+	}
+
+	var decoded struct {
+		BlockDevices []lsblkDevice `json:"blockdevices"`
+	}
+	err = json.Unmarshal([]byte(output), &decoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list block devices: %s", err)
+	}
+
+	// Without LVM (e.g. if lvm2 is not installed), no partition is in a VG
+	pvs, err := lvm.Pvs()
+	if err != nil {
+		util.Logf("Failed to list physical volumes, ignoring volume groups: %s", err)
+		pvs = []lvm.Pv{}
+	}
+
+	disks := []Disk{}
+	for _, dev := range decoded.BlockDevices {
+		if dev.Type != "disk" || dev.Size == 0 {
+			continue
+		}
+
+		target, err := LocateDisk(dev.Path)
+		if err != nil {
+			return nil, err
+		}
+		target.Serial = dev.Serial
+		target.Removable = bool(dev.Removable)
+		target.Rotational = bool(dev.Rotational)
+
+		for i := range target.Partitions {
+			part := &target.Partitions[i]
+			idx := slices.IndexFunc(dev.Children, func(child lsblkDevice) bool { return child.Path == part.Path })
+			if idx < 0 {
+				continue
+			}
+
+			child := dev.Children[idx]
+			part.FsLabel = child.Label
+			part.FsUUID = child.UUID
+			part.PartLabel = child.PartLabel
+			part.PartUUID = child.PartUUID
+			part.MountedAt = child.mountpoints()
+			part.LUKS = child.FsType == "crypto_LUKS"
+			for _, pv := range pvs {
+				if pv.Path == part.Path {
+					part.VG = pv.VgName
+				}
+			}
+		}
+
+		disks = append(disks, *target)
+	}
+
+	return disks, nil
+}
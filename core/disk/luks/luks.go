@@ -1,9 +1,9 @@
 package disk
 
 import (
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"strings"
 
 	"github.com/vanilla-os/albius/core/util"
@@ -15,17 +15,15 @@ type Partition interface {
 }
 
 func IsLuks(part Partition) (bool, error) {
-	isLuksCmd := "cryptsetup isLuks %s"
-
-	cmd := exec.Command("sh", "-c", fmt.Sprintf(isLuksCmd, part.GetPath()))
-	err := cmd.Run()
+	_, err := util.OutputCommand("cryptsetup", "isLuks", part.GetPath())
 	if err != nil {
 		// We expect the command to return exit status 1 if partition isn't LUKS-encrypted
-		if exitError, ok := err.(*exec.ExitError); ok {
-			if exitError.ExitCode() == 1 {
+		var exitError *util.ExitError
+		if errors.As(err, &exitError) {
+			if exitError.Code == 1 {
 				return false, nil
 			} else {
-				return false, fmt.Errorf("failed to check if %s is LUKS-encrypted: %s", part.GetPath(), string(exitError.Stderr))
+				return false, fmt.Errorf("failed to check if %s is LUKS-encrypted: %s", part.GetPath(), exitError.Stderr)
 			}
 		}
 		return false, fmt.Errorf("failed to check if %s is LUKS-encrypted: %s", part.GetPath(), err)
@@ -43,19 +41,16 @@ func IsLuks(part Partition) (bool, error) {
 // WARNING: This function will return an error if mapping already exists, use
 // LuksTryOpen() to open a device while ignoring existing mappings
 func LuksOpen(part Partition, mapping, password string) error {
-	var luksOpenCmd string
-	if password != "" {
-		luksOpenCmd = "printf \"%%s\" \"$LUKSPASS\" | "
-	} else {
-		luksOpenCmd = ""
-	}
-
-	luksOpenCmd += "cryptsetup open %s %s"
+	luksOpenCmd := util.NewCommand("cryptsetup", "open", part.GetPath(), mapping)
+	luksOpenCmd.Stdin = password
 
-	err := util.RunCommand(fmt.Sprintf(luksOpenCmd, part.GetPath(), mapping), "LUKSPASS="+password)
+	err := util.Run(luksOpenCmd)
 	if err != nil {
 		return fmt.Errorf("failed to open LUKS-encrypted partition: %s", err)
 	}
+	util.AddCleanup("luks:"+mapping, "close LUKS mapping "+mapping, func() error {
+		return LuksClose(mapping)
+	})
 
 	return nil
 }
@@ -80,20 +75,20 @@ func LuksTryOpen(part Partition, mapping, password string) error {
 }
 
 func LuksClose(mapping string) error {
-	luksCloseCmd := "cryptsetup close %s"
-
-	err := util.RunCommand(fmt.Sprintf(luksCloseCmd, mapping))
+	err := util.RunCommand("cryptsetup", "close", mapping)
 	if err != nil {
 		return fmt.Errorf("failed to close LUKS-encrypted partition: %s", err)
 	}
+	util.RemoveCleanup("luks:" + mapping)
 
 	return nil
 }
 
 func LuksFormat(part Partition, password string) error {
-	luksFormatCmd := "printf \"%%s\" \"$LUKSPASS\" | cryptsetup -q luksFormat %s"
+	luksFormatCmd := util.NewCommand("cryptsetup", "-q", "luksFormat", part.GetPath())
+	luksFormatCmd.Stdin = password
 
-	err := util.RunCommand(fmt.Sprintf(luksFormatCmd, part.GetPath()), "LUKSPASS="+password)
+	err := util.Run(luksFormatCmd)
 	if err != nil {
 		return fmt.Errorf("failed to create LUKS-encrypted partition: %s", err)
 	}
@@ -102,30 +97,28 @@ func LuksFormat(part Partition, password string) error {
 }
 
 func GenCrypttab(targetRoot string, entries [][]string) error {
-	file, err := os.Create(fmt.Sprintf("%s/etc/crypttab", targetRoot))
-	if err != nil {
-		return err
-	}
-
-	defer file.Close()
-
+	content := []byte{}
 	for _, entry := range entries {
 		fmtEntry := strings.Join(entry, " ")
-		_, err := file.Write(append([]byte(fmtEntry), '\n'))
-		if err != nil {
-			return err
-		}
+		content = append(content, append([]byte(fmtEntry), '\n')...)
 	}
 
-	return nil
+	return util.WriteFile(fmt.Sprintf("%s/etc/crypttab", targetRoot), content, 0o644)
 }
 
 func GetLUKSFilesystemByPath(path string) (string, error) {
-	lsblkCmd := "lsblk -n -o FSTYPE %s | sed '/crypto_LUKS/d'"
-	output, err := util.OutputCommand(fmt.Sprintf(lsblkCmd, path))
+	output, err := util.OutputCommand("lsblk", "-n", "-o", "FSTYPE", path)
 	if err != nil {
 		return "", fmt.Errorf("failed to get encrypted partition FSTYPE: %s", err)
 	}
 
-	return output, nil
+	// The first line is the LUKS container itself
+	filesystems := []string{}
+	for _, fs := range strings.Split(output, "\n") {
+		if fs != "crypto_LUKS" {
+			filesystems = append(filesystems, fs)
+		}
+	}
+
+	return strings.TrimSpace(strings.Join(filesystems, "\n")), nil
 }
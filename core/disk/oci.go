@@ -0,0 +1,663 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/vanilla-os/albius/core/util"
+	"github.com/vanilla-os/prometheus"
+	"go.podman.io/image/v5/copy"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/image"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/signature"
+	"go.podman.io/image/v5/storage"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+// OCIProgress reports how far OCISetup got.
+type OCIProgress struct {
+	// Phase is either "pull", while downloading the image, or "copy",
+	// while copying its contents to the destination
+	Phase string
+	// Layer is the digest of the layer the last pull report was about
+	Layer string
+	// Bytes is the number of bytes pulled or copied so far
+	Bytes int64
+	// TotalBytes is the number of bytes to pull or copy, or 0 if not known
+	TotalBytes int64
+	// Files is the number of layers pulled, or files copied, so far
+	Files int64
+	// TotalFiles is the number of layers to pull, or files to copy, or 0 if
+	// not known
+	TotalFiles int64
+}
+
+// Transports OCISetup reads images from without a network connection
+const (
+	OCIArchive           = "oci-archive"
+	OCILayout            = "oci"
+	OCIContainersStorage = "containers-storage"
+)
+
+// OCISource is where OCISetup gets an image from.
+type OCISource struct {
+	// Transport is either "docker", for images pulled from a registry, or
+	// one of OCIArchive, OCILayout and OCIContainersStorage
+	Transport string
+	// Reference identifies the image within Transport, e.g.
+	// "ghcr.io/vanilla-os/desktop:main" or "/cdrom/image.tar"
+	Reference string
+}
+
+// ParseOCISource parses an installation source for the OCI method. Images
+// are pulled from a registry unless source starts with one of the local
+// transports, as in "oci-archive:/cdrom/image.tar", "oci:/cdrom/image:main"
+// (an OCI layout directory, optionally followed by a tag) or
+// "containers-storage:ghcr.io/vanilla-os/desktop:main".
+func ParseOCISource(source string) (OCISource, error) {
+	parsed := OCISource{Transport: "docker", Reference: strings.TrimPrefix(source, "docker://")}
+	for _, transport := range []string{OCIArchive, OCILayout, OCIContainersStorage} {
+		if reference, ok := strings.CutPrefix(source, transport+":"); ok {
+			parsed = OCISource{Transport: transport, Reference: reference}
+			break
+		}
+	}
+
+	// Parsing local references would access the filesystem or the
+	// container storage, which is left to OCISetup
+	if parsed.Local() {
+		if parsed.Reference == "" {
+			return OCISource{}, fmt.Errorf("invalid OCI image source %q: missing %s reference", source, parsed.Transport)
+		}
+		return parsed, nil
+	}
+
+	_, err := alltransports.ParseImageName(parsed.String())
+	if err != nil {
+		return OCISource{}, fmt.Errorf("invalid OCI image source %q: %s", source, err)
+	}
+
+	return parsed, nil
+}
+
+// Local reports whether the image is read without a network connection.
+func (s OCISource) Local() bool {
+	return s.Transport != "docker"
+}
+
+func (s OCISource) String() string {
+	if s.Transport == "docker" {
+		return "docker://" + s.Reference
+	}
+
+	return s.Transport + ":" + s.Reference
+}
+
+// storedNameExpr matches the characters not allowed in an image name
+var storedNameExpr = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// storedName returns the name a local image is stored as.
+func (s OCISource) storedName() string {
+	return "localhost/" + strings.Trim(storedNameExpr.ReplaceAllString(strings.ToLower(s.String()), "-"), "-._")
+}
+
+// ErrImageVerification is returned by OCISetup when the image does not
+// have the expected digest or its signatures do not satisfy the policy.
+var ErrImageVerification = errors.New("image verification failed")
+
+// OCIVerification restricts which images OCISetup accepts. The zero value
+// accepts any image allowed by the system's default policy.
+type OCIVerification struct {
+	// Digest, if set, is the manifest digest the image must have. Both the
+	// digest of a multi-platform manifest list and the digest of the
+	// manifest for the current platform are accepted.
+	Digest string
+	// PolicyPath, if set, is a containers-policy.json(5) file the image's
+	// signatures must satisfy, instead of the system's default policy. Keys
+	// for simple signing and sigstore (cosign) signatures are referenced
+	// from the policy.
+	PolicyPath string
+}
+
+// OCISetup pulls imageSource (see ParseOCISource) into the storage at
+// storagePath and copies its contents to destination. If progress is not
+// nil, it is called regularly with the progress of the pull and the copy.
+//
+// The image is checked against verify before it is copied to storagePath
+// or destination, and images from a registry are then pulled by the digest
+// which was checked, so a tag moving in the meantime has no effect.
+func OCISetup(imageSource, storagePath, destination string, verify OCIVerification, verbose bool, progress func(OCIProgress)) error {
+	if progress == nil {
+		progress = func(OCIProgress) {}
+	}
+
+	source, err := ParseOCISource(imageSource)
+	if err != nil {
+		return err
+	}
+	// Stored images are named after the source as written in the recipe
+	storedImageName := strings.ReplaceAll(source.Reference, "/", "-")
+
+	pmt, err := prometheus.NewPrometheus(filepath.Join(storagePath, "storage"), "overlay", 0)
+	if err != nil {
+		return fmt.Errorf("failed to create Prometheus instance: %s", err)
+	}
+
+	// Create tmp directory in root's /var to store podman's temp files, since /var/tmp in
+	// the ISO is tied to the user's RAM and can run out of space pretty quickly
+	storageTmpDir := filepath.Join(storagePath, "tmp")
+	err = os.Mkdir(storageTmpDir, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create storage tmp dir: %s", err)
+	}
+	err = util.RunCommand("mount", "--bind", storageTmpDir, "/var/tmp")
+	if err != nil {
+		return fmt.Errorf("failed to mount bind storage tmp dir: %s", err)
+	}
+	util.AddCleanup("mount:/var/tmp", "unmount /var/tmp", func() error {
+		return util.RunCommand("umount", "-l", "/var/tmp")
+	})
+
+	var pulledManifest *prometheus.OciManifest
+	var manifestDigest digest.Digest
+	if source.Local() {
+		pulledManifest, manifestDigest, err = copyLocalImage(pmt, source, verify, progress)
+		if err != nil {
+			return fmt.Errorf("failed to copy OCI image from %s: %s", source, err)
+		}
+	} else {
+		if verify != (OCIVerification{}) {
+			source, err = verifyRemoteImage(source, verify)
+			if err != nil {
+				return err
+			}
+		}
+
+		// try multiple times in case of an unstable connection
+		for range 4 {
+			pulledManifest, manifestDigest, err = pullImage(pmt, source.Reference, storedImageName, progress)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to pull OCI image: %s", err)
+		}
+	}
+
+	id := pulledManifest.Config.Digest.Encoded()
+	util.Logf("Image pulled with ID %s", id)
+
+	image, err := pmt.GetImageById(id)
+	if err != nil {
+		return fmt.Errorf("failed to get image by ID: %s", err)
+	}
+
+	mountPoint, err := pmt.MountImage(image.TopLayer)
+	if err != nil {
+		return fmt.Errorf("failed to mount image at %s: %s", image.TopLayer, err)
+	}
+
+	util.Logf("Image mounted at %s", mountPoint)
+
+	// Rsync image into destination
+	util.Logf("Copying image to %s", destination)
+
+	var verboseFlag string
+	if verbose {
+		verboseFlag = "v"
+	} else {
+		verboseFlag = ""
+	}
+	// --no-inc-recursive makes rsync scan every file before copying, so the
+	// totals it reports are known from the start
+	cmd := util.NewCommand("rsync", fmt.Sprintf("-a%sxHAX", verboseFlag), "--numeric-ids", "--info=progress2", "--no-inc-recursive", mountPoint+"/", destination+"/")
+	cmd.Stdout = &rsyncProgressWriter{progress: progress}
+	err = util.Run(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to sync image contents to %s: %s", destination, err)
+	}
+
+	_, err = pmt.UnMountImage(image.TopLayer, true)
+	if err != nil {
+		return fmt.Errorf("failed to unmount image: %s", err)
+	}
+
+	// Unmount tmp storage directory
+	err = util.RunCommand("umount", "-l", "/var/tmp")
+	if err != nil {
+		return fmt.Errorf("failed to unmount storage tmp dir: %s", err)
+	}
+	util.RemoveCleanup("mount:/var/tmp")
+	entries, err := os.ReadDir(storageTmpDir)
+	if err != nil {
+		return fmt.Errorf("failed to read from storage tmp dir: %s", err)
+	}
+	for _, entry := range entries {
+		err = os.RemoveAll(filepath.Join(storageTmpDir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to remove %s from storage tmp dir: %s", entry.Name(), err)
+		}
+	}
+
+	// Store the digest in destination as it may be used by the update manager
+	err = os.WriteFile(filepath.Join(destination, ".oci_digest"), []byte(manifestDigest), 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to save digest in %s: %s", destination, err)
+	}
+
+	return nil
+}
+
+// pullImage pulls imageSource into pmt's storage as dstName, reporting the
+// progress of every layer.
+func pullImage(pmt *prometheus.Prometheus, imageSource, dstName string, progress func(OCIProgress)) (*prometheus.OciManifest, digest.Digest, error) {
+	imageManifest, manifestDigest, err := pmt.PullManifestOnly(imageSource)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to pull manifest: %s", err)
+	}
+
+	tracker := newPullProgress(imageManifest, progress)
+
+	progressCh := make(chan types.ProgressProperties)
+	manifestCh := make(chan prometheus.OciManifest)
+	errorCh := make(chan error)
+	err = pmt.PullImageAsync(imageSource, dstName, progressCh, manifestCh, errorCh)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for {
+		select {
+		case report := <-progressCh:
+			tracker.report(report)
+		case pulledManifest := <-manifestCh:
+			return &pulledManifest, manifestDigest, nil
+		case err := <-errorCh:
+			return nil, "", err
+		}
+	}
+}
+
+// copyLocalImage checks an image available without a network connection
+// against verify and copies it into pmt's storage, reporting the progress of
+// every layer. The image is opened once, as opening an archive extracts it.
+func copyLocalImage(pmt *prometheus.Prometheus, source OCISource, verify OCIVerification, progress func(OCIProgress)) (*prometheus.OciManifest, digest.Digest, error) {
+	ctx := context.Background()
+	systemCtx := &types.SystemContext{}
+
+	srcRef, err := alltransports.ParseImageName(source.String())
+	if err != nil {
+		return nil, "", err
+	}
+	destRef, err := storage.Transport.ParseStoreReference(pmt.Store, source.storedName())
+	if err != nil {
+		return nil, "", err
+	}
+
+	src, err := srcRef.NewImageSource(ctx, systemCtx)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open image: %s", err)
+	}
+	defer src.Close()
+
+	if verify != (OCIVerification{}) {
+		err = verifyImage(ctx, systemCtx, source, src, verify)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	imageManifest, manifestDigest, err := sourceManifest(ctx, systemCtx, src)
+	if err != nil {
+		return nil, "", err
+	}
+
+	policyCtx, err := policyContext(systemCtx, verify.PolicyPath)
+	if err != nil {
+		return nil, "", err
+	}
+	defer policyCtx.Destroy()
+
+	tracker := newPullProgress(imageManifest, progress)
+	progressCh := make(chan types.ProgressProperties)
+	reported := make(chan struct{})
+	go func() {
+		for report := range progressCh {
+			tracker.report(report)
+		}
+		close(reported)
+	}()
+
+	copiedManifest, err := copy.Image(ctx, policyCtx, destRef, openedReference{srcRef, src}, &copy.Options{
+		ProgressInterval: 100 * time.Millisecond,
+		Progress:         progressCh,
+	})
+	close(progressCh)
+	<-reported
+	if err != nil {
+		return nil, "", err
+	}
+
+	pulledManifest := &prometheus.OciManifest{}
+	err = json.Unmarshal(copiedManifest, pulledManifest)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse manifest: %s", err)
+	}
+
+	return pulledManifest, manifestDigest, nil
+}
+
+// openedReference is an image reference whose source is already open, so
+// copying it does not open it again.
+type openedReference struct {
+	types.ImageReference
+	source types.ImageSource
+}
+
+func (ref openedReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	return unclosedSource{ref.source}, nil
+}
+
+// unclosedSource leaves closing the source to whoever opened it.
+type unclosedSource struct {
+	types.ImageSource
+}
+
+func (unclosedSource) Close() error {
+	return nil
+}
+
+// policyContext returns a context evaluating the policy at path, or the
+// system's default policy if path is empty.
+func policyContext(systemCtx *types.SystemContext, path string) (*signature.PolicyContext, error) {
+	var policy *signature.Policy
+	var err error
+	if path != "" {
+		policy, err = signature.NewPolicyFromFile(path)
+	} else {
+		policy, err = signature.DefaultPolicy(systemCtx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signature policy: %s", err)
+	}
+
+	return signature.NewPolicyContext(policy)
+}
+
+// verifyRemoteImage checks the image at source, from a registry, against
+// verify (see verifyImage), reading only its manifest and signatures. The
+// returned source references the checked manifest by digest.
+func verifyRemoteImage(source OCISource, verify OCIVerification) (OCISource, error) {
+	ctx := context.Background()
+	systemCtx := &types.SystemContext{}
+
+	ref, err := alltransports.ParseImageName(source.String())
+	if err != nil {
+		return OCISource{}, err
+	}
+	src, err := ref.NewImageSource(ctx, systemCtx)
+	if err != nil {
+		return OCISource{}, fmt.Errorf("failed to open image: %s", err)
+	}
+	defer src.Close()
+
+	err = verifyImage(ctx, systemCtx, source, src, verify)
+	if err != nil {
+		return OCISource{}, err
+	}
+	instanceDigest, err := platformDigest(ctx, systemCtx, src)
+	if err != nil {
+		return OCISource{}, err
+	}
+
+	named, err := reference.ParseNormalizedNamed(source.Reference)
+	if err != nil {
+		return OCISource{}, err
+	}
+	pinned, err := reference.WithDigest(reference.TrimNamed(named), instanceDigest)
+	if err != nil {
+		return OCISource{}, err
+	}
+
+	return OCISource{Transport: source.Transport, Reference: pinned.String()}, nil
+}
+
+// verifyImage checks the digest and signatures of src, the image at source,
+// against verify.
+func verifyImage(ctx context.Context, systemCtx *types.SystemContext, source OCISource, src types.ImageSource, verify OCIVerification) error {
+	var expected digest.Digest
+	if verify.Digest != "" {
+		var err error
+		expected, err = digest.Parse(verify.Digest)
+		if err != nil {
+			return fmt.Errorf("invalid image digest %q: %s", verify.Digest, err)
+		}
+	}
+
+	raw, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %s", err)
+	}
+	topDigest, err := manifest.Digest(raw)
+	if err != nil {
+		return fmt.Errorf("failed to compute manifest digest: %s", err)
+	}
+	instanceDigest, err := platformDigest(ctx, systemCtx, src)
+	if err != nil {
+		return err
+	}
+
+	if expected != "" && expected != topDigest && expected != instanceDigest {
+		return fmt.Errorf("%w: %s has digest %s, expected %s", ErrImageVerification, source, instanceDigest, expected)
+	}
+
+	if verify.PolicyPath != "" {
+		policyCtx, err := policyContext(systemCtx, verify.PolicyPath)
+		if err != nil {
+			return err
+		}
+		defer policyCtx.Destroy()
+
+		allowed, err := policyCtx.IsRunningImageAllowed(ctx, image.UnparsedInstance(src, nil))
+		if !allowed {
+			return fmt.Errorf("%w: %s is not allowed by %s: %s", ErrImageVerification, source, verify.PolicyPath, err)
+		}
+	}
+
+	util.Logf("Verified %s as %s", source, instanceDigest)
+	return nil
+}
+
+// platformDigest returns the digest of the manifest of src for the current
+// platform, which is the digest of its manifest unless it is a manifest list.
+func platformDigest(ctx context.Context, systemCtx *types.SystemContext, src types.ImageSource) (digest.Digest, error) {
+	raw, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to read manifest: %s", err)
+	}
+	if !manifest.MIMETypeIsMultiImage(mimeType) {
+		manifestDigest, err := manifest.Digest(raw)
+		if err != nil {
+			return "", fmt.Errorf("failed to compute manifest digest: %s", err)
+		}
+		return manifestDigest, nil
+	}
+
+	list, err := manifest.ListFromBlob(raw, mimeType)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse manifest list: %s", err)
+	}
+	instance, err := list.ChooseInstance(systemCtx)
+	if err != nil {
+		return "", fmt.Errorf("failed to select platform instance: %s", err)
+	}
+
+	return instance, nil
+}
+
+// sourceManifest returns the manifest of source for the current platform,
+// along with its digest, which is what the update manager compares against
+// the registry.
+func sourceManifest(ctx context.Context, systemCtx *types.SystemContext, source types.ImageSource) (manifest.Manifest, digest.Digest, error) {
+	raw, mimeType, err := source.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read manifest: %s", err)
+	}
+
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		list, err := manifest.ListFromBlob(raw, mimeType)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to parse manifest list: %s", err)
+		}
+		instance, err := list.ChooseInstance(systemCtx)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to select platform instance: %s", err)
+		}
+		raw, mimeType, err = source.GetManifest(ctx, &instance)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read platform manifest: %s", err)
+		}
+	}
+
+	parsed, err := manifest.FromBlob(raw, mimeType)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse manifest: %s", err)
+	}
+	manifestDigest, err := manifest.Digest(raw)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to compute manifest digest: %s", err)
+	}
+
+	return parsed, manifestDigest, nil
+}
+
+// pullProgress turns the progress reports of an image copy into
+// OCIProgress reports.
+type pullProgress struct {
+	progress func(OCIProgress)
+	state    OCIProgress
+	// reading holds the bytes read of the blobs being copied, which may be
+	// several at once
+	reading map[digest.Digest]int64
+	// copied is the size of the blobs already copied
+	copied int64
+}
+
+func newPullProgress(imageManifest manifest.Manifest, progress func(OCIProgress)) *pullProgress {
+	// The config blob is copied along with the layers
+	blobs := append(imageManifest.LayerInfos(), manifest.LayerInfo{BlobInfo: imageManifest.ConfigInfo()})
+	p := &pullProgress{
+		progress: progress,
+		state:    OCIProgress{Phase: "pull", TotalFiles: int64(len(blobs))},
+		reading:  map[digest.Digest]int64{},
+	}
+	for _, blob := range blobs {
+		if blob.Size > 0 {
+			p.state.TotalBytes += blob.Size
+		}
+	}
+
+	progress(p.state)
+	return p
+}
+
+func (p *pullProgress) report(report types.ProgressProperties) {
+	blob := report.Artifact.Digest
+	switch report.Event {
+	case types.ProgressEventNewArtifact:
+		p.reading[blob] = 0
+		util.Logf("Pulling %s", blob.Encoded()[:12])
+	case types.ProgressEventRead:
+		p.reading[blob] = int64(report.Offset)
+	case types.ProgressEventDone, types.ProgressEventSkipped:
+		delete(p.reading, blob)
+		if report.Artifact.Size > 0 {
+			p.copied += report.Artifact.Size
+		}
+		p.state.Files++
+	}
+
+	p.state.Layer = blob.String()
+	p.state.Bytes = p.copied
+	for _, offset := range p.reading {
+		p.state.Bytes += offset
+	}
+	p.progress(p.state)
+}
+
+// rsyncProgressExpr matches the lines printed by rsync --info=progress2, e.g.
+// "  1,234,567  12%  1.23MB/s  0:00:10 (xfr#12, to-chk=100/2000)". The file
+// counts are only printed after a file was copied, with ir-chk instead of
+// to-chk while rsync is still scanning files.
+var rsyncProgressExpr = regexp.MustCompile(`^\s*([\d,]+)\s+(\d+)%.*?(?:(to|ir)-chk=(\d+)/(\d+))?\)?$`)
+
+// rsyncProgressWriter parses the output of rsync --info=progress2, which
+// rewrites the same line with carriage returns, into OCIProgress reports.
+type rsyncProgressWriter struct {
+	progress func(OCIProgress)
+	state    OCIProgress
+	buf      []byte
+	// logged is the last percentage logged, in steps of 10
+	logged int64
+}
+
+func (w *rsyncProgressWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexAny(w.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+		w.parse(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+func (w *rsyncProgressWriter) parse(line string) {
+	match := rsyncProgressExpr.FindStringSubmatch(line)
+	if match == nil {
+		// File names printed in verbose mode
+		if strings.TrimSpace(line) != "" {
+			util.Logf("%s", line)
+		}
+		return
+	}
+
+	w.state.Phase = "copy"
+	w.state.Bytes, _ = strconv.ParseInt(strings.ReplaceAll(match[1], ",", ""), 10, 64)
+	// rsync only reports the percentage, so the total is an estimate
+	percent, _ := strconv.ParseInt(match[2], 10, 64)
+	if percent > 0 {
+		w.state.TotalBytes = w.state.Bytes * 100 / percent
+	}
+	if percent >= w.logged+10 {
+		w.logged = percent - percent%10
+		util.Logf("Copied %d%%", w.logged)
+	}
+	if match[3] != "" {
+		toCheck, _ := strconv.ParseInt(match[4], 10, 64)
+		total, _ := strconv.ParseInt(match[5], 10, 64)
+		w.state.Files = total - toCheck
+		// The total of ir-chk only counts the files scanned so far
+		if match[3] == "to" {
+			w.state.TotalFiles = total
+		}
+	}
+
+	w.progress(w.state)
+}
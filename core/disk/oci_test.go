@@ -0,0 +1,171 @@
+package disk
+
+import (
+	"fmt"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/vanilla-os/albius/core/util"
+	"github.com/vanilla-os/albius/core/util/exectest"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/types"
+)
+
+func TestParseOCISource(t *testing.T) {
+	for source, expected := range map[string]string{
+		"ghcr.io/vanilla-os/desktop:main":                    "docker://ghcr.io/vanilla-os/desktop:main",
+		"docker://ghcr.io/vanilla-os/desktop:main":           "docker://ghcr.io/vanilla-os/desktop:main",
+		"oci-archive:/cdrom/desktop.tar":                     "oci-archive:/cdrom/desktop.tar",
+		"oci:/cdrom/desktop:main":                            "oci:/cdrom/desktop:main",
+		"containers-storage:ghcr.io/vanilla-os/desktop:main": "containers-storage:ghcr.io/vanilla-os/desktop:main",
+		"Invalid Reference":                                  "",
+		"oci:":                                               "",
+	} {
+		parsed, err := ParseOCISource(source)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", source, parsed)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", source, err)
+		} else if parsed.String() != expected {
+			t.Errorf("%s: expected %s, got %s", source, expected, parsed)
+		}
+	}
+}
+
+func TestRsyncProgressWriter(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		output  string
+		reports int
+		last    OCIProgress
+	}{
+		{
+			name:    "to-chk",
+			output:  "      1,000,000  10%  1.00MB/s  0:00:01 (xfr#5, to-chk=95/100)\n",
+			reports: 1,
+			last:    OCIProgress{Phase: "copy", Bytes: 1000000, TotalBytes: 10000000, Files: 5, TotalFiles: 100},
+		},
+		{
+			// The total only counts the files scanned so far
+			name:    "ir-chk",
+			output:  "      1,000,000  10%  1.00MB/s  0:00:01 (xfr#5, ir-chk=1015/1020)\n",
+			reports: 1,
+			last:    OCIProgress{Phase: "copy", Bytes: 1000000, TotalBytes: 10000000, Files: 5},
+		},
+		{
+			name:    "no counts",
+			output:  "        32,768   0%    0.00kB/s    0:00:00  \n",
+			reports: 1,
+			last:    OCIProgress{Phase: "copy", Bytes: 32768},
+		},
+		{
+			name:    "verbose file names",
+			output:  "sending incremental file list\n./\nusr/bin/bash\n\n    500  50%  1.00kB/s  0:00:00 (xfr#1, to-chk=1/2)\n",
+			reports: 1,
+			last:    OCIProgress{Phase: "copy", Bytes: 500, TotalBytes: 1000, Files: 1, TotalFiles: 2},
+		},
+		{
+			// Later reports keep the file counts of earlier ones
+			name:    "carriage returns",
+			output:  "    100  10%  1.00kB/s  0:00:01 (xfr#1, to-chk=9/10)\r    500  50%  1.00kB/s  0:00:00\r  1,000 100%  1.00kB/s  0:00:01 (xfr#10, to-chk=0/10)\n",
+			reports: 3,
+			last:    OCIProgress{Phase: "copy", Bytes: 1000, TotalBytes: 1000, Files: 10, TotalFiles: 10},
+		},
+		{
+			name:    "unterminated line",
+			output:  "    100  10%  1.00kB/s  0:00:01 (xfr#1, to-chk=9/10)\r    500  50%",
+			reports: 1,
+			last:    OCIProgress{Phase: "copy", Bytes: 100, TotalBytes: 1000, Files: 1, TotalFiles: 10},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fake := exectest.New().Expect("rsync *", test.output)
+
+			reports := []OCIProgress{}
+			cmd := util.NewCommand("rsync", "-axHAX", "--info=progress2", "/mnt/image/", "/mnt/a/")
+			cmd.Stdout = &rsyncProgressWriter{progress: func(p OCIProgress) { reports = append(reports, p) }}
+			err := fake.Run(cmd)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(reports) != test.reports {
+				t.Fatalf("expected %d reports, got %+v", test.reports, reports)
+			}
+			if last := reports[len(reports)-1]; last != test.last {
+				t.Errorf("expected last report %+v, got %+v", test.last, last)
+			}
+		})
+	}
+}
+
+func TestPullProgress(t *testing.T) {
+	config := digest.FromString("config")
+	layers := []digest.Digest{digest.FromString("layer1"), digest.FromString("layer2")}
+	imageManifest, err := manifest.FromBlob([]byte(fmt.Sprintf(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": %q, "size": 100},
+		"layers": [
+			{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": %q, "size": 1000},
+			{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": %q, "size": 2000}
+		]}`, config, layers[0], layers[1])), manifest.DefaultRequestedManifestMIMETypes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reports := []OCIProgress{}
+	tracker := newPullProgress(imageManifest, func(p OCIProgress) { reports = append(reports, p) })
+
+	layer := func(n int) types.BlobInfo {
+		return types.BlobInfo{Digest: layers[n], Size: int64(1000 * (n + 1))}
+	}
+	for _, test := range []struct {
+		report   types.ProgressProperties
+		expected OCIProgress
+	}{
+		{
+			types.ProgressProperties{Event: types.ProgressEventNewArtifact, Artifact: layer(0)},
+			OCIProgress{Layer: layers[0].String()},
+		},
+		{
+			types.ProgressProperties{Event: types.ProgressEventRead, Artifact: layer(0), Offset: 400},
+			OCIProgress{Layer: layers[0].String(), Bytes: 400},
+		},
+		{
+			// Layers are pulled concurrently
+			types.ProgressProperties{Event: types.ProgressEventRead, Artifact: layer(1), Offset: 1500},
+			OCIProgress{Layer: layers[1].String(), Bytes: 1900},
+		},
+		{
+			types.ProgressProperties{Event: types.ProgressEventDone, Artifact: layer(0), Offset: 1000},
+			OCIProgress{Layer: layers[0].String(), Bytes: 2500, Files: 1},
+		},
+		{
+			// Blobs already in the storage are skipped
+			types.ProgressProperties{Event: types.ProgressEventSkipped, Artifact: types.BlobInfo{Digest: config, Size: 100}},
+			OCIProgress{Layer: config.String(), Bytes: 2600, Files: 2},
+		},
+		{
+			types.ProgressProperties{Event: types.ProgressEventDone, Artifact: layer(1), Offset: 2000},
+			OCIProgress{Layer: layers[1].String(), Bytes: 3100, Files: 3},
+		},
+	} {
+		test.expected.Phase = "pull"
+		test.expected.TotalBytes = 3100
+		test.expected.TotalFiles = 3
+
+		tracker.report(test.report)
+		if last := reports[len(reports)-1]; last != test.expected {
+			t.Errorf("after %v on %s: expected %+v, got %+v", test.report.Event, test.report.Artifact.Digest, test.expected, last)
+		}
+	}
+
+	if first := reports[0]; first != (OCIProgress{Phase: "pull", TotalBytes: 3100, TotalFiles: 3}) {
+		t.Errorf("unexpected initial report %+v", first)
+	}
+}
@@ -33,6 +33,25 @@ type Partition struct {
 	Number                       int
 	Start, End, Size, Type, Path string
 	Filesystem                   PartitionFs
+	// Flags are the partition flags set, as named by parted (e.g. esp or
+	// bios_grub)
+	Flags []string `json:"flags,omitempty"`
+
+	// The fields below are only filled by ListDisks
+
+	// FsLabel and FsUUID identify the filesystem in the partition
+	FsLabel string `json:"fs-label,omitempty"`
+	FsUUID  string `json:"fs-uuid,omitempty"`
+	// PartLabel and PartUUID identify the partition in a GPT partition table
+	PartLabel string `json:"part-label,omitempty"`
+	PartUUID  string `json:"part-uuid,omitempty"`
+	// MountedAt lists where the partition, or any device stacked on it (e.g.
+	// an open LUKS container), is mounted
+	MountedAt []string `json:"mountpoints,omitempty"`
+	// LUKS tells whether the partition is a LUKS container
+	LUKS bool `json:"luks,omitempty"`
+	// VG is the LVM volume group the partition is a physical volume of
+	VG string `json:"vg,omitempty"`
 }
 
 func (part *Partition) Mount(location string) error {
@@ -70,11 +89,11 @@ func (part *Partition) Mount(location string) error {
 		return nil
 	}
 
-	mountCmd := "mount -m %s %s"
-	err = util.RunCommand(fmt.Sprintf(mountCmd, mountPath, location))
+	err = util.RunCommand("mount", "-m", mountPath, location)
 	if err != nil {
 		return fmt.Errorf("failed to run mount command: %s", err)
 	}
+	addUnmountCleanup(location)
 
 	return nil
 }
@@ -84,8 +103,7 @@ func (part *Partition) GetPath() string {
 }
 
 func (part *Partition) Mountpoints() ([]string, error) {
-	mountpointsCmd := "lsblk -n -o MOUNTPOINTS %s"
-	output, err := util.OutputCommand(fmt.Sprintf(mountpointsCmd, part.Path))
+	output, err := util.OutputCommand("lsblk", "-n", "-o", "MOUNTPOINTS", part.Path)
 	if err != nil {
 		return []string{}, fmt.Errorf("failed to list mountpoints for %s: %s", part.Path, err)
 	}
@@ -113,11 +131,11 @@ func (part *Partition) UnmountPartition() error {
 	var mountTarget string
 
 	// Check if partition is mounted first
-	isMounted, err := part.IsMounted()
+	mountpoints, err := part.Mountpoints()
 	if err != nil {
 		return err
 	}
-	if !isMounted {
+	if len(mountpoints) == 0 {
 		return nil
 	}
 
@@ -144,30 +162,38 @@ func (part *Partition) UnmountPartition() error {
 		mountTarget = part.Path
 	}
 
-	umountCmd := "umount %s"
-	err = util.RunCommand(fmt.Sprintf(umountCmd, mountTarget))
+	err = util.RunCommand("umount", mountTarget)
 	if err != nil {
 		return fmt.Errorf("failed to run umount command: %s", err)
 	}
+	for _, mnt := range mountpoints {
+		util.RemoveCleanup("mount:" + mnt)
+	}
 
 	return nil
 }
 
 func UnmountDirectory(dir string) error {
-	umountCmd := "umount %s"
-
-	err := util.RunCommand(fmt.Sprintf(umountCmd, dir))
+	err := util.RunCommand("umount", dir)
 	if err != nil {
 		return fmt.Errorf("failed to run umount command: %s", err)
 	}
+	util.RemoveCleanup("mount:" + dir)
 
 	return nil
 }
 
+// addUnmountCleanup registers the unmounting of dir as the cleanup for a
+// mount made there (see util.AddCleanup).
+func addUnmountCleanup(dir string) {
+	util.AddCleanup("mount:"+dir, "unmount "+dir, func() error {
+		return UnmountDirectory(dir)
+	})
+}
+
 func (target *Partition) RemovePartition() error {
 	disk, part := util.SeparateDiskPart(target.Path)
-	rmPartCmd := "parted -s %s rm %s"
-	err := util.RunCommand(fmt.Sprintf(rmPartCmd, disk, part))
+	err := util.RunCommand("parted", "-s", disk, "rm", part)
 	if err != nil {
 		return fmt.Errorf("failed to remove partition: %s", err)
 	}
@@ -175,10 +201,20 @@ func (target *Partition) RemovePartition() error {
 	return nil
 }
 
-func (target *Partition) ResizePartition(newEnd int) error {
+// ResizePartition moves the end of the partition to newEnd, which is
+// interpreted like the end position of Disk.NewPartition.
+func (target *Partition) ResizePartition(newEnd util.Size) error {
 	disk, part := util.SeparateDiskPart(target.Path)
-	resizePartCmd := "parted -s %s unit MiB resizepart %s %d"
-	err := util.RunCommand(fmt.Sprintf(resizePartCmd, disk, part, newEnd))
+	parent, err := LocateDisk(disk)
+	if err != nil {
+		return fmt.Errorf("failed to resize partition: %s", err)
+	}
+	end, err := parent.partedPosition(newEnd)
+	if err != nil {
+		return fmt.Errorf("failed to resize partition: invalid end position: %s", err)
+	}
+
+	err = util.RunCommand("parted", "-s", disk, "unit", "MiB", "resizepart", part, end)
 	if err != nil {
 		return fmt.Errorf("failed to resize partition: %s", err)
 	}
@@ -187,9 +223,13 @@ func (target *Partition) ResizePartition(newEnd int) error {
 }
 
 func (target *Partition) NamePartition(name string) error {
+	quotedName, err := quotePartedString(name)
+	if err != nil {
+		return fmt.Errorf("failed to name partition: %s", err)
+	}
+
 	disk, part := util.SeparateDiskPart(target.Path)
-	namePartCmd := "parted -s %s name %s %s"
-	err := util.RunCommand(fmt.Sprintf(namePartCmd, disk, part, name))
+	err = util.RunCommand("parted", "-s", disk, "name", part, quotedName)
 	if err != nil {
 		return fmt.Errorf("failed to name partition: %s", err)
 	}
@@ -197,6 +237,20 @@ func (target *Partition) NamePartition(name string) error {
 	return nil
 }
 
+// quotePartedString quotes s so that parted, which splits its arguments into
+// words on its own, reads it as a single word. Parted has no escape sequences,
+// so strings containing both kinds of quotes cannot be represented.
+func quotePartedString(s string) (string, error) {
+	switch {
+	case !strings.Contains(s, `"`):
+		return `"` + s + `"`, nil
+	case !strings.Contains(s, "'"):
+		return "'" + s + "'", nil
+	default:
+		return "", fmt.Errorf("%s contains both single and double quotes", s)
+	}
+}
+
 func (target *Partition) SetPartitionFlag(flag string, state bool) error {
 	stateStr := "off"
 	if state {
@@ -204,8 +258,7 @@ func (target *Partition) SetPartitionFlag(flag string, state bool) error {
 	}
 
 	disk, part := util.SeparateDiskPart(target.Path)
-	setPartCmd := "parted -s %s set %s %s %s"
-	err := util.RunCommand(fmt.Sprintf(setPartCmd, disk, part, flag, stateStr))
+	err := util.RunCommand("parted", "-s", disk, "set", part, flag, stateStr)
 	if err != nil {
 		return fmt.Errorf("failed to name partition: %s", err)
 	}
@@ -223,9 +276,7 @@ func (target *Partition) FillPath(basePath string) {
 }
 
 func (target *Partition) GetUUID() (string, error) {
-	lsblkCmd := "lsblk -d -n -o UUID %s"
-
-	output, err := util.OutputCommand(fmt.Sprintf(lsblkCmd, target.Path))
+	output, err := util.OutputCommand("lsblk", "-d", "-n", "-o", "UUID", target.Path)
 	if err != nil {
 		return "", fmt.Errorf("failed to get partition UUID: %s", err)
 	}
@@ -234,9 +285,7 @@ func (target *Partition) GetUUID() (string, error) {
 }
 
 func GetUUIDByPath(path string) (string, error) {
-	lsblkCmd := "lsblk -d -n -o UUID %s"
-
-	output, err := util.OutputCommand(fmt.Sprintf(lsblkCmd, path))
+	output, err := util.OutputCommand("lsblk", "-d", "-n", "-o", "UUID", path)
 	if err != nil {
 		return "", fmt.Errorf("failed to get partition UUID: %s", err)
 	}
@@ -245,9 +294,7 @@ func GetUUIDByPath(path string) (string, error) {
 }
 
 func GetFilesystemByPath(path string) (string, error) {
-	lsblkCmd := "lsblk -d -n -o FSTYPE %s"
-
-	output, err := util.OutputCommand(fmt.Sprintf(lsblkCmd, path))
+	output, err := util.OutputCommand("lsblk", "-d", "-n", "-o", "FSTYPE", path)
 	if err != nil {
 		return "", fmt.Errorf("failed to get partition FSTYPE: %s", err)
 	}
@@ -273,27 +320,27 @@ func (part *Partition) GetLUKSMapperPath() (string, error) {
 }
 
 func (part *Partition) SetLabel(label string) error {
-	var labelCmd string
+	var labelCmd []string
 	switch part.Filesystem {
 	case FAT16, FAT32:
-		labelCmd = fmt.Sprintf("fatlabel %s %s", part.Path, label)
+		labelCmd = []string{"fatlabel", part.Path, label}
 	case EXT2, EXT3, EXT4:
-		labelCmd = fmt.Sprintf("e2label %s %s", part.Path, label)
+		labelCmd = []string{"e2label", part.Path, label}
 	case BTRFS:
-		labelCmd = fmt.Sprintf("btrfs filesystem label %s %s", part.Path, label)
+		labelCmd = []string{"btrfs", "filesystem", "label", part.Path, label}
 	case REISERFS:
-		labelCmd = fmt.Sprintf("reiserfstune -l %s %s", label, part.Path)
+		labelCmd = []string{"reiserfstune", "-l", label, part.Path}
 	case XFS:
-		labelCmd = fmt.Sprintf("xfs_admin -L %s %s", label, part.Path)
+		labelCmd = []string{"xfs_admin", "-L", label, part.Path}
 	case LINUX_SWAP:
 		return nil // There's no way to rename swap after it has been created
 	case NTFS:
-		labelCmd = fmt.Sprintf("ntfslabel %s %s", part.Path, label)
+		labelCmd = []string{"ntfslabel", part.Path, label}
 	default:
 		return fmt.Errorf("unsupported filesystem: %s", part.Filesystem)
 	}
 
-	err := util.RunCommand(labelCmd)
+	err := util.RunCommand(labelCmd[0], labelCmd[1:]...)
 	if err != nil {
 		return fmt.Errorf("failed to label partition %s: %s", part.Path, err)
 	}
@@ -320,6 +367,11 @@ func LUKSSetLabel(part *Partition, name string) error {
 // This is particularly useful to make sure a recently created or modified
 // partition is recognized by the system.
 func (part *Partition) WaitUntilAvailable() {
+	// Nothing was actually created
+	if util.DryRun() {
+		return
+	}
+
 	for {
 		_, err := os.Stat(part.Path)
 		if !os.IsNotExist(err) {
@@ -332,9 +384,9 @@ func (part *Partition) WaitUntilAvailable() {
 				return
 			}
 
-			fmt.Println("Partition does not have UUID, retrying...")
+			util.Logf("Partition does not have UUID, retrying...")
 		} else {
-			fmt.Println("Partition not found, retrying...")
+			util.Logf("Partition not found, retrying...")
 		}
 
 		time.Sleep(50 * time.Millisecond)
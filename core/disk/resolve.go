@@ -0,0 +1,113 @@
+package disk
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/vanilla-os/albius/core/util"
+)
+
+// refTags are the KEY=value references accepted by ResolveDevice
+var refTags = []string{"UUID", "LABEL", "PARTUUID", "PARTLABEL", "SERIAL"}
+
+// refLinkDir holds the symlinks udev creates for stable device names, e.g.
+// /dev/disk/by-id or /dev/disk/by-partuuid
+const refLinkDir = "/dev/disk/"
+
+// IsDeviceRef tells whether ref can be passed to ResolveDevice, without
+// checking that the device exists.
+func IsDeviceRef(ref string) bool {
+	if strings.HasPrefix(ref, "/dev/") {
+		return true
+	}
+
+	_, _, ok := splitRefTag(ref)
+	return ok
+}
+
+// IsStableRef tells whether ref refers to a device by something other than
+// its kernel name, i.e. whether ResolveDevice has to look it up.
+func IsStableRef(ref string) bool {
+	_, _, isTag := splitRefTag(ref)
+	return isTag || strings.HasPrefix(ref, refLinkDir)
+}
+
+func splitRefTag(ref string) (string, string, bool) {
+	tag, value, found := strings.Cut(ref, "=")
+	for _, known := range refTags {
+		if found && value != "" && strings.EqualFold(tag, known) {
+			return known, value, true
+		}
+	}
+
+	return "", "", false
+}
+
+// ResolveDevice returns the kernel path (e.g. /dev/nvme0n1p2) of the disk or
+// partition ref refers to, which is one of:
+//   - a device path. Paths in /dev/disk (e.g. /dev/disk/by-id/...) are
+//     followed to the device they link to, other paths are returned as is;
+//   - UUID=, LABEL=, PARTUUID= or PARTLABEL= followed by the value of that
+//     tag, as in fstab. References matching more than one device are
+//     rejected;
+//   - SERIAL= followed by the serial number of a disk.
+func ResolveDevice(ref string) (string, error) {
+	if strings.HasPrefix(ref, "/dev/") {
+		if !strings.HasPrefix(ref, refLinkDir) {
+			return ref, nil
+		}
+
+		path, err := util.OutputCommand("readlink", "-e", ref)
+		if err != nil || path == "" {
+			return "", fmt.Errorf("failed to resolve %s: device does not exist", ref)
+		}
+		return path, nil
+	}
+
+	tag, value, ok := splitRefTag(ref)
+	if !ok {
+		return "", fmt.Errorf("invalid device reference %q: expected a path in /dev or one of %s followed by =value", ref, strings.Join(refTags, "=, ")+"=")
+	}
+
+	if tag == "SERIAL" {
+		return diskBySerial(value)
+	}
+
+	// Bypass the blkid cache, which may not know about devices created
+	// during the installation
+	output, err := util.OutputCommand("blkid", "-c", "/dev/null", "-o", "device", "-t", tag+"="+value)
+	if err != nil || output == "" {
+		return "", fmt.Errorf("failed to resolve %s: no device found", ref)
+	}
+
+	devices := strings.Fields(output)
+	if len(devices) > 1 {
+		return "", fmt.Errorf("failed to resolve %s: matches more than one device (%s)", ref, strings.Join(devices, ", "))
+	}
+
+	return devices[0], nil
+}
+
+func diskBySerial(serial string) (string, error) {
+	output, err := util.OutputCommand("lsblk", "-J", "-d", "-o", "PATH,SERIAL")
+	if err != nil {
+		return "", fmt.Errorf("failed to list block devices: %s", err)
+	}
+
+	var decoded struct {
+		BlockDevices []lsblkDevice `json:"blockdevices"`
+	}
+	err = json.Unmarshal([]byte(output), &decoded)
+	if err != nil {
+		return "", fmt.Errorf("failed to list block devices: %s", err)
+	}
+
+	for _, dev := range decoded.BlockDevices {
+		if dev.Serial != "" && dev.Serial == serial {
+			return dev.Path, nil
+		}
+	}
+
+	return "", fmt.Errorf("failed to resolve SERIAL=%s: no disk found", serial)
+}
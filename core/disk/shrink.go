@@ -0,0 +1,184 @@
+package disk
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vanilla-os/albius/core/util"
+)
+
+// shrinkMountpoint is where btrfs filesystems are mounted while resizing
+// them, since btrfs can only be resized online
+const shrinkMountpoint = "/mnt/albius-shrink"
+
+var (
+	freedMu sync.Mutex
+	// freedRegions holds the region freed by the last Shrink on each disk
+	freedRegions = map[string]FreeRegion{}
+)
+
+// FreedRegion returns the region freed by the last call to Shrink on a
+// partition of the disk at diskPath. Partitions may have been created in it
+// since, see Disk.FreeRegionWithin.
+func FreedRegion(diskPath string) (FreeRegion, bool) {
+	freedMu.Lock()
+	defer freedMu.Unlock()
+
+	region, ok := freedRegions[diskPath]
+	return region, ok
+}
+
+// SetFreedRegion records region as freed on the disk at diskPath, as if by
+// Shrink, e.g. to restore it when resuming a run.
+func SetFreedRegion(diskPath string, region FreeRegion) {
+	freedMu.Lock()
+	defer freedMu.Unlock()
+
+	freedRegions[diskPath] = region
+}
+
+// partedMiB reads a position or size printed by parted in MiB (e.g.
+// "1025MiB").
+func partedMiB(value string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSuffix(value, "MiB"), 64)
+}
+
+// Shrink makes room for a new installation after the partition by shrinking
+// its filesystem, then the partition itself, to newSize. Sizes counted from
+// the end (e.g. -50GiB) are the amount of space to free, and percentages
+// refer to the current size of the partition.
+//
+// Only NTFS, ext2/3/4 and btrfs filesystems can be shrunk, and the partition
+// must not be mounted. The filesystem is first shrunk a little more than
+// needed and grown back to fill the partition once it has been resized, so
+// rounding in parted can never cut the end of the filesystem.
+//
+// The region freed after the partition is returned, and can also be retrieved
+// later with FreedRegion.
+func (target *Partition) Shrink(newSize util.Size) (FreeRegion, error) {
+	diskPath, partNum := util.SeparateDiskPart(target.Path)
+
+	mounted, err := target.IsMounted()
+	if err != nil {
+		return FreeRegion{}, err
+	}
+	if mounted {
+		return FreeRegion{}, fmt.Errorf("failed to shrink %s: partition is mounted", target.Path)
+	}
+
+	start, err := partedMiB(target.Start)
+	if err != nil {
+		return FreeRegion{}, fmt.Errorf("failed to shrink %s: invalid start position %q", target.Path, target.Start)
+	}
+	end, err := partedMiB(target.End)
+	if err != nil {
+		return FreeRegion{}, fmt.Errorf("failed to shrink %s: invalid end position %q", target.Path, target.End)
+	}
+
+	if newSize.Kind == util.SizeRest {
+		return FreeRegion{}, fmt.Errorf("failed to shrink %s: new size cannot be %s", target.Path, newSize)
+	}
+	currentSize := int64((end - start) * float64(util.MiB))
+	sizeBytes, err := newSize.Resolve(currentSize)
+	if err != nil {
+		return FreeRegion{}, fmt.Errorf("failed to shrink %s: %s", target.Path, err)
+	}
+
+	// Keep the new end aligned to 1MiB
+	newEnd := math.Floor(start + float64(sizeBytes)/float64(util.MiB))
+	if newEnd-start < 2 || newEnd >= math.Floor(end) {
+		return FreeRegion{}, fmt.Errorf("failed to shrink %s: new size %s must be smaller than the current size (%s)", target.Path, newSize, target.Size)
+	}
+	fsBytes := int64((newEnd-start-1)*float64(util.MiB)) / util.KiB * util.KiB
+
+	fsType, err := GetFilesystemByPath(target.Path)
+	if err != nil {
+		return FreeRegion{}, err
+	}
+	resizeFs, err := fsResizer(fsType, target.Path)
+	if err != nil {
+		return FreeRegion{}, fmt.Errorf("failed to shrink %s: %s", target.Path, err)
+	}
+
+	util.Logf("Shrinking %s filesystem on %s to %s", fsType, target.Path, util.Size{Bytes: fsBytes})
+	err = resizeFs(fsBytes)
+	if err != nil {
+		return FreeRegion{}, fmt.Errorf("failed to shrink %s filesystem on %s: %s", fsType, target.Path, err)
+	}
+
+	err = util.RunCommand("parted", "-s", diskPath, "unit", "MiB", "resizepart", partNum, strconv.FormatFloat(newEnd, 'f', -1, 64))
+	if err != nil {
+		return FreeRegion{}, fmt.Errorf("failed to shrink partition %s: %s", target.Path, err)
+	}
+
+	err = resizeFs(0)
+	if err != nil {
+		return FreeRegion{}, fmt.Errorf("failed to grow %s filesystem on %s to fill the partition: %s", fsType, target.Path, err)
+	}
+
+	region := FreeRegion{
+		Start: util.MiBSize(newEnd),
+		End:   util.MiBSize(math.Floor(end)),
+	}
+	SetFreedRegion(diskPath, region)
+
+	util.Logf("Freed %s on %s", region, diskPath)
+	return region, nil
+}
+
+// fsResizer returns a function resizing the fsType filesystem at path to a
+// number of bytes, or to fill its partition if size is zero.
+func fsResizer(fsType, path string) (func(size int64) error, error) {
+	switch fsType {
+	case NTFS:
+		return func(size int64) error {
+			if size == 0 {
+				return util.RunCommand("ntfsresize", "-f", path)
+			}
+			// Check that the filesystem is consistent and that the data fits
+			// before touching it
+			sizeStr := strconv.FormatInt(size, 10)
+			err := util.RunCommand("ntfsresize", "--no-action", "--size", sizeStr, path)
+			if err != nil {
+				return err
+			}
+			return util.RunCommand("ntfsresize", "-f", "--size", sizeStr, path)
+		}, nil
+	case EXT2, EXT3, EXT4:
+		return func(size int64) error {
+			if size == 0 {
+				return util.RunCommand("resize2fs", path)
+			}
+			// resize2fs refuses to shrink filesystems which were not
+			// checked
+			err := util.RunCommand("e2fsck", "-f", "-y", path)
+			if err != nil {
+				return err
+			}
+			return util.RunCommand("resize2fs", path, fmt.Sprintf("%dK", size/util.KiB))
+		}, nil
+	case BTRFS:
+		return func(size int64) error {
+			sizeStr := "max"
+			if size != 0 {
+				sizeStr = strconv.FormatInt(size, 10)
+			}
+			err := util.RunCommand("mount", "-m", path, shrinkMountpoint)
+			if err != nil {
+				return err
+			}
+			err = util.RunCommand("btrfs", "filesystem", "resize", sizeStr, shrinkMountpoint)
+			if umountErr := util.RunCommand("umount", shrinkMountpoint); err == nil {
+				err = umountErr
+			}
+			return err
+		}, nil
+	case "":
+		return nil, fmt.Errorf("partition has no filesystem")
+	default:
+		return nil, fmt.Errorf("shrinking %s filesystems is not supported", fsType)
+	}
+}
@@ -0,0 +1,178 @@
+package albius
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/vanilla-os/albius/core/disk"
+	"github.com/vanilla-os/albius/core/util"
+)
+
+// EventType identifies what an Event reports.
+type EventType string
+
+const (
+	// EventStageStarted is sent before a stage starts.
+	EventStageStarted EventType = "stage-started"
+	// EventStageFinished is sent after every step of a stage succeeded.
+	EventStageFinished EventType = "stage-finished"
+	// EventStageFailed is sent when a stage fails, with Error set.
+	EventStageFailed EventType = "stage-failed"
+	// EventStepStarted is sent before a setup or post-installation step.
+	EventStepStarted EventType = "step-started"
+	// EventStepFinished is sent after a step succeeded.
+	EventStepFinished EventType = "step-finished"
+	// EventStepFailed is sent when a step fails, with Error set.
+	EventStepFailed EventType = "step-failed"
+	// EventProgress reports how many bytes of Task were processed.
+	EventProgress EventType = "progress"
+	// EventLog carries a human readable Message.
+	EventLog EventType = "log"
+)
+
+// Event reports the progress of a recipe run to a frontend. Fields not
+// relevant to Type are left empty.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+
+	// Stage the event belongs to, if any. Log and progress events belong to
+	// the stage and step running when they are reported.
+	Stage Stage `json:"stage,omitempty"`
+	// Step is the index of the step inside Stage, the same reported by
+	// Validate, Plan and StageError, or -1 for events not about a step
+	Step int `json:"step"`
+	// Steps is the number of steps in Stage, or -1 if it has no steps
+	Steps int `json:"steps"`
+	// Operation is the step's operation
+	Operation string `json:"operation,omitempty"`
+	// Error describes why a stage or step failed
+	Error string `json:"error,omitempty"`
+
+	// Message is the text of a log event
+	Message string `json:"message,omitempty"`
+
+	// Task names what a progress event is about, either "pull" for
+	// downloading an OCI image or "copy" for copying it to the target
+	Task string `json:"task,omitempty"`
+	// Item is the digest of the OCI layer being pulled
+	Item string `json:"item,omitempty"`
+	// Done is the number of bytes of Task processed so far
+	Done int64 `json:"done,omitempty"`
+	// Total is the number of bytes Task will process, or 0 if not known
+	Total int64 `json:"total,omitempty"`
+	// FilesDone is the number of files (layers, when pulling) processed
+	FilesDone int64 `json:"filesDone,omitempty"`
+	// Files is the number of files (layers, when pulling) Task will
+	// process, or 0 if not known
+	Files int64 `json:"files,omitempty"`
+}
+
+// NewJSONEventWriter returns a function, suitable for Recipe.OnEvent, which
+// writes every event to w as a line of JSON. Write errors are ignored so a
+// frontend going away never interrupts an installation.
+func NewJSONEventWriter(w io.Writer) func(Event) {
+	var mu sync.Mutex
+	encoder := json.NewEncoder(w)
+
+	return func(event Event) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		_ = encoder.Encode(event)
+	}
+}
+
+// emitter delivers events to a recipe's listeners. Progress may be reported
+// from other goroutines, so delivery is serialized.
+type emitter struct {
+	mu     sync.Mutex
+	recipe *Recipe
+	// current holds the stage and step running, which log and progress
+	// events are attributed to
+	current Event
+}
+
+func (e *emitter) send(event Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	event.Time = time.Now().UTC()
+	event.Message = util.MaskSecrets(event.Message)
+	event.Error = util.MaskSecrets(event.Error)
+	switch event.Type {
+	case EventStageStarted:
+		e.current = Event{Stage: event.Stage, Step: -1, Steps: event.Steps}
+	case EventStageFinished, EventStageFailed:
+		e.current = Event{Step: -1, Steps: -1}
+	case EventStepStarted:
+		e.current = Event{Stage: event.Stage, Step: event.Step, Steps: event.Steps}
+	case EventStepFinished, EventStepFailed:
+		e.current.Step = -1
+	case EventLog, EventProgress:
+		event.Stage, event.Step, event.Steps = e.current.Stage, e.current.Step, e.current.Steps
+	}
+
+	if e.recipe.OnEvent != nil {
+		e.recipe.OnEvent(event)
+	}
+	if e.recipe.Events != nil {
+		e.recipe.Events <- event
+	}
+}
+
+// eventReporter forwards log lines from util to the recipe's listeners, in
+// addition to the previous Reporter.
+type eventReporter struct {
+	prev    util.Reporter
+	emitter *emitter
+}
+
+func (r *eventReporter) Log(message string) {
+	r.prev.Log(message)
+	r.emitter.send(Event{Type: EventLog, Message: message})
+}
+
+// emit sends event to the recipe's listeners, if any.
+func (recipe *Recipe) emit(event Event) {
+	if recipe.emitter == nil {
+		return
+	}
+
+	recipe.emitter.send(event)
+}
+
+// stageEvent returns an event of type typ about stage.
+func (recipe *Recipe) stageEvent(typ EventType, stage Stage, err error) Event {
+	event := Event{Type: typ, Stage: stage, Step: -1, Steps: recipe.stepCount(stage)}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	return event
+}
+
+// stepEvent returns an event of type typ about step i of stage.
+func (recipe *Recipe) stepEvent(typ EventType, stage Stage, i int, operation string, err error) Event {
+	event := Event{Type: typ, Stage: stage, Step: i, Steps: recipe.stepCount(stage), Operation: operation}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	return event
+}
+
+// reportOCIProgress sends the progress of disk.OCISetup as an event.
+func (recipe *Recipe) reportOCIProgress(progress disk.OCIProgress) {
+	recipe.emit(Event{
+		Type:      EventProgress,
+		Task:      progress.Phase,
+		Item:      progress.Layer,
+		Done:      progress.Bytes,
+		Total:     progress.TotalBytes,
+		FilesDone: progress.Files,
+		Files:     progress.TotalFiles,
+	})
+}
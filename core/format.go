@@ -0,0 +1,95 @@
+package albius
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// RecipeFormat is the language a recipe is written in.
+type RecipeFormat string
+
+const (
+	FormatJSON RecipeFormat = "json"
+	FormatYAML RecipeFormat = "yaml"
+	FormatTOML RecipeFormat = "toml"
+)
+
+// tomlKeyExpr matches the "key = value" lines of TOML documents
+var tomlKeyExpr = regexp.MustCompile(`^[A-Za-z0-9_."'-]+\s*=`)
+
+// DetectRecipeFormat returns the format of the recipe at path, from its
+// extension (.json, .yaml, .yml or .toml) or else from content: JSON starts
+// with {, TOML with a [table] or key = value, and anything else is YAML.
+func DetectRecipeFormat(path string, content []byte) RecipeFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FormatJSON
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// Both YAML and TOML use # for comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "{"):
+			return FormatJSON
+		case strings.HasPrefix(line, "["), tomlKeyExpr.MatchString(line):
+			return FormatTOML
+		default:
+			return FormatYAML
+		}
+	}
+
+	return FormatJSON
+}
+
+// ParseRecipe reads a recipe written in format. YAML and TOML recipes have
+// the same structure as JSON ones, and are converted to JSON before being
+// read so that parameters get the same types (e.g. numbers are float64).
+// Included fragments are not read, see ReadRecipe.
+func ParseRecipe(content []byte, format RecipeFormat) (*Recipe, error) {
+	var err error
+	if format != FormatJSON {
+		var decoded map[string]interface{}
+		switch format {
+		case FormatYAML:
+			err = yaml.Unmarshal(content, &decoded)
+		case FormatTOML:
+			err = toml.Unmarshal(content, &decoded)
+		default:
+			return nil, fmt.Errorf("unsupported recipe format %q", format)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		content, err = json.Marshal(decoded)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var recipe Recipe
+	err = json.Unmarshal(content, &recipe)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recipe, nil
+}
@@ -0,0 +1,123 @@
+package albius
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// overrideSections are the sections which can be listed in Recipe.Override
+var overrideSections = []string{"setup", "mountpoints", "postInstallation"}
+
+// readRecipeFile reads the recipe at path along with the fragments it
+// includes. stack holds the absolute paths of the recipes including it, to
+// detect cycles.
+func readRecipeFile(path string, stack []string) (*Recipe, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(stack, absPath) {
+		return nil, fmt.Errorf("include cycle: %s", strings.Join(append(stack, absPath), " -> "))
+	}
+
+	content, err := os.ReadFile(absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	format := DetectRecipeFormat(absPath, content)
+	recipe, err := ParseRecipe(content, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid %s: %s", path, format, err)
+	}
+
+	err = recipe.applyIncludes(filepath.Dir(absPath), append(stack, absPath))
+	if err != nil {
+		return nil, err
+	}
+
+	return recipe, nil
+}
+
+// applyIncludes reads the fragments listed in Include, relative to dir, and
+// merges recipe on top of them (see merge).
+func (recipe *Recipe) applyIncludes(dir string, stack []string) error {
+	for _, section := range recipe.Override {
+		if !slices.Contains(overrideSections, section) {
+			return fmt.Errorf("%s: cannot override %q, expected one of %s", stack[len(stack)-1], section, strings.Join(overrideSections, ", "))
+		}
+	}
+
+	base := &Recipe{}
+	for _, include := range recipe.Include {
+		path := include
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+
+		fragment, err := readRecipeFile(path, stack)
+		if err != nil {
+			return err
+		}
+		base.merge(fragment, nil)
+	}
+
+	base.merge(recipe, recipe.Override)
+	base.Include, base.Override = nil, nil
+	*recipe = *base
+
+	return nil
+}
+
+// merge applies overlay on top of recipe. The steps and mountpoints of
+// overlay are appended to recipe's, except for the sections listed in
+// override, which replace recipe's. Installation options and variables set
+// in overlay replace recipe's.
+func (recipe *Recipe) merge(overlay *Recipe, override []string) {
+	if slices.Contains(override, "setup") {
+		recipe.Setup = overlay.Setup
+	} else {
+		recipe.Setup = append(recipe.Setup, overlay.Setup...)
+	}
+	if slices.Contains(override, "mountpoints") {
+		recipe.Mountpoints = overlay.Mountpoints
+	} else {
+		recipe.Mountpoints = append(recipe.Mountpoints, overlay.Mountpoints...)
+	}
+	if slices.Contains(override, "postInstallation") {
+		recipe.PostInstallation = overlay.PostInstallation
+	} else {
+		recipe.PostInstallation = append(recipe.PostInstallation, overlay.PostInstallation...)
+	}
+
+	installation := &recipe.Installation
+	if overlay.Installation.Method != "" {
+		installation.Method = overlay.Installation.Method
+	}
+	for _, field := range []struct{ base, overlay *string }{
+		{&installation.Source, &overlay.Installation.Source},
+		{&installation.Digest, &overlay.Installation.Digest},
+		{&installation.SignaturePolicy, &overlay.Installation.SignaturePolicy},
+	} {
+		if *field.overlay != "" {
+			*field.base = *field.overlay
+		}
+	}
+	if overlay.Installation.InitramfsPre != nil {
+		installation.InitramfsPre = overlay.Installation.InitramfsPre
+	}
+	if overlay.Installation.InitramfsPost != nil {
+		installation.InitramfsPost = overlay.Installation.InitramfsPost
+	}
+
+	if len(overlay.Variables) > 0 {
+		if recipe.Variables == nil {
+			recipe.Variables = map[string]Variable{}
+		}
+		maps.Copy(recipe.Variables, overlay.Variables)
+	}
+}
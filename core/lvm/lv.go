@@ -301,7 +301,7 @@ func MakeThinPool(poolMetadata, pool interface{}) error {
 		return err
 	}
 
-	_, err = RunCommand("lvconvert -y --type thin-pool --poolmetadata %s %s", poolMetadataName, poolName)
+	_, err = RunCommand("lvconvert", "-y", "--type", "thin-pool", "--poolmetadata", poolMetadataName, poolName)
 	if err != nil {
 		return err
 	}
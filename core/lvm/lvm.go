@@ -3,10 +3,10 @@ package lvm
 import (
 	"errors"
 	"fmt"
-	"os/exec"
-	"reflect"
 	"strconv"
 	"strings"
+
+	"github.com/vanilla-os/albius/core/util"
 )
 
 // LVM command return codes
@@ -18,21 +18,20 @@ const (
 	ECMD_FAILED       = iota + 1
 )
 
-func RunCommand(command string, args ...interface{}) (string, error) {
-	cmd := exec.Command("sh", "-c", fmt.Sprintf(command, args...))
-	out, err := cmd.Output()
+func RunCommand(name string, args ...string) (string, error) {
+	out, err := util.OutputCommand(name, args...)
 
-	exitErr, ok := err.(*exec.ExitError)
-	if err != nil && ok {
-		return strings.TrimSpace(string(out)), fmt.Errorf("lvm.RunCommand: \n%s", string(exitErr.Stderr))
+	var exitErr *util.ExitError
+	if errors.As(err, &exitErr) {
+		return out, fmt.Errorf("lvm.RunCommand: \n%s", exitErr.Stderr)
 	}
 
-	return strings.TrimSpace(string(out)), err
+	return out, err
 }
 
 // pvcreate (create pv)
 func Pvcreate(diskLabel string) error {
-	_, err := RunCommand("pvcreate -y %s", diskLabel)
+	_, err := RunCommand("pvcreate", "-y", diskLabel)
 	if err != nil {
 		return fmt.Errorf("pvcreate: %v", err)
 	}
@@ -44,7 +43,7 @@ func Pvcreate(diskLabel string) error {
 
 // pvscanCache runs the command `pvscan --cache [pv]` on the specified volume
 func pvscanCache(diskLabel string) error {
-	_, err := RunCommand("pvscan --cache %s", diskLabel)
+	_, err := RunCommand("pvscan", "--cache", diskLabel)
 	if err != nil {
 		return fmt.Errorf("pvscanCache: %v", err)
 	}
@@ -54,12 +53,8 @@ func pvscanCache(diskLabel string) error {
 
 // pvs (list pvs)
 func Pvs(filter ...string) ([]Pv, error) {
-	filterStr := ""
-	if len(filter) > 0 {
-		filterStr = strings.Join(filter, " ")
-	}
-
-	output, err := RunCommand("pvs --noheadings --units m --nosuffix --separator , %s", filterStr)
+	args := append([]string{"--noheadings", "--units", "m", "--nosuffix", "--separator", ","}, filter...)
+	output, err := RunCommand("pvs", args...)
 	if err != nil {
 		return []Pv{}, fmt.Errorf("pvs: %v", err)
 	}
@@ -98,19 +93,45 @@ func Pvs(filter ...string) ([]Pv, error) {
 	return pvList, nil
 }
 
-// pvresize (resize pv)
-func Pvresize(pv interface{}, setPvSize ...float64) error {
+// lvmSize formats bytes as an LVM size argument.
+func lvmSize(bytes int64) string {
+	if bytes%util.MiB == 0 {
+		return fmt.Sprintf("%dm", bytes/util.MiB)
+	}
+
+	return fmt.Sprintf("%db", bytes)
+}
+
+// pvresize (resize pv). If setPvSize is given, it is resolved against the
+// size of the underlying device, and util.RestSize() uses all of it.
+func Pvresize(pv interface{}, setPvSize ...util.Size) error {
 	pvPaths, err := extractPathsFromPvs(pv)
 	if err != nil {
 		return fmt.Errorf("pvresize: %v", err)
 	}
 
-	setPvSizeOpt := ""
-	if len(setPvSize) > 0 {
-		setPvSizeOpt = fmt.Sprintf("--setphysicalvolumesize %fm", setPvSize[0])
+	args := []string{"-y"}
+	if len(setPvSize) > 0 && setPvSize[0].Kind != util.SizeRest {
+		size := setPvSize[0]
+		bytes := size.Bytes
+		if size.Kind != util.SizeAbsolute {
+			output, err := util.OutputCommand("blockdev", "--getsize64", pvPaths[0])
+			if err != nil {
+				return fmt.Errorf("pvresize: failed to get size of %s: %v", pvPaths[0], err)
+			}
+			deviceSize, err := strconv.ParseInt(output, 10, 64)
+			if err != nil {
+				return fmt.Errorf("pvresize: failed to get size of %s: %v", pvPaths[0], err)
+			}
+			bytes, err = size.Resolve(deviceSize)
+			if err != nil {
+				return fmt.Errorf("pvresize: %v", err)
+			}
+		}
+		args = append(args, "--setphysicalvolumesize", lvmSize(bytes))
 	}
 
-	_, err = RunCommand("pvresize -y %s %s", setPvSizeOpt, pvPaths[0])
+	_, err = RunCommand("pvresize", append(args, pvPaths[0])...)
 	if err != nil {
 		return fmt.Errorf("pvresize: %v", err)
 	}
@@ -128,7 +149,7 @@ func Pvremove(pv interface{}) error {
 		return fmt.Errorf("pvremove: %v", err)
 	}
 
-	_, err = RunCommand("pvremove -y %s", pvPaths[0])
+	_, err = RunCommand("pvremove", "-y", pvPaths[0])
 	if err != nil {
 		return fmt.Errorf("pvremove: %v", err)
 	}
@@ -147,22 +168,19 @@ func Vgcreate(name string, pvs ...interface{}) error {
 		return fmt.Errorf("vgcreate: %v", err)
 	}
 
-	_, err = RunCommand("vgcreate %s %s", name, strings.Join(pvPaths, " "))
+	_, err = RunCommand("vgcreate", append([]string{name}, pvPaths...)...)
 	if err != nil {
 		return fmt.Errorf("vgcreate: %v", err)
 	}
+	addDeactivateCleanup(name)
 
 	return nil
 }
 
 // vgs (list vgs)
 func Vgs(filter ...string) ([]Vg, error) {
-	filterStr := ""
-	if len(filter) > 0 {
-		filterStr = strings.Join(filter, " ")
-	}
-
-	output, err := RunCommand("vgs --noheadings --units m --nosuffix --separator , %s", filterStr)
+	args := append([]string{"--noheadings", "--units", "m", "--nosuffix", "--separator", ","}, filter...)
+	output, err := RunCommand("vgs", args...)
 	if err != nil {
 		return []Vg{}, fmt.Errorf("vgs: %v", err)
 	}
@@ -227,10 +245,12 @@ func Vgs(filter ...string) ([]Vg, error) {
 
 // vgrename (rename vg)
 func Vgrename(oldName, newName string) (Vg, error) {
-	_, err := RunCommand("vgrename %s %s", oldName, newName)
+	_, err := RunCommand("vgrename", oldName, newName)
 	if err != nil {
 		return Vg{}, fmt.Errorf("vgrename: %v", err)
 	}
+	util.RemoveCleanup("vg:" + oldName)
+	addDeactivateCleanup(newName)
 
 	newVg, err := Vgs(newName)
 	if err != nil {
@@ -255,7 +275,7 @@ func Vgextend(vg interface{}, pvs ...interface{}) error {
 		return fmt.Errorf("vgextend: %v", err)
 	}
 
-	_, err = RunCommand("vgextend %s %s", vgName, strings.Join(pvPaths, " "))
+	_, err = RunCommand("vgextend", append([]string{vgName}, pvPaths...)...)
 	if err != nil {
 		return fmt.Errorf("vgextend: %v", err)
 	}
@@ -278,7 +298,7 @@ func Vgreduce(vg interface{}, pvs ...interface{}) error {
 		return fmt.Errorf("vgreduce: %v", err)
 	}
 
-	_, err = RunCommand("vgreduce %s %s", vgName, strings.Join(pvPaths, " "))
+	_, err = RunCommand("vgreduce", append([]string{vgName}, pvPaths...)...)
 	if err != nil {
 		return fmt.Errorf("vgreduce: %v", err)
 	}
@@ -293,34 +313,91 @@ func Vgremove(vg interface{}) error {
 		return fmt.Errorf("vgremove: %v", err)
 	}
 
-	_, err = RunCommand("vgremove -y %s", vgName)
+	_, err = RunCommand("vgremove", "-y", vgName)
 	if err != nil {
 		return fmt.Errorf("vgremove: %v", err)
 	}
+	util.RemoveCleanup("vg:" + vgName)
+
+	return nil
+}
+
+// vgchange -an (deactivate every lv in vg)
+func Vgdeactivate(vg interface{}) error {
+	vgName, err := extractNameFromVg(vg)
+	if err != nil {
+		return fmt.Errorf("vgdeactivate: %v", err)
+	}
+
+	_, err = RunCommand("vgchange", "-an", vgName)
+	if err != nil {
+		return fmt.Errorf("vgdeactivate: %v", err)
+	}
+	util.RemoveCleanup("vg:" + vgName)
 
 	return nil
 }
 
-// lvcreate (create lv)
-func Lvcreate(name string, vg interface{}, lvType LVType, size interface{}) error {
+// vgchange -ay (activate every lv in vg)
+func Vgactivate(vg interface{}) error {
+	vgName, err := extractNameFromVg(vg)
+	if err != nil {
+		return fmt.Errorf("vgactivate: %v", err)
+	}
+
+	_, err = RunCommand("vgchange", "-ay", vgName)
+	if err != nil {
+		return fmt.Errorf("vgactivate: %v", err)
+	}
+	addDeactivateCleanup(vgName)
+
+	return nil
+}
+
+// addDeactivateCleanup registers the deactivation of vgName as the cleanup
+// for creating or activating it (see util.AddCleanup).
+func addDeactivateCleanup(vgName string) {
+	util.AddCleanup("vg:"+vgName, "deactivate volume group "+vgName, func() error {
+		return Vgdeactivate(vgName)
+	})
+}
+
+// lvcreate (create lv). Percentages refer to the whole VG unless they say
+// otherwise (e.g. "100%FREE"), util.RestSize() uses all the free space and
+// sizes counted from the end leave that much free space.
+func Lvcreate(name string, vg interface{}, lvType LVType, size util.Size) error {
 	vgName, err := extractNameFromVg(vg)
 	if err != nil {
 		return fmt.Errorf("lvcreate: %v", err)
 	}
 
-	sizeStr := ""
-	switch sizeVar := size.(type) {
-	case string:
-		sizeStr = "-l" + sizeVar
-	case float64:
-		sizeStr = fmt.Sprintf("-L %.2fm", sizeVar)
-	case int:
-		sizeStr = fmt.Sprintf("-L %dm", sizeVar)
-	default:
-		return fmt.Errorf("lvcreate: expected either string, int, or float64 for size, got %s", reflect.TypeOf(size))
+	var sizeArgs []string
+	switch size.Kind {
+	case util.SizeAbsolute:
+		sizeArgs = []string{"-L", lvmSize(size.Bytes)}
+	case util.SizePercent:
+		percentOf := size.PercentOf
+		if percentOf == "" {
+			percentOf = "VG"
+		}
+		sizeArgs = []string{"-l", strconv.FormatFloat(size.Percent, 'f', -1, 64) + "%" + percentOf}
+	case util.SizeRest:
+		sizeArgs = []string{"-l", "100%FREE"}
+	case util.SizeFromEnd:
+		vgInfo, err := FindVg(vgName)
+		if err != nil {
+			return fmt.Errorf("lvcreate: %v", err)
+		}
+		free := int64(vgInfo.Free * float64(util.MiB))
+		bytes, err := size.Resolve(free)
+		if err != nil {
+			return fmt.Errorf("lvcreate: %v", err)
+		}
+		sizeArgs = []string{"-L", lvmSize(bytes)}
 	}
 
-	_, err = RunCommand("lvcreate -y --type %s %s %s -n %s", lvType, sizeStr, vgName, name)
+	args := append([]string{"-y", "--type", string(lvType)}, sizeArgs...)
+	_, err = RunCommand("lvcreate", append(args, vgName, "-n", name)...)
 	if err != nil {
 		return fmt.Errorf("lvcreate: %v", err)
 	}
@@ -328,7 +405,13 @@ func Lvcreate(name string, vg interface{}, lvType LVType, size interface{}) erro
 	return nil
 }
 
-func LvThinCreate(name string, vg, pool interface{}, size float64) error {
+// LvThinCreate creates a thin LV of the given virtual size, which must be
+// absolute since a thin LV may be larger than its pool.
+func LvThinCreate(name string, vg, pool interface{}, size util.Size) error {
+	if size.Kind != util.SizeAbsolute {
+		return fmt.Errorf("lvmThinCreate: thin volume size must be absolute, got %s", size)
+	}
+
 	vgName, err := extractNameFromVg(vg)
 	if err != nil {
 		return fmt.Errorf("lvmThinCreate: %v", err)
@@ -339,7 +422,7 @@ func LvThinCreate(name string, vg, pool interface{}, size float64) error {
 		return fmt.Errorf("lvmThinCreate: %v", err)
 	}
 
-	_, err = RunCommand("lvcreate -y -n %s -V %.2fm --thinpool %s %s", name, size, poolName, vgName)
+	_, err = RunCommand("lvcreate", "-y", "-n", name, "-V", lvmSize(size.Bytes), "--thinpool", poolName, vgName)
 	if err != nil {
 		return fmt.Errorf("lvmThinCreate: %v", err)
 	}
@@ -349,12 +432,8 @@ func LvThinCreate(name string, vg, pool interface{}, size float64) error {
 
 // lvs (list lvs)
 func Lvs(filter ...string) ([]Lv, error) {
-	filterStr := ""
-	if len(filter) > 0 {
-		filterStr = strings.Join(filter, " ")
-	}
-
-	output, err := RunCommand("lvs --noheadings --units m --nosuffix --separator , %s", filterStr)
+	args := append([]string{"--noheadings", "--units", "m", "--nosuffix", "--separator", ","}, filter...)
+	output, err := RunCommand("lvs", args...)
 	if err != nil {
 		return []Lv{}, fmt.Errorf("lvs: %v", err)
 	}
@@ -405,7 +484,7 @@ func Lvrename(oldName, newName string, vg interface{}) (Lv, error) {
 		return Lv{}, fmt.Errorf("lvrename: %v", err)
 	}
 
-	_, err = RunCommand("lvrename %s %s %s", vgName, oldName, newName)
+	_, err = RunCommand("lvrename", vgName, oldName, newName)
 	if err != nil {
 		return Lv{}, fmt.Errorf("lvrename: %v", err)
 	}
@@ -431,7 +510,7 @@ func Lvremove(lv interface{}) error {
 		return fmt.Errorf("lvremove: %v", err)
 	}
 
-	_, err = RunCommand("lvremove -y %s", lvName)
+	_, err = RunCommand("lvremove", "-y", lvName)
 	if err != nil {
 		return fmt.Errorf("lvremove: %v", err)
 	}
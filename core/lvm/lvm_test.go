@@ -9,6 +9,8 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+
+	"github.com/vanilla-os/albius/core/util"
 )
 
 var lvmpart string
@@ -78,7 +80,7 @@ func TestPvShrink(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	err = Pvresize(&pvs[0], 10.0)
+	err = Pvresize(&pvs[0], util.MiBSize(10))
 	if err != nil {
 		t.Error(err)
 	}
@@ -206,7 +208,7 @@ func TestVgExtend(t *testing.T) {
 }
 
 func TestLvCreate(t *testing.T) {
-	err := Lvcreate("MyLv0", "MyTestingVG1", LV_TYPE_LINEAR, 30)
+	err := Lvcreate("MyLv0", "MyTestingVG1", LV_TYPE_LINEAR, util.MiBSize(30))
 	if err != nil {
 		t.Error(err)
 	}
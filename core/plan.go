@@ -0,0 +1,660 @@
+package albius
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/vanilla-os/albius/core/disk"
+	"github.com/vanilla-os/albius/core/util"
+)
+
+// PlanAction is a single side effect the recipe would have on the system:
+// either a command or a file being written or removed.
+type PlanAction struct {
+	Command string `json:"command,omitempty"`
+	// Chroot is the root Command would be executed in, if any
+	Chroot string `json:"chroot,omitempty"`
+	// Stdin reports whether Command would be fed input (e.g. a password),
+	// which is never included in the plan
+	Stdin bool `json:"stdin,omitempty"`
+	// File is the path of a file that would be written or removed
+	File    string `json:"file,omitempty"`
+	Content string `json:"content,omitempty"`
+	Remove  bool   `json:"remove,omitempty"`
+	// Note describes an action which is not carried by an external command
+	Note string `json:"note,omitempty"`
+}
+
+func (a PlanAction) String() string {
+	switch {
+	case a.Note != "":
+		return "# " + a.Note
+	case a.Remove:
+		return "rm " + a.File
+	case a.File != "":
+		content := strings.TrimSuffix(a.Content, "\n")
+		return fmt.Sprintf("write %s:\n    %s", a.File, strings.ReplaceAll(content, "\n", "\n    "))
+	}
+
+	command := a.Command
+	if a.Chroot != "" {
+		command = fmt.Sprintf("chroot %s %s", util.Quote(a.Chroot), command)
+	}
+	if a.Stdin {
+		command += " < (hidden input)"
+	}
+
+	return command
+}
+
+// PlanStep groups the actions performed by a single recipe step.
+type PlanStep struct {
+	// Stage is the recipe section the step belongs to, using the same names
+	// as ValidationError.Section
+	Stage     string       `json:"stage"`
+	Step      int          `json:"step"`
+	Operation string       `json:"operation"`
+	Actions   []PlanAction `json:"actions"`
+}
+
+// Plan is the list of everything a recipe would do, in order.
+type Plan struct {
+	Steps []PlanStep `json:"steps"`
+}
+
+func (p *Plan) String() string {
+	var sb strings.Builder
+	for _, step := range p.Steps {
+		header := step.Stage
+		if step.Step >= 0 {
+			header = fmt.Sprintf("%s[%d]", step.Stage, step.Step)
+		}
+		if step.Operation != "" {
+			header += " " + step.Operation
+		}
+		sb.WriteString(header + "\n")
+		for _, action := range step.Actions {
+			sb.WriteString("  " + action.String() + "\n")
+		}
+	}
+
+	return sb.String()
+}
+
+// Plan walks through Setup, Mountpoints, Installation and PostInstallation
+// like a real run would, but records every command and file write instead
+// of executing them. Queries which do not change the system (e.g. listing a
+// disk's partitions) are still executed so the plan reflects the current
+// machine, and their results are adjusted to account for the changes made
+// by previous steps.
+//
+// The recipe is validated first, and the partial plan is returned along with
+// the error if any step fails.
+func (recipe *Recipe) Plan() (*Plan, error) {
+	err := recipe.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	rec := newRecorder()
+	prevExecutor := util.SetExecutor(rec)
+	defer util.SetExecutor(prevExecutor)
+	// Nothing recorded actually happens, so there is nothing to undo
+	defer util.IsolateCleanups()()
+
+	rec.host = prevExecutor
+	if recipe.Executor != nil {
+		rec.host = recipe.Executor
+	}
+
+	plan := &Plan{}
+	addStep := func(stage string, step int, operation string) {
+		plan.Steps = append(plan.Steps, PlanStep{
+			Stage:     stage,
+			Step:      step,
+			Operation: operation,
+			Actions:   rec.flush(),
+		})
+	}
+
+	// Devices created while planning do not exist
+	recipe.devices = nil
+	defer func() { recipe.devices = nil }()
+
+	// Unlike runs, facts are detected when first needed since nothing
+	// changes while planning
+	recipe.detectedFacts = nil
+	defer func() { recipe.detectedFacts = nil }()
+
+	for i, step := range recipe.Setup {
+		skip, err := recipe.unmetCondition(step.When, step.Disk)
+		if err == nil && skip != "" {
+			rec.note("skipped: " + skip)
+		} else if err == nil {
+			err = recipe.runSetupStep(step)
+		}
+		addStep("setup", i, step.Operation)
+		if err != nil {
+			return plan, fmt.Errorf("failed to plan setup operation %s: %s", step.Operation, err)
+		}
+	}
+
+	err = recipe.setupMountpoints()
+	addStep("mountpoints", -1, "")
+	if err != nil {
+		return plan, fmt.Errorf("failed to plan mountpoints: %s", err)
+	}
+
+	// The OCI image is pulled through prometheus, which does not run any
+	// command we could record.
+	if recipe.Installation.Method == OCI {
+		verb := "pull"
+		if source, err := disk.ParseOCISource(recipe.Installation.Source); err == nil && source.Local() {
+			verb = "copy"
+		}
+		if recipe.Installation.Digest != "" {
+			rec.note(fmt.Sprintf("check that OCI image %s has digest %s", recipe.Installation.Source, recipe.Installation.Digest))
+		}
+		if recipe.Installation.SignaturePolicy != "" {
+			rec.note(fmt.Sprintf("check the signatures of OCI image %s against %s", recipe.Installation.Source, recipe.Installation.SignaturePolicy))
+		}
+		rec.note(fmt.Sprintf("%s OCI image %s into %s and copy it into %s", verb, recipe.Installation.Source, filepath.Join(RootA, "var", "storage"), RootA))
+		rec.WriteFile(filepath.Join(RootA, ".oci_digest"), []byte("<digest of "+recipe.Installation.Source+">"), 0o644)
+	} else {
+		err = recipe.copyInstallationFiles()
+	}
+	if err == nil {
+		err = recipe.configureInstallation()
+	}
+	addStep("installation", -1, string(recipe.Installation.Method))
+	if err != nil {
+		return plan, err
+	}
+
+	for i, step := range recipe.PostInstallation {
+		skip, err := recipe.unmetCondition(step.When, "")
+		if err == nil && skip != "" {
+			rec.note("skipped: " + skip)
+		} else if err == nil {
+			err = recipe.runPostInstallStep(step)
+		}
+		addStep("postInstallation", i, step.Operation)
+		if err != nil {
+			return plan, fmt.Errorf("failed to plan post-install operation %s: %s", step.Operation, err)
+		}
+	}
+
+	return plan, nil
+}
+
+// recorder is an util.Executor which records every command and file write
+// instead of performing them. Read-only queries are executed by host, and
+// the recorder keeps track of the partition tables, filesystems, LUKS
+// containers and LVM volumes created by recorded commands so that following
+// queries see the same state they would see during a real run.
+type recorder struct {
+	actions []PlanAction
+	// host executes the read-only queries
+	host util.Executor
+
+	disks map[string]*disk.Disk
+	// devices created during the plan, which do not exist yet
+	newDevices map[string]bool
+	// filesystem type of formatted devices
+	filesystems map[string]string
+	// name (PARTLABEL) of partitions named during the plan
+	partLabels map[string]string
+	// LUKS mapping name -> underlying device
+	luksMappings map[string]string
+	// VG name -> LV names
+	vgs map[string][]string
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		host:         util.SystemExecutor{},
+		disks:        map[string]*disk.Disk{},
+		newDevices:   map[string]bool{},
+		filesystems:  map[string]string{},
+		partLabels:   map[string]string{},
+		luksMappings: map[string]string{},
+		vgs:          map[string][]string{},
+	}
+}
+
+func (r *recorder) DryRun() bool {
+	return true
+}
+
+func (r *recorder) flush() []PlanAction {
+	actions := r.actions
+	r.actions = []PlanAction{}
+	return actions
+}
+
+func (r *recorder) note(msg string) {
+	r.actions = append(r.actions, PlanAction{Note: util.MaskSecrets(msg)})
+}
+
+func (r *recorder) record(cmd util.Command) {
+	chroot := cmd.Chroot
+	cmd.Chroot = ""
+	r.actions = append(r.actions, PlanAction{
+		Command: util.MaskSecrets(cmd.String()),
+		Chroot:  chroot,
+		Stdin:   cmd.Stdin != "",
+	})
+
+	// Commands executed in the target system do not change the host
+	if chroot == "" {
+		r.track(append([]string{cmd.Name}, cmd.Args...))
+	}
+}
+
+func (r *recorder) Run(cmd util.Command) error {
+	r.record(cmd)
+	return nil
+}
+
+func (r *recorder) WriteFile(name string, data []byte, perm os.FileMode) error {
+	r.actions = append(r.actions, PlanAction{File: name, Content: util.MaskSecrets(string(data))})
+	return nil
+}
+
+func (r *recorder) Remove(name string) error {
+	r.actions = append(r.actions, PlanAction{File: name, Remove: true})
+	return nil
+}
+
+// Output answers read-only queries and records everything else.
+func (r *recorder) Output(cmd util.Command) (string, error) {
+	if cmd.Chroot == "" {
+		args := cmd.Args
+		switch cmd.Name {
+		case "parted":
+			if len(args) > 0 && args[len(args)-1] == "print" {
+				return r.partedPrint(cmd)
+			}
+		case "lsblk":
+			return r.lsblk(cmd)
+		case "cryptsetup":
+			if slices.Contains(args, "isLuks") {
+				return r.isLuks(cmd)
+			}
+		case "pvs", "vgs", "lvs":
+			return r.lvmQuery(cmd)
+		case "blkid":
+			return r.blkid(cmd)
+		case "readlink", "uname", "systemd-detect-virt", "os-prober":
+			return r.host.Output(cmd)
+		case "ls":
+			return r.ls(cmd)
+		}
+	}
+
+	r.record(cmd)
+	return "", nil
+}
+
+// query executes a read-only command on the host. Devices which will only
+// exist later in the real run cannot be queried, so errors are swallowed.
+func (r *recorder) query(cmd util.Command) string {
+	out, err := r.host.Output(cmd)
+	if err != nil {
+		return ""
+	}
+
+	return out
+}
+
+// kernelPlaceholder stands for the version of the kernels of the target
+// system, which is only installed by the real run
+const kernelPlaceholder = "<kernel version>"
+
+// ls lists a directory of the host, except for the target system's /boot,
+// which holds a kernel and its initramfs.
+func (r *recorder) ls(cmd util.Command) (string, error) {
+	if cmd.Args[len(cmd.Args)-1] == filepath.Join(RootA, "boot") {
+		return "initrd.img-" + kernelPlaceholder + "\nvmlinuz-" + kernelPlaceholder, nil
+	}
+
+	return r.host.Output(cmd)
+}
+
+func uuidPlaceholder(device string) string {
+	return fmt.Sprintf("<uuid:%s>", device)
+}
+
+func (r *recorder) partedPrint(cmd util.Command) (string, error) {
+	diskPath := cmd.Args[1]
+	target, ok := r.disks[diskPath]
+	if !ok {
+		// If disk is unformatted, parted returns the expected json but also
+		// throws an error, see disk.LocateDisk
+		out, err := r.host.Output(cmd)
+		if err != nil && out == "" {
+			return "", err
+		}
+
+		var decoded struct {
+			Disk disk.Disk
+		}
+		err = json.Unmarshal([]byte(out), &decoded)
+		if err != nil {
+			return "", fmt.Errorf("could not find device %s", diskPath)
+		}
+		for i := range decoded.Disk.Partitions {
+			decoded.Disk.Partitions[i].FillPath(decoded.Disk.Path)
+		}
+
+		target = &decoded.Disk
+		r.disks[diskPath] = target
+	}
+
+	out, err := json.Marshal(struct{ Disk *disk.Disk }{target})
+	if err != nil {
+		return "", err
+	}
+
+	return string(out), nil
+}
+
+func (r *recorder) lsblk(cmd util.Command) (string, error) {
+	args := cmd.Args
+	device := args[len(args)-1]
+	column := ""
+	noDeps := false
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-") && strings.HasSuffix(arg, "o") && i+1 < len(args) {
+			column = args[i+1]
+		}
+		if arg == "-d" {
+			noDeps = true
+		}
+	}
+
+	switch column {
+	case "NAME":
+		// Used to count the partitions in a disk
+		if target, ok := r.disks[device]; ok {
+			names := []string{device}
+			for _, part := range target.Partitions {
+				names = append(names, part.Path)
+			}
+			return strings.Join(names, "\n"), nil
+		}
+	case "UUID":
+		if _, ok := r.filesystems[device]; ok || r.newDevices[device] {
+			return uuidPlaceholder(device), nil
+		}
+		if out := r.query(cmd); out != "" {
+			return out, nil
+		}
+		return uuidPlaceholder(device), nil
+	case "FSTYPE":
+		fs, ok := r.filesystems[device]
+		if !ok {
+			break
+		}
+		// Without -d, lsblk also lists the filesystem inside a LUKS
+		// container
+		if !noDeps && fs == "crypto_LUKS" {
+			for mapping, dev := range r.luksMappings {
+				if dev == device {
+					return fs + "\n" + r.filesystems["/dev/mapper/"+mapping], nil
+				}
+			}
+		}
+		return fs, nil
+	case "MOUNTPOINTS":
+		if r.newDevices[device] {
+			return "", nil
+		}
+	}
+
+	return r.query(cmd), nil
+}
+
+func (r *recorder) isLuks(cmd util.Command) (string, error) {
+	device := cmd.Args[len(cmd.Args)-1]
+	if fs, ok := r.filesystems[device]; ok {
+		if fs == "crypto_LUKS" {
+			return "", nil
+		}
+		return "", &util.ExitError{Code: 1}
+	}
+
+	_, err := r.host.Output(cmd)
+	if err != nil {
+		return "", &util.ExitError{Code: 1}
+	}
+
+	return "", nil
+}
+
+func (r *recorder) lvmQuery(cmd util.Command) (string, error) {
+	filter := cmd.Args[len(cmd.Args)-1]
+	switch cmd.Name {
+	case "vgs":
+		if _, ok := r.vgs[filter]; ok {
+			return fmt.Sprintf("%s,0,0,0,wz--n-,0,0", filter), nil
+		}
+	case "lvs":
+		vgName, lvName, found := strings.Cut(filter, "/")
+		if found && slices.Contains(r.vgs[vgName], lvName) {
+			return fmt.Sprintf("%s,%s,-wi-a-----,0,", lvName, vgName), nil
+		}
+	}
+
+	return r.query(cmd), nil
+}
+
+// blkid looks up devices by tag (e.g. PARTLABEL=root). Partitions named
+// during the plan are matched by their new name, and the host's answer is
+// ignored for partitions which were removed or recreated.
+func (r *recorder) blkid(cmd util.Command) (string, error) {
+	tag, value := "", ""
+	for i, arg := range cmd.Args {
+		if arg == "-t" && i+1 < len(cmd.Args) {
+			tag, value, _ = strings.Cut(cmd.Args[i+1], "=")
+		}
+	}
+
+	devices := []string{}
+	if tag == "PARTLABEL" {
+		for device, label := range r.partLabels {
+			if label == value {
+				devices = append(devices, device)
+			}
+		}
+	}
+
+	out, _ := r.host.Output(cmd)
+	for _, device := range strings.Fields(out) {
+		if _, renamed := r.partLabels[device]; renamed || r.newDevices[device] || r.removed(device) {
+			continue
+		}
+		devices = append(devices, device)
+	}
+
+	if len(devices) == 0 {
+		// blkid exits with 2 when no device matches
+		return "", &util.ExitError{Code: 2}
+	}
+
+	slices.Sort(devices)
+	return strings.Join(devices, "\n"), nil
+}
+
+// removed tells whether device is a partition of a disk whose partition
+// table changed during the plan, and which no longer exists.
+func (r *recorder) removed(device string) bool {
+	diskPath, partName := util.SeparateDiskPart(device)
+	target, ok := r.disks[diskPath]
+	if !ok || partName == "" {
+		return false
+	}
+
+	return !slices.ContainsFunc(target.Partitions, func(p disk.Partition) bool { return p.Path == device })
+}
+
+// track updates the simulated state according to the argv of a recorded
+// command.
+func (r *recorder) track(fields []string) {
+	last := fields[len(fields)-1]
+	switch {
+	case fields[0] == "parted":
+		r.trackParted(fields)
+	case strings.HasPrefix(fields[0], "mkfs."):
+		fs := strings.TrimPrefix(fields[0], "mkfs.")
+		if fs == "fat" {
+			fs = "vfat"
+		}
+		r.setFilesystem(last, fs)
+	case fields[0] == "mkswap":
+		r.setFilesystem(last, "swap")
+	case fields[0] == "cryptsetup" && slices.Contains(fields, "luksFormat"):
+		r.setFilesystem(last, "crypto_LUKS")
+	case fields[0] == "cryptsetup" && slices.Contains(fields, "open"):
+		r.luksMappings[last] = fields[len(fields)-2]
+	case fields[0] == "vgcreate":
+		r.vgs[fields[1]] = []string{}
+	case fields[0] == "vgrename":
+		r.vgs[fields[2]] = r.vgs[fields[1]]
+		delete(r.vgs, fields[1])
+	case fields[0] == "vgremove":
+		delete(r.vgs, last)
+	case fields[0] == "lvcreate":
+		r.trackLvcreate(fields)
+	case fields[0] == "lvrename":
+		vgName := fields[1]
+		lvs := r.vgs[vgName]
+		if idx := slices.Index(lvs, fields[2]); idx >= 0 {
+			lvs[idx] = fields[3]
+		}
+		r.newDevices[fmt.Sprintf("/dev/%s/%s", vgName, fields[3])] = true
+	}
+}
+
+func (r *recorder) setFilesystem(device, fs string) {
+	r.filesystems[device] = fs
+	for _, target := range r.disks {
+		for i, part := range target.Partitions {
+			if part.Path == device {
+				target.Partitions[i].Filesystem = disk.PartitionFs(fs)
+			}
+		}
+	}
+}
+
+func (r *recorder) trackLvcreate(fields []string) {
+	name, vgName := "", ""
+	positional := []string{}
+	for i := 1; i < len(fields); i++ {
+		switch fields[i] {
+		case "-n":
+			i++
+			name = fields[i]
+		case "--type", "-L", "-l", "-V", "--thinpool":
+			i++
+		default:
+			if !strings.HasPrefix(fields[i], "-") {
+				positional = append(positional, fields[i])
+			}
+		}
+	}
+	if len(positional) > 0 {
+		vgName = positional[len(positional)-1]
+	}
+
+	r.vgs[vgName] = append(r.vgs[vgName], name)
+	r.newDevices[fmt.Sprintf("/dev/%s/%s", vgName, name)] = true
+}
+
+func mibValue(pos string) float64 {
+	val, _ := strconv.ParseFloat(strings.TrimSuffix(pos, "MiB"), 64)
+	return val
+}
+
+func (r *recorder) trackParted(fields []string) {
+	target, ok := r.disks[fields[2]]
+	if !ok {
+		return
+	}
+
+	opIdx := 3
+	if fields[opIdx] == "unit" {
+		opIdx += 2
+	}
+
+	switch fields[opIdx] {
+	case "mklabel":
+		target.Label = disk.DiskLabel(fields[opIdx+1])
+		for _, part := range target.Partitions {
+			delete(r.partLabels, part.Path)
+		}
+		target.Partitions = []disk.Partition{}
+	case "mkpart":
+		start := fields[len(fields)-2]
+		end := fields[len(fields)-1]
+		if end == "100%" {
+			end = target.Size
+		}
+
+		// parted uses the lowest available partition number
+		number := 1
+		for slices.ContainsFunc(target.Partitions, func(p disk.Partition) bool { return p.Number == number }) {
+			number++
+		}
+
+		part := disk.Partition{
+			Number: number,
+			Start:  start + "MiB",
+			End:    strings.TrimSuffix(end, "MiB") + "MiB",
+		}
+		part.Size = fmt.Sprintf("%gMiB", mibValue(part.End)-mibValue(part.Start))
+		part.FillPath(target.Path)
+		target.Partitions = append(target.Partitions, part)
+		slices.SortFunc(target.Partitions, func(a, b disk.Partition) int { return a.Number - b.Number })
+		r.newDevices[part.Path] = true
+		delete(r.partLabels, part.Path)
+	case "name":
+		number, _ := strconv.Atoi(fields[opIdx+1])
+		for _, part := range target.Partitions {
+			if part.Number == number {
+				// Names are quoted for parted, see disk.quotePartedString
+				name := fields[opIdx+2]
+				r.partLabels[part.Path] = name[1 : len(name)-1]
+			}
+		}
+	case "rm":
+		number, _ := strconv.Atoi(fields[opIdx+1])
+		target.Partitions = slices.DeleteFunc(target.Partitions, func(p disk.Partition) bool { return p.Number == number })
+		delete(r.partLabels, partitionPath(target.Path, number))
+	case "set":
+		number, _ := strconv.Atoi(fields[opIdx+1])
+		flag := fields[opIdx+2]
+		for i, part := range target.Partitions {
+			if part.Number == number {
+				flags := slices.DeleteFunc(part.Flags, func(f string) bool { return f == flag })
+				if fields[opIdx+3] == "on" {
+					flags = append(flags, flag)
+				}
+				target.Partitions[i].Flags = flags
+			}
+		}
+	case "resizepart":
+		number, _ := strconv.Atoi(fields[opIdx+1])
+		for i, part := range target.Partitions {
+			if part.Number == number {
+				target.Partitions[i].End = fields[opIdx+2] + "MiB"
+				target.Partitions[i].Size = fmt.Sprintf("%gMiB", mibValue(target.Partitions[i].End)-mibValue(part.Start))
+			}
+		}
+	}
+}
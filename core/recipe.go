@@ -1,12 +1,14 @@
 package albius
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
-	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -29,16 +31,63 @@ const (
 	RootB = "/mnt/b"
 )
 
+// lvmPathExpr matches LVM logical volume paths (e.g. /dev/vg_name/lv_name)
+var lvmPathExpr = regexp.MustCompile(`^/dev/(?P<vg>[\w-]+)/(?P<lv>[\w-]+)$`)
+
 type Recipe struct {
 	Setup            []SetupStep
 	Mountpoints      []Mountpoint
 	Installation     Installation
 	PostInstallation []PostStep
+	// Variables are referenced as ${name} in the rest of the recipe, and
+	// replaced by SetVariables
+	Variables map[string]Variable `json:",omitempty"`
+	// Include lists recipe fragments, relative to the recipe, which
+	// ReadRecipe merges this recipe on top of
+	Include []string `json:",omitempty"`
+	// Override lists the sections (setup, mountpoints or postInstallation)
+	// which replace those of the included fragments instead of being
+	// appended to them
+	Override []string `json:",omitempty"`
+
+	// Facts, if set, are tested by the when clause of steps instead of the
+	// facts detected on the machine (see DetectFacts), e.g. to plan the
+	// installation of another machine.
+	Facts *Facts `json:"-"`
+
+	// Executor runs every command and file operation performed while
+	// applying this recipe. If nil, the package-level executor from
+	// util.SetExecutor is used.
+	Executor util.Executor `json:"-"`
+
+	// OnEvent, if set, is called with every Event reported while applying
+	// this recipe, from the goroutine doing the work.
+	OnEvent func(Event) `json:"-"`
+	// Events, if set, receives every Event reported while applying this
+	// recipe. Sends block, so the channel must be drained while running.
+	Events chan<- Event `json:"-"`
+
+	// checkpoint records progress while running, see Run and Resume
+	checkpoint *checkpoint
+	// emitter delivers events while running, see use
+	emitter *emitter
+	// devices holds the path of the device created by each setup step with
+	// an id, see SetupStep.ID
+	devices map[string]string
+	// detectedFacts are the facts detected for the steps' conditions, see
+	// detectFacts
+	detectedFacts *Facts
 }
 
 type SetupStep struct {
 	Disk, Operation string
 	Params          []interface{}
+	// ID names the device created by the step, so that later steps and
+	// mountpoints can reference it. Only mkpart, lvcreate and luks-format
+	// create devices.
+	ID string `json:",omitempty"`
+	// When, if set, is the condition for the step to run
+	When *Condition `json:",omitempty"`
 }
 
 type Mountpoint struct {
@@ -46,31 +95,181 @@ type Mountpoint struct {
 }
 
 type Installation struct {
-	Method        InstallationMethod
-	Source        string
-	InitramfsPre  []string
-	InitramfsPost []string
+	Method InstallationMethod
+	Source string
+	// Digest is the manifest digest the OCI image must have, if set
+	Digest string
+	// SignaturePolicy is the path of a containers-policy.json(5) file the
+	// OCI image's signatures must satisfy, if set
+	SignaturePolicy string
+	InitramfsPre    []string
+	InitramfsPost   []string
 }
 
 type PostStep struct {
 	Chroot    bool
 	Operation string
 	Params    []interface{}
+	// When, if set, is the condition for the step to run
+	When *Condition `json:",omitempty"`
+}
+
+// use installs the recipe's Executor and event listeners, if any, returning
+// a function which restores the previous state.
+func (recipe *Recipe) use() func() {
+	restore := []func(){}
+
+	if recipe.Executor != nil {
+		prev := util.SetExecutor(recipe.Executor)
+		restore = append(restore, func() { util.SetExecutor(prev) })
+	}
+
+	if (recipe.OnEvent != nil || recipe.Events != nil) && recipe.emitter == nil {
+		recipe.emitter = &emitter{recipe: recipe, current: Event{Step: -1, Steps: -1}}
+		reporter := &eventReporter{emitter: recipe.emitter}
+		reporter.prev = util.SetReporter(reporter)
+		restore = append(restore, func() {
+			util.SetReporter(reporter.prev)
+			recipe.emitter = nil
+		})
+	}
+
+	return func() {
+		for i := len(restore) - 1; i >= 0; i-- {
+			restore[i]()
+		}
+	}
 }
 
+// ReadRecipe reads the recipe at path, written in JSON, YAML or TOML (see
+// DetectRecipeFormat), and merges it with the fragments it includes, see
+// Recipe.Include.
 func ReadRecipe(path string) (*Recipe, error) {
-	content, err := os.ReadFile(path)
+	recipe, err := readRecipeFile(path, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read recipe: %s", err)
 	}
 
-	var recipe Recipe
-	err = json.Unmarshal(content, &recipe)
+	return recipe, nil
+}
+
+// Free regions mkpart positions can refer to, see partitionPositions
+const (
+	// freedPosition is the region freed by the last shrink-for-install on a
+	// disk
+	freedPosition = "freed"
+	// largestFreePosition is the largest free region of a disk
+	largestFreePosition = "free:largest"
+	// freeRegionPrefix is followed by the number of a free region, counting
+	// from 1 in disk order
+	freeRegionPrefix = "free:"
+)
+
+// isRegionPosition reports whether value names a free region rather than
+// a size.
+func isRegionPosition(value any) bool {
+	name, ok := value.(string)
+	if !ok {
+		return false
+	}
+	if name == freedPosition || name == largestFreePosition {
+		return true
+	}
+	number, found := strings.CutPrefix(name, freeRegionPrefix)
+	n, err := strconv.Atoi(number)
+	return found && err == nil && n >= 1
+}
+
+// regionPosition returns the free region of target named by value, see
+// isRegionPosition.
+func regionPosition(target *disk.Disk, value any) (disk.FreeRegion, error) {
+	name := value.(string)
+	switch name {
+	case freedPosition:
+		freed, ok := disk.FreedRegion(target.Path)
+		if !ok {
+			return disk.FreeRegion{}, fmt.Errorf("no region was freed on %s", target.Path)
+		}
+		return target.FreeRegionWithin(freed)
+	case largestFreePosition:
+		return target.LargestFreeRegion()
+	}
+
+	n, _ := strconv.Atoi(strings.TrimPrefix(name, freeRegionPrefix))
+	regions, err := target.FreeRegions()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read recipe: %s", err)
+		return disk.FreeRegion{}, err
+	}
+	if n > len(regions) {
+		return disk.FreeRegion{}, fmt.Errorf("%s has %d free region(s), cannot use free region %d", target.Path, len(regions), n)
 	}
 
-	return &recipe, nil
+	return regions[n-1], nil
+}
+
+// partitionPositions reads the start and end positions of a new partition
+// on target. Either can name a free region, meaning its start or its end.
+// When the start names a region, an end given as a size is relative to that
+// region: absolute sizes are the length of the partition, percentages refer
+// to the size of the region, and sizes counted from the end and rest are
+// counted from its end.
+func partitionPositions(target *disk.Disk, startValue, endValue any) (start, end util.Size, err error) {
+	if !isRegionPosition(startValue) {
+		start, err = util.ParseSize(startValue)
+		if err != nil {
+			return start, end, err
+		}
+		if !isRegionPosition(endValue) {
+			end, err = util.ParseSize(endValue)
+			return start, end, err
+		}
+
+		region, err := regionPosition(target, endValue)
+		return start, region.End, err
+	}
+
+	region, err := regionPosition(target, startValue)
+	if err != nil {
+		return start, end, err
+	}
+	if isRegionPosition(endValue) {
+		endRegion, err := regionPosition(target, endValue)
+		return region.Start, endRegion.End, err
+	}
+
+	size, err := util.ParseSize(endValue)
+	if err != nil {
+		return start, end, err
+	}
+	length, err := size.Resolve(region.Size().Bytes)
+	if err != nil {
+		return start, end, fmt.Errorf("end position does not fit in free region %s: %s", region, err)
+	}
+
+	return region.Start, util.Size{Bytes: region.Start.Bytes + length}, nil
+}
+
+// layoutPolicy returns the layout policy given to an auto-layout step, or
+// the default one.
+func layoutPolicy(args []interface{}) (disk.LayoutPolicy, error) {
+	if len(args) < 3 {
+		return disk.DefaultLayoutPolicy(), nil
+	}
+
+	content, err := json.Marshal(args[2])
+	if err != nil {
+		return disk.LayoutPolicy{}, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+
+	var policy disk.LayoutPolicy
+	err = decoder.Decode(&policy)
+	if err != nil {
+		return disk.LayoutPolicy{}, fmt.Errorf("invalid layout policy: %s", err)
+	}
+
+	return policy, nil
 }
 
 func operationError(operation string, err any, args ...any) error {
@@ -79,7 +278,7 @@ func operationError(operation string, err any, args ...any) error {
 	case string:
 		return fmt.Errorf(prefix+e, args...)
 	case error:
-		return fmt.Errorf(prefix + e.Error())
+		return fmt.Errorf("%s%s", prefix, e)
 	default:
 		return fmt.Errorf(prefix+"%v", e)
 	}
@@ -99,15 +298,22 @@ func jsonFieldToInt(value any) (int, error) {
 	}
 }
 
-func runSetupOperation(diskLabel, operation string, args []interface{}) error {
-	target, err := disk.LocateDisk(diskLabel)
+// runSetupOperation runs operation on the disk referenced by diskLabel. For
+// operations which can be given an id (see SetupStep.ID), the path of the
+// device they create is returned.
+func runSetupOperation(diskLabel, operation string, args []interface{}) (string, error) {
+	diskPath, err := disk.ResolveDevice(diskLabel)
 	if err != nil {
-		return err
+		return "", err
+	}
+	target, err := disk.LocateDisk(diskPath)
+	if err != nil {
+		return "", err
 	}
 
 	err = target.WaitUntilAvailable()
 	if err != nil {
-		fmt.Println("disk not found:", err)
+		util.Logf("disk not found: %s", err)
 		// try to continue anyway
 	}
 
@@ -118,13 +324,56 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 	 * Create a new partition table on the disk.
 	 *
 	 * **Accepts**:
-	 * - *LabelType* (`string`): The partitioning scheme. Either `mbr` or `gpt`.
+	 * - *LabelType* (`string`): The partitioning scheme. Either `msdos` or `gpt`.
 	 */
 	case "label":
 		label := disk.DiskLabel(args[0].(string))
 		err = target.LabelDisk(label)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
+		}
+	/* !! ### auto-layout
+	 *
+	 * Erase the disk and create the partitions of a layout policy on it, sized to fit the disk.
+	 * Every partition gets its minimum size, and the remaining space is split between partitions
+	 * by weight, up to their maximum size. Partitions are aligned to 1MiB and numbered in the
+	 * order of the policy.
+	 *
+	 * The mountpoints of the partitions are added to the recipe's `mountpoints`, so they must
+	 * not be listed there.
+	 *
+	 * The default policy creates the standard Vanilla OS layout on a GPT disk:
+	 *
+	 * | Name | Filesystem | Mountpoint | Size | Notes |
+	 * | ---- | ---------- | ---------- | ---- | ----- |
+	 * | `boot` | ext4 | `/boot` | 1GiB | |
+	 * | `efi` | fat32 | `/boot/efi` | 512MiB | `efi` only, `esp` flag |
+	 * | `bios` | none | | 1MiB | `bios` only, `bios_grub` flag |
+	 * | `a` | btrfs | `/` | 12GiB to 32GiB, weight 1 | encrypted |
+	 * | `b` | btrfs | `/` | 12GiB to 32GiB, weight 1 | encrypted |
+	 * | `home` | btrfs | `/home` | 8GiB or more, weight 4 | encrypted |
+	 *
+	 * **Accepts**:
+	 * - *Firmware* (`string`): The firmware the system boots with, either `efi` or `bios`.
+	 * - *LUKSPassword* (optional `string`): If not empty, the partitions of the policy meant to be
+	 * encrypted are encrypted with LUKS2 using this password.
+	 * - *Policy* (optional `object`): The layout policy, with a `partitions` list. Each partition
+	 * has a `name`, and optionally a `filesystem`, a `mountpoint`, a `min` and `max` (absolute
+	 * [sizes](#sizes), no `max` meaning no limit), a `weight`, whether to `encrypt` it, a list
+	 * of `flags` and the only `firmware` it is created for. Defaults to the policy above.
+	 */
+	case "auto-layout":
+		policy, err := layoutPolicy(args)
+		if err != nil {
+			return "", operationError(operation, err)
+		}
+		luksPassword := ""
+		if len(args) > 1 {
+			luksPassword = args[1].(string)
+		}
+		_, err = target.AutoLayout(disk.Firmware(args[0].(string)), luksPassword, policy)
+		if err != nil {
+			return "", operationError(operation, err)
 		}
 	/* !! ### mkpart
 	 *
@@ -135,9 +384,12 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 	 * - *FsType* (`string`): The filesystem for the partition. Can be either `none`, `btrfs`,
 	 * `ext[2,3,4]`, `linux-swap`, `ntfs`\*, `reiserfs`\*, `udf`\*, or `xfs`\*. If FsType
 	 * is prefixed with `luks-` (e.g. `luks-btrfs`), the partition will be encrypted using LUKS2.
-	 * - *Start* (`int`): The start position on disk for the new partition (in MiB).
-	 * - *End* (`int`): The end position on disk for the new partition (in MiB), or -1 for
-	 * using all the remaining space.
+	 * - *Start* (`size`): The start position on disk for the new partition, or the start of a
+	 * free region. See [Sizes](#sizes) and [Free regions](#free-regions).
+	 * - *End* (`size`): The end position on disk for the new partition, `rest` (also `-1`) for
+	 * using all the remaining space, or the end of a free region. If *Start* is a free region,
+	 * the end is relative to it: absolute sizes are the size of the partition, percentages refer
+	 * to the size of the region, and `rest` or negative sizes are counted from its end.
 	 * - *LUKSPassword* (optional `string`): The password used to encrypt the partition. Only
 	 * relevant if `FsType` is prefixed with `luks-`.
 	 *
@@ -146,47 +398,25 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 	case "mkpart":
 		name := args[0].(string)
 		fsType := disk.PartitionFs(args[1].(string))
-		start := int(args[2].(float64))
-		end := int(args[3].(float64))
+		start, end, err := partitionPositions(target, args[2], args[3])
+		if err != nil {
+			return "", operationError(operation, err)
+		}
+		var part *disk.Partition
 		if len(args) > 4 && strings.HasPrefix(string(fsType), "luks-") { // Encrypted partition
 			luksPassword := args[4].(string)
-			part, err := target.NewPartition(name, "", start, end)
-			if err != nil {
-				return operationError(operation, err)
-			}
-			err = luks.LuksFormat(part, luksPassword)
-			if err != nil {
-				return operationError(operation, err)
-			}
-			// lsblk seems to take a few milliseconds to update the partition's
-			// UUID, so we loop until it gives us one
-			part.WaitUntilAvailable()
-			uuid, err := part.GetUUID()
-			if err != nil {
-				return operationError(operation, err)
-			}
-			err = luks.LuksOpen(part, fmt.Sprintf("luks-%s", uuid), luksPassword)
-			if err != nil {
-				return operationError(operation, err)
-			}
-			part.Filesystem = disk.PartitionFs(strings.TrimPrefix(string(fsType), "luks-"))
-			err = disk.LUKSMakeFs(*part)
-			if err != nil {
-				return operationError(operation, err)
-			}
-			err = disk.LUKSSetLabel(part, name)
-			if err != nil {
-				return operationError(operation, err)
-			}
+			innerFs := disk.PartitionFs(strings.TrimPrefix(string(fsType), "luks-"))
+			part, err = target.NewEncryptedPartition(name, innerFs, start, end, luksPassword)
 		} else { // Unencrypted partition
 			if fsType == "none" {
 				fsType = ""
 			}
-			_, err := target.NewPartition(name, fsType, start, end)
-			if err != nil {
-				return operationError(operation, err)
-			}
+			part, err = target.NewPartition(name, fsType, start, end)
 		}
+		if err != nil {
+			return "", operationError(operation, err)
+		}
+		return part.Path, nil
 	/* !! ### rm
 	 *
 	 * Delete a partition from the disk.
@@ -197,11 +427,11 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 	case "rm":
 		partNum, err := jsonFieldToInt(args[0])
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 		err = target.GetPartition(partNum).RemovePartition()
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 	/* !! ### resizepart
 	 *
@@ -209,20 +439,55 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 	 *
 	 * **Accepts**:
 	 * - *PartNum* (`int`): The partition number on disk (e.g. `/dev/sda3` is partition 3).
-	 * - *PartNewSize* (`int`): The new size in MiB for the partition.
+	 * - *PartNewSize* (`size`): The new end position on disk for the partition, or `rest` for
+	 * growing it into all the space after it. See [Sizes](#sizes).
 	 */
 	case "resizepart":
 		partNum, err := jsonFieldToInt(args[0])
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
-		partNewSize, err := jsonFieldToInt(args[1])
+		partNewSize, err := util.ParseSize(args[1])
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 		err = target.GetPartition(partNum).ResizePartition(partNewSize)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
+		}
+	/* !! ### shrink-for-install
+	 *
+	 * Make room for the installation after an existing partition (e.g. to install alongside
+	 * Windows or another Linux system) by shrinking its filesystem, then the partition. The
+	 * partition must not be mounted, and contain an NTFS, ext2/3/4 or btrfs filesystem. The
+	 * filesystem is checked before being shrunk, and the operation fails without changing
+	 * anything if its data does not fit in the new size.
+	 *
+	 * The freed region is reported, and later `mkpart` steps on the same disk can refer to it
+	 * as `freed` (see [Free regions](#free-regions)).
+	 *
+	 * **Accepts**:
+	 * - *PartNum* (`int`): The partition number on disk (e.g. `/dev/sda3` is partition 3).
+	 * - *NewSize* (`size`): The new size of the partition. Sizes counted from the end (e.g.
+	 * `-50GiB`) are the amount of space to free, and percentages refer to the current size
+	 * of the partition. See [Sizes](#sizes).
+	 */
+	case "shrink-for-install":
+		partNum, err := jsonFieldToInt(args[0])
+		if err != nil {
+			return "", operationError(operation, err)
+		}
+		newSize, err := util.ParseSize(args[1])
+		if err != nil {
+			return "", operationError(operation, err)
+		}
+		part := target.GetPartition(partNum)
+		if part == nil {
+			return "", operationError(operation, "partition %d does not exist on %s", partNum, target.Path)
+		}
+		_, err = part.Shrink(newSize)
+		if err != nil {
+			return "", operationError(operation, err)
 		}
 	/* !! ### namepart
 	 *
@@ -235,36 +500,36 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 	case "namepart":
 		partNum, err := jsonFieldToInt(args[0])
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 		partNewName, ok := args[1].(string)
 		if !ok {
-			return operationError(operation, "%v is not a string", partNewName)
+			return "", operationError(operation, "%v is not a string", partNewName)
 		}
 		err = target.GetPartition(partNum).NamePartition(partNewName)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 	/* !! ### setlabel
 	 *
 	 * Set the filesystem label of the specified partition.
 	 *
 	 * **Accepts**:
-	 * - *PartNum* ('int'): The partition number on disk (e.g. '/dev/sda3' is partition 3).
-	 * - *Label* ('string'): The filesystem label
+	 * - *PartNum* (`int`): The partition number on disk (e.g. `/dev/sda3` is partition 3).
+	 * - *Label* (`string`): The filesystem label.
 	 */
 	case "setlabel":
 		partNum, err := jsonFieldToInt(args[0])
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 		partNewName, ok := args[1].(string)
 		if !ok {
-			return operationError(operation, "%v is not a string", partNewName)
+			return "", operationError(operation, "%v is not a string", partNewName)
 		}
 		err = target.GetPartition(partNum).SetLabel(partNewName)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 	/* !! ### setflag
 	 *
@@ -279,11 +544,11 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 	case "setflag":
 		partNum, err := jsonFieldToInt(args[0])
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 		err = target.GetPartition(partNum).SetPartitionFlag(args[1].(string), args[2].(bool))
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 	/* !! ### format
 	 *
@@ -297,20 +562,20 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 	case "format":
 		partNum, err := jsonFieldToInt(args[0])
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 		filesystem := args[1].(string)
 		part := target.GetPartition(partNum)
 		part.Filesystem = disk.PartitionFs(filesystem)
 		err = disk.MakeFs(part)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 		if len(args) == 3 {
 			label := args[2].(string)
 			err := part.SetLabel(label)
 			if err != nil {
-				return operationError(operation, err)
+				return "", operationError(operation, err)
 			}
 		}
 	/* !! ### luks-format
@@ -326,7 +591,7 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 	case "luks-format":
 		partNum, err := jsonFieldToInt(args[0])
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 		filesystem := args[1].(string)
 		password := args[2].(string)
@@ -334,30 +599,31 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 		part.Filesystem = disk.PartitionFs(filesystem)
 		err = luks.LuksFormat(part, password)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 		// lsblk seems to take a few milliseconds to update the partition's
 		// UUID, so we loop until it gives us one
 		part.WaitUntilAvailable()
 		uuid, err := part.GetUUID()
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 		err = luks.LuksOpen(part, fmt.Sprintf("luks-%s", uuid), password)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 		err = disk.LUKSMakeFs(*part)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 		if len(args) == 4 {
 			label := args[3].(string)
 			err := disk.LUKSSetLabel(part, label)
 			if err != nil {
-				return operationError(operation, err)
+				return "", operationError(operation, err)
 			}
 		}
+		return part.Path, nil
 	/* !! ### pvcreate
 	 *
 	 * Creates a new LVM physical volume from a partition.
@@ -371,7 +637,7 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 		dummyPart.WaitUntilAvailable()
 		err := lvm.Pvcreate(part)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 	/* !! ### pvresize
 	 *
@@ -379,19 +645,21 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 	 *
 	 * **Accepts**:
 	 * - *PV* (`string`): The physical volume path.
-	 * - *Size* (optional `float`): The PV's desired size in MiB. If not provided, the PV will expand to the size of the underlying partition.
+	 * - *Size* (optional `size`): The PV's desired size, where percentages and sizes counted from the end refer to the underlying partition. If not provided, the PV will expand to the size of the underlying partition. See [Sizes](#sizes).
 	 */
 	case "pvresize":
 		part := args[0].(string)
-		var err error
+		sizes := []util.Size{}
 		if len(args) > 1 {
-			size := args[1].(float64)
-			err = lvm.Pvresize(part, size)
-		} else {
-			err = lvm.Pvresize(part)
+			size, err := util.ParseSize(args[1])
+			if err != nil {
+				return "", operationError(operation, err)
+			}
+			sizes = append(sizes, size)
 		}
+		err := lvm.Pvresize(part, sizes...)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 	/* !! ### pvremove
 	 *
@@ -404,7 +672,7 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 		part := args[0].(string)
 		err := lvm.Pvremove(part)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 	/* !! ### vgcreate
 	 *
@@ -430,7 +698,7 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 		}
 		err := lvm.Vgcreate(name, pvList...)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 	/* !! ### vgrename
 	 *
@@ -445,7 +713,7 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 		newName := args[1].(string)
 		_, err := lvm.Vgrename(oldName, newName)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 	/* !! ### vgextend
 	 *
@@ -467,7 +735,7 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 		}
 		err := lvm.Vgextend(name, pvList...)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 	/* !! ### vgreduce
 	 *
@@ -489,7 +757,7 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 		}
 		err := lvm.Vgreduce(name, pvList...)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 	/* !! ### vgremove
 	 *
@@ -502,7 +770,7 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 		name := args[0].(string)
 		err := lvm.Vgremove(name)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 	/* !! ### lvcreate
 	 *
@@ -512,17 +780,23 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 	 * - *Name* (`string`): Logical volume name.
 	 * - *VG* (`string`): Volume group name.
 	 * - *Type* (`string`): Logical volume type. See lvcreate(8) for available types. If unsure, use `linear`.
-	 * - *Size* (`float` or `string`): Logical volume size in MiB or a string containing a relative size (e.g. "100%FREE").
+	 * - *Size* (`size`): Logical volume size. Percentages refer to the whole VG unless followed by
+	 * what they refer to, as in `100%FREE`, `rest` uses all the free space in the VG and sizes
+	 * counted from the end (e.g. `-2GiB`) leave that much free space. See [Sizes](#sizes).
 	 */
 	case "lvcreate":
 		name := args[0].(string)
 		vg := args[1].(string)
 		lvType := args[2].(string)
-		vgSize := args[3]
-		err := lvm.Lvcreate(name, vg, lvm.LVType(lvType), vgSize)
+		vgSize, err := util.ParseSize(args[3])
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
+		err = lvm.Lvcreate(name, vg, lvm.LVType(lvType), vgSize)
+		if err != nil {
+			return "", operationError(operation, err)
+		}
+		return fmt.Sprintf("/dev/%s/%s", vg, name), nil
 	/* !! ### lvrename
 	 *
 	 * Renames an LVM logical volume.
@@ -538,7 +812,7 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 		vg := args[2].(string)
 		_, err := lvm.Lvrename(oldName, newName, vg)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 	/* !! ### lvremove
 	 *
@@ -551,7 +825,7 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 		name := args[0].(string)
 		err := lvm.Lvremove(name)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 	/* !! ### make-thin-pool
 	 *
@@ -566,7 +840,7 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 		thinMetaLV := args[1].(string)
 		err := lvm.MakeThinPool(thinMetaLV, thinDataLV)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 	/* !! ### lvcreate-thin
 	 *
@@ -575,17 +849,20 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 	 * **Accepts**:
 	 * - *Name* (`string`): Thin logical volume name.
 	 * - *VG* (`string`): Volume group name.
-	 * - *Size* (`float`): Volume group size in MiB.
+	 * - *Size* (`size`): Virtual size of the thin LV, which must be absolute. See [Sizes](#sizes).
 	 * - *Thinpool* (`string`): Name of the thin pool to create the LV from.
 	 */
 	case "lvcreate-thin":
 		name := args[0].(string)
 		vg := args[1].(string)
-		vgSize := args[2].(float64)
+		vgSize, err := util.ParseSize(args[2])
+		if err != nil {
+			return "", operationError(operation, err)
+		}
 		thinPool := args[3].(string)
-		err := lvm.LvThinCreate(name, vg, thinPool, vgSize)
+		err = lvm.LvThinCreate(name, vg, thinPool, vgSize)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 	/* !! ### lvm-format
 	 *
@@ -601,7 +878,7 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 		filesystem := args[1].(string)
 		lv, err := lvm.FindLv(name)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 		dummyPart := disk.Partition{
 			Path:       "/dev/" + lv.VgName + "/" + lv.Name,
@@ -609,13 +886,13 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 		}
 		err = disk.MakeFs(&dummyPart)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 		if len(args) == 3 {
 			label := args[2].(string)
 			err := dummyPart.SetLabel(label)
 			if err != nil {
-				return operationError(operation, err)
+				return "", operationError(operation, err)
 			}
 		}
 	/* !! ### lvm-luks-format
@@ -634,7 +911,7 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 		password := args[2].(string)
 		lv, err := lvm.FindLv(name)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 		dummyPart := disk.Partition{
 			Path:       "/dev/" + lv.VgName + "/" + lv.Name,
@@ -642,50 +919,123 @@ func runSetupOperation(diskLabel, operation string, args []interface{}) error {
 		}
 		err = luks.LuksFormat(&dummyPart, password)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 		// lsblk seems to take a few milliseconds to update the partition's
 		// UUID, so we loop until it gives us one
 		dummyPart.WaitUntilAvailable()
 		uuid, err := dummyPart.GetUUID()
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 		err = luks.LuksOpen(&dummyPart, fmt.Sprintf("luks-%s", uuid), password)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 		err = disk.LUKSMakeFs(dummyPart)
 		if err != nil {
-			return operationError(operation, err)
+			return "", operationError(operation, err)
 		}
 		if len(args) == 4 {
 			label := args[3].(string)
 			err := disk.LUKSSetLabel(&dummyPart, label)
 			if err != nil {
-				return operationError(operation, err)
+				return "", operationError(operation, err)
 			}
 		}
 	/* !! --- */
 	default:
-		return fmt.Errorf("unrecognized operation %s", operation)
+		return "", fmt.Errorf("unrecognized operation %s", operation)
 	}
 
-	return nil
+	return "", nil
 }
 
 func (recipe *Recipe) RunSetup() error {
-	for i, step := range recipe.Setup {
-		fmt.Printf("Setup [%d/%d]: %s\n", i+1, len(recipe.Setup), step.Operation)
-		err := runSetupOperation(step.Disk, step.Operation, step.Params)
+	defer recipe.use()()
+
+	return recipe.runSetup(0)
+}
+
+// runSetup runs the setup steps starting at index from.
+func (recipe *Recipe) runSetup(from int) error {
+	for i := from; i < len(recipe.Setup); i++ {
+		step := recipe.Setup[i]
+		recipe.emit(recipe.stepEvent(EventStepStarted, StageSetup, i, step.Operation, nil))
+		util.Logf("Setup [%d/%d]: %s", i+1, len(recipe.Setup), step.Operation)
+		skip, err := recipe.unmetCondition(step.When, step.Disk)
+		if err == nil && skip != "" {
+			util.Logf("Skipping setup step %d (%s): %s", i, step.Operation, skip)
+		} else if err == nil {
+			err = recipe.runSetupStep(step)
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to run setup operation %s: %s", step.Operation, err)
+		} else {
+			err = recipe.stepDone(StageSetup, i)
+		}
 		if err != nil {
-			return fmt.Errorf("failed to run setup operation %s: %s", step.Operation, err)
+			recipe.emit(recipe.stepEvent(EventStepFailed, StageSetup, i, step.Operation, err))
+			return &StageError{Stage: StageSetup, Step: i, Err: err}
 		}
+		recipe.emit(recipe.stepEvent(EventStepFinished, StageSetup, i, step.Operation, nil))
+	}
+
+	return nil
+}
+
+// runSetupStep runs a setup step after resolving the references in its
+// parameters, and records the device it created if it has an id.
+func (recipe *Recipe) runSetupStep(step SetupStep) error {
+	params, err := expandParams(step.Params, recipe.resolveRef)
+	if err != nil {
+		return err
+	}
+
+	device, err := runSetupOperation(step.Disk, step.Operation, params)
+	if err != nil {
+		return err
+	}
+	if step.ID != "" {
+		recipe.setDevice(step.ID, device)
+	}
+	if step.Operation == "shrink-for-install" {
+		return recipe.saveFreedRegion(step.Disk)
 	}
 
 	return nil
 }
 
+// runPostInstallStep runs a post-installation step after resolving the
+// references in its parameters.
+func (recipe *Recipe) runPostInstallStep(step PostStep) error {
+	params, err := expandParams(step.Params, recipe.resolveRef)
+	if err != nil {
+		return err
+	}
+	switch step.Operation {
+	case "grub-install":
+		// The auto target is the firmware steps' conditions are tested
+		// against
+		if params[2] == system.FirmwareAuto {
+			params[2] = string(recipe.firmware())
+		}
+	case "sdboot-entry", "uki-install":
+		// The root options come from the mountpoints, and precede the
+		// recipe's
+		cmdline, err := recipe.kernelCmdline()
+		if err != nil {
+			return err
+		}
+		if len(params) > 3 && params[3].(string) != "" {
+			cmdline += " " + params[3].(string)
+		}
+		params = slices.Concat(params[:3:3], []interface{}{cmdline}, params[min(len(params), 4):])
+	}
+
+	return runPostInstallOperation(step.Chroot, step.Operation, params)
+}
+
 func runPostInstallOperation(chroot bool, operation string, args []interface{}) error {
 	targetRoot := ""
 	if chroot {
@@ -754,12 +1104,7 @@ func runPostInstallOperation(chroot bool, operation string, args []interface{})
 	case "shell":
 		for _, arg := range args {
 			command := arg.(string)
-			var err error
-			if chroot {
-				err = util.RunInChroot(targetRoot, command)
-			} else {
-				err = util.RunCommand(command)
-			}
+			err := util.RunShell(targetRoot, command)
 			if err != nil {
 				return operationError(operation, err)
 			}
@@ -841,11 +1186,11 @@ func runPostInstallOperation(chroot bool, operation string, args []interface{})
 	 *
 	 * **Accepts**:
 	 * - *BootDirectory* (`string`): The path for the boot dir (usually `/boot`).
-	 * - *InstallDevice* (`string`): The disk where the boot partition is located.
-	 * - *Target* (`string`): The target firmware. Either `bios` for legacy systems or `efi` for UEFI systems.
+	 * - *InstallDevice* (`string`): The disk where the boot partition is located. Can be a [device reference](#device-references).
+	 * - *Target* (`string`): The target firmware. Either `bios` for legacy systems, `efi` for UEFI systems, or `auto` for the firmware the installer booted with (see `firmware` in [Conditions](#conditions)). The GRUB target is chosen for the architecture: `x86_64-efi`, `i386-efi` (64-bit machines with a 32-bit UEFI), `arm64-efi`, `riscv64-efi`, `loongarch64-efi` or `i386-pc`. With `bios`, GPT disks need a partition with the `bios_grub` flag.
 	 * - *EntryName* (`string`): Name of the boot entry.
 	 * - *Removable* (`bool`): Only relevant for EFI installations. If the drive is a removable (e.g. USB stick).
-	 * - *EFIDevice* (optional `string`): Only required for EFI installations. The partition where the EFI is located.
+	 * - *EFIDevice* (optional `string`): Only required for EFI installations. The partition where the EFI is located. Can be a [device reference](#device-references).
 	 */
 	case "grub-install":
 		bootDirectory := args[0].(string)
@@ -857,7 +1202,15 @@ func runPostInstallOperation(chroot bool, operation string, args []interface{})
 		if len(args) > 5 {
 			efiDevice = args[5].(string)
 		}
-		err := system.RunGrubInstall(targetRoot, bootDirectory, installDevice, target, entryName, removable, efiDevice)
+		installDevice, err := resolveOptionalDevice(installDevice)
+		if err != nil {
+			return operationError(operation, err)
+		}
+		efiDevice, err = resolveOptionalDevice(efiDevice)
+		if err != nil {
+			return operationError(operation, err)
+		}
+		err = system.RunGrubInstall(targetRoot, bootDirectory, installDevice, target, entryName, removable, efiDevice)
 		if err != nil {
 			return operationError(operation, err)
 		}
@@ -924,6 +1277,90 @@ func runPostInstallOperation(chroot bool, operation string, args []interface{})
 		if err != nil {
 			return operationError(operation, err)
 		}
+	/* !! ### sdboot-install
+	 *
+	 * Install systemd-boot with `bootctl install`, as an alternative to GRUB on UEFI systems. This writes `loader/loader.conf` in the EFI partition and creates a boot entry for systemd-boot in the firmware.
+	 *
+	 * **Accepts**:
+	 * - *ESPPath* (`string`): Where the EFI partition is mounted in the installed system (usually `/boot/efi`).
+	 * - *EFIDevice* (`string`): The partition where the EFI is located. Can be a [device reference](#device-references).
+	 * - *EntryName* (`string`): Name of the boot entry.
+	 * - *Timeout* (optional `int`): Seconds the boot menu is shown for. Defaults to 3.
+	 */
+	case "sdboot-install":
+		espPath := args[0].(string)
+		efiDevice, err := resolveOptionalDevice(args[1].(string))
+		if err != nil {
+			return operationError(operation, err)
+		}
+		entryName := args[2].(string)
+		timeout := 3
+		if len(args) > 3 {
+			timeout, err = jsonFieldToInt(args[3])
+			if err != nil {
+				return operationError(operation, err)
+			}
+		}
+		err = system.RunBootctlInstall(targetRoot, espPath, efiDevice, entryName, timeout)
+		if err != nil {
+			return operationError(operation, err)
+		}
+	/* !! ### sdboot-entry
+	 *
+	 * Write a [Boot Loader Specification](https://uapi-group.org/specifications/specs/boot_loader_specification/) entry for each kernel in `/boot`, copying the kernel and its initramfs to the EFI partition. Must run after `sdboot-install`.
+	 *
+	 * The kernel command line mounts the partition mounted on `/` (`root=UUID=...`), unlocking it first if it is encrypted (`rd.luks.name=...`).
+	 *
+	 * **Accepts**:
+	 * - *ESPPath* (`string`): Where the EFI partition is mounted in the installed system (usually `/boot/efi`).
+	 * - *EntryName* (`string`): Name of the entries, which are written to `loader/entries/<EntryName>-<version>.conf`.
+	 * - *Title* (`string`): Title of the entries in the boot menu.
+	 * - *Options* (optional `string`): Additional kernel command line options (e.g. `quiet splash`).
+	 */
+	case "sdboot-entry":
+		espPath := args[0].(string)
+		entryName := args[1].(string)
+		title := args[2].(string)
+		cmdline := ""
+		if len(args) > 3 {
+			cmdline = args[3].(string)
+		}
+		err := system.WriteBootEntries(targetRoot, espPath, entryName, title, cmdline)
+		if err != nil {
+			return operationError(operation, err)
+		}
+	/* !! ### uki-install
+	 *
+	 * Build a Unified Kernel Image, bundling the kernel with its initramfs and command line, for each kernel in `/boot` with `ukify`. The images are placed in `EFI/Linux` in the EFI partition, where systemd-boot also finds them, and each gets a boot entry in the firmware named `<EntryName> (<version>)`.
+	 *
+	 * The kernel command line is the same as with `sdboot-entry`.
+	 *
+	 * **Accepts**:
+	 * - *ESPPath* (`string`): Where the EFI partition is mounted in the installed system (usually `/boot/efi`).
+	 * - *EFIDevice* (`string`): The partition where the EFI is located. Can be a [device reference](#device-references).
+	 * - *EntryName* (`string`): Name of the images, which are written to `EFI/Linux/<EntryName>-<version>.efi`, and of the boot entries.
+	 * - *Options* (optional `string`): Additional kernel command line options (e.g. `quiet splash`).
+	 * - *SigningKey* (optional `string`): Path to a private key on the host to sign the images with for Secure Boot, using `sbsign`. The key is never copied to the installed system.
+	 * - *SigningCert* (optional `string`): Path to the certificate matching *SigningKey*. Required if *SigningKey* is given.
+	 */
+	case "uki-install":
+		espPath := args[0].(string)
+		efiDevice, err := resolveOptionalDevice(args[1].(string))
+		if err != nil {
+			return operationError(operation, err)
+		}
+		entryName := args[2].(string)
+		cmdline, keyPath, certPath := "", "", ""
+		if len(args) > 3 {
+			cmdline = args[3].(string)
+		}
+		if len(args) > 5 {
+			keyPath, certPath = args[4].(string), args[5].(string)
+		}
+		err = system.BuildUKIs(targetRoot, espPath, efiDevice, entryName, cmdline, keyPath, certPath)
+		if err != nil {
+			return operationError(operation, err)
+		}
 	default:
 		return fmt.Errorf("unrecognized operation %s", operation)
 	}
@@ -931,20 +1368,256 @@ func runPostInstallOperation(chroot bool, operation string, args []interface{})
 	return nil
 }
 
+/* !! ## Sizes
+ *
+ * Parameters of type `size` accept any of:
+ * - A number, or a string without unit, in MiB (e.g. `512`). `-1` means the rest of the space.
+ * - A string with a binary (`KiB`, `MiB`, `GiB`, `TiB`, `PiB`) or decimal (`KB`, `MB`, `GB`,
+ * `TB`, `PB`) unit, or `B` for bytes (e.g. `"512MiB"`, `"20GiB"` or `"1TB"`).
+ * - A negative size, counted back from the end (e.g. `"-2GiB"` leaves 2 GiB after it).
+ * - A percentage of the whole disk, partition or volume group (e.g. `"50%"`). LVM sizes
+ * may also name what they refer to, as in lvcreate(8) (e.g. `"100%FREE"`).
+ * - `"rest"`, meaning all the remaining space.
+ */
+
+/* !! ## Free regions
+ *
+ * The start and end positions of `mkpart` can name an unallocated area of the disk instead of
+ * a size:
+ * - `"free:largest"`: the largest free region.
+ * - `"free:N"`: the Nth free region, counting from 1 in disk order.
+ * - `"freed"`: the space still free in the region freed by the last `shrink-for-install` on the disk.
+ *
+ * Free regions are computed when the step runs, so they account for the partitions created by
+ * previous steps. They are aligned to 1MiB and exclude the partition table, including the backup
+ * GPT header at the end of GPT disks.
+ */
+
+/* !! ## Device references
+ *
+ * Kernel names like `/dev/sda` depend on the order disks are detected in. Wherever a recipe
+ * takes a disk or partition (the `disk` of setup steps, the `partition` of mountpoints and the
+ * devices of `grub-install`), it can instead use:
+ * - A udev link, e.g. `/dev/disk/by-id/nvme-Samsung_SSD_980_1TB_S64ANS0R123456` or
+ *   `/dev/disk/by-partuuid/...`. The partitions of a disk referenced this way are the same
+ *   link followed by `-partN`.
+ * - `UUID=`, `LABEL=`, `PARTUUID=` or `PARTLABEL=` followed by a value, as in fstab. Partitions
+ *   created by `mkpart` can be referenced by `PARTLABEL=` and their name.
+ * - `SERIAL=` followed by the serial number of a disk, as shown by `list-disks`.
+ *
+ * References are resolved when the step or mount that uses them runs, so they may refer to
+ * partitions created during setup, and fail if they match no device or more than one.
+ * `auto-layout` adds the mountpoints of its partitions by number, so it requires a path.
+ */
+
+/* !! ## Step references
+ *
+ * `mkpart`, `lvcreate` and `luks-format` steps can be given an `id`, which names the device they
+ * create (the partition, the LV, or the formatted partition):
+ *
+ * ```json
+ * {"disk": "/dev/sda", "id": "root_a", "operation": "mkpart", "params": ["a", "btrfs", "1GiB", "32GiB"]}
+ * ```
+ *
+ * Parameters of later setup steps, post-installation steps and the `partition` of mountpoints can
+ * then reference it as `${part.root_a}` anywhere in a string, or as `{"ref": "root_a"}` in place
+ * of a whole parameter. References are replaced when the step runs, with:
+ * - `${part.ID}` (`{"ref": "ID"}`): the path of the device, e.g. `/dev/sda3`.
+ * - `${part.ID.uuid}` (`{"ref": "ID", "field": "uuid"}`): the UUID of its filesystem or LUKS container.
+ * - `${part.ID.mapper}` (`{"ref": "ID", "field": "mapper"}`): the path of its opened LUKS mapping.
+ *
+ * Setup steps can only reference steps before them. When the step with the id did not run in the
+ * same run (e.g. with `--stages`), its device is found from its parameters: partitions created
+ * by `mkpart` by their name, which must then be unique.
+ */
+
+/* !! ## Variables
+ *
+ * Recipes can declare variables in a top-level `variables` object, and reference them as
+ * `${name}` in the disks and parameters of setup and post-installation steps, in mountpoints and
+ * in the installation options:
+ *
+ * ```json
+ * "variables": {
+ *     "disk": {"description": "Target disk"},
+ *     "fs": {"default": "btrfs"},
+ *     "luks_password": {"type": "secret"}
+ * }
+ * ```
+ *
+ * Each variable accepts:
+ * - `type`: `string` (the default) or `secret`. The values of secret variables, such as LUKS
+ *   passwords, are replaced by `********` in logs, plans, progress events and error messages.
+ * - `description`: shown when asking for the value.
+ * - `default`: the value used when none is given.
+ *
+ * Values are looked up in order from `--var NAME=VALUE`, `--var-file NAME=PATH` (the file's
+ * trailing newline is ignored), the `ALBIUS_VAR_NAME` environment variable, the default and,
+ * with `--prompt`, the terminal. A recipe with a variable given no value is rejected. Names
+ * are made of letters, digits and `_`; references to names which are not declared, such as
+ * `${HOME}` in a shell command, are left as they are.
+ */
+
+/* !! ## Includes
+ *
+ * A recipe can include recipe fragments, so that e.g. editions share the steps of a base recipe.
+ * Fragments are recipes which may leave out any section, and may include fragments themselves.
+ * Paths are relative to the recipe including them, and each file can be JSON, YAML or TOML:
+ *
+ * ```json
+ * {
+ *     "include": ["../base.yaml", "common/post.toml"],
+ *     "override": ["mountpoints"],
+ *     "mountpoints": [{"partition": "/dev/sda3", "target": "/"}]
+ * }
+ * ```
+ *
+ * The fragments are merged in order, and then the recipe on top of them:
+ * - `setup`, `mountpoints` and `postInstallation` steps are appended to those of the fragments,
+ *   unless the section is listed in `override`, in which case they replace them (an empty or
+ *   missing section then removes them).
+ * - `installation` options and `variables` given by the recipe replace those of the fragments.
+ *
+ * Step indices reported by `validate` and `plan` refer to the merged recipe. Including a recipe
+ * which, directly or not, includes the recipe itself is an error.
+ */
+
+/* !! ## Conditions
+ *
+ * Setup and post-installation steps can be given a `when` clause, so that a single recipe serves
+ * different machines. The step only runs if every fact tested matches, and is otherwise skipped
+ * and logged:
+ *
+ * ```json
+ * {
+ *     "operation": "grub-install",
+ *     "params": ["/boot", "/dev/sda", "efi", "vanilla", false, "/dev/sda1"],
+ *     "when": {"firmware": "efi"}
+ * }
+ * ```
+ *
+ * The facts are:
+ * - `firmware`: `efi` if the system booted with UEFI (i.e. `/sys/firmware/efi` exists), `bios`
+ *   otherwise.
+ * - `arch`: the architecture, as printed by `uname -m` (e.g. `x86_64` or `aarch64`).
+ * - `virtualization`: the hypervisor or container, as printed by `systemd-detect-virt` (e.g.
+ *   `kvm` or `vmware`), or `none` on bare metal.
+ * - `existingOS`: `true` if `os-prober` finds other operating systems, `false` if not.
+ * - `transport`: how the disk is connected, as reported by parted (e.g. `nvme`, `scsi`, `usb`
+ *   or `virtblk`).
+ * - `minSize` and `maxSize`: the smallest and largest size of the disk, as absolute
+ *   [sizes](#sizes) (e.g. `"64GiB"`).
+ *
+ * `firmware`, `arch`, `virtualization` and `transport` accept a string or a list of strings, and
+ * match any of them. Values prefixed with `!` match anything else, e.g. `"!none"` for any virtual
+ * machine. Disk facts test the disk of setup steps, or the one given as `disk`, which is required
+ * in post-installation steps.
+ *
+ * Facts are detected once, before the first step runs, and saved for `resume`. Validation checks
+ * every step regardless of its condition, but the steps which cannot run on the firmware and
+ * architecture given in `Facts` (or the firmware of the system validating the recipe) do not
+ * change the partitions, volumes and ids later steps are checked against.
+ */
+
 func (recipe *Recipe) RunPostInstall() error {
-	for i, step := range recipe.PostInstallation {
-		fmt.Printf("Post-installation [%d/%d]: %s\n", i+1, len(recipe.PostInstallation), step.Operation)
-		err := runPostInstallOperation(step.Chroot, step.Operation, step.Params)
+	defer recipe.use()()
+
+	return recipe.runPostInstall(0)
+}
+
+// runPostInstall runs the post-installation steps starting at index from.
+func (recipe *Recipe) runPostInstall(from int) error {
+	for i := from; i < len(recipe.PostInstallation); i++ {
+		step := recipe.PostInstallation[i]
+		recipe.emit(recipe.stepEvent(EventStepStarted, StagePost, i, step.Operation, nil))
+		util.Logf("Post-installation [%d/%d]: %s", i+1, len(recipe.PostInstallation), step.Operation)
+		skip, err := recipe.unmetCondition(step.When, "")
+		if err == nil && skip != "" {
+			util.Logf("Skipping post-installation step %d (%s): %s", i, step.Operation, skip)
+		} else if err == nil {
+			err = recipe.runPostInstallStep(step)
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to run post-install operation %s: %s", step.Operation, err)
+		} else {
+			err = recipe.stepDone(StagePost, i)
+		}
 		if err != nil {
-			return fmt.Errorf("failed to run post-install operation %s: %s", step.Operation, err)
+			recipe.emit(recipe.stepEvent(EventStepFailed, StagePost, i, step.Operation, err))
+			return &StageError{Stage: StagePost, Step: i, Err: err}
 		}
+		recipe.emit(recipe.stepEvent(EventStepFinished, StagePost, i, step.Operation, nil))
 	}
 
 	return nil
 }
 
+// mountpoints returns the recipe's Mountpoints followed by those of the
+// partitions created by auto-layout steps.
+func (recipe *Recipe) mountpoints() []Mountpoint {
+	mountpoints := slices.Clone(recipe.Mountpoints)
+	for _, step := range recipe.Setup {
+		if step.Operation != "auto-layout" || len(step.Params) == 0 {
+			continue
+		}
+		// Once facts are known, auto-layout steps which are skipped create
+		// no partitions
+		if step.When != nil && (recipe.Facts != nil || recipe.detectedFacts != nil) {
+			if skip, err := recipe.unmetCondition(step.When, step.Disk); err == nil && skip != "" {
+				continue
+			}
+		}
+		firmware, _ := step.Params[0].(string)
+		policy, err := layoutPolicy(step.Params)
+		if err != nil {
+			continue
+		}
+
+		for i, part := range policy.ForFirmware(disk.Firmware(firmware)) {
+			if part.Mountpoint != "" {
+				mountpoints = append(mountpoints, Mountpoint{
+					Partition: partitionPath(step.Disk, i+1),
+					Target:    part.Mountpoint,
+				})
+			}
+		}
+	}
+
+	return mountpoints
+}
+
+// resolvedMountpoints returns the mountpoints with their partitions resolved
+// to device paths, see disk.ResolveDevice. The partitions must exist.
+func (recipe *Recipe) resolvedMountpoints() ([]Mountpoint, error) {
+	mountpoints := recipe.mountpoints()
+	for i, mnt := range mountpoints {
+		path, err := recipe.resolveDevice(mnt.Partition)
+		if err != nil {
+			return nil, fmt.Errorf("mountpoint %s: %s", mnt.Target, err)
+		}
+		mountpoints[i].Partition = path
+	}
+
+	return mountpoints, nil
+}
+
+// resolveOptionalDevice resolves ref like disk.ResolveDevice, unless it is
+// empty.
+func resolveOptionalDevice(ref string) (string, error) {
+	if ref == "" {
+		return "", nil
+	}
+
+	return disk.ResolveDevice(ref)
+}
+
 func (recipe *Recipe) SetupMountpoints() error {
-	diskCache := map[string]*disk.Disk{}
+	defer recipe.use()()
+
+	return recipe.setupMountpoints()
+}
+
+func (recipe *Recipe) setupMountpoints() error {
 	rootAMounted := false
 
 	/* We need to mount the partitions in order to prevent one mountpoint
@@ -953,23 +1626,25 @@ func (recipe *Recipe) SetupMountpoints() error {
 	 * /mnt/a, any files copied over to /mnt/a/boot will end up in the root
 	 * partition.
 	 */
+	mountpoints, err := recipe.resolvedMountpoints()
+	if err != nil {
+		return err
+	}
 	mount_depth := 0
 	ordered_mountpoints := make([]*Mountpoint, 0)
-	for len(ordered_mountpoints) < len(recipe.Mountpoints) {
-		for i, mnt := range recipe.Mountpoints {
+	for len(ordered_mountpoints) < len(mountpoints) {
+		for i, mnt := range mountpoints {
 			cnt := strings.Count(mnt.Target, "/")
 			if mnt.Target == "/" {
 				cnt = 0
 			}
 			if cnt == mount_depth {
-				ordered_mountpoints = append(ordered_mountpoints, &recipe.Mountpoints[i])
+				ordered_mountpoints = append(ordered_mountpoints, &mountpoints[i])
 			}
 		}
 		mount_depth += 1
 	}
 
-	lvmExpr := regexp.MustCompile(`^/dev/(?P<vg>[\w-]+)/(?P<lv>[\w-]+)$`)
-
 	for _, mnt := range ordered_mountpoints {
 		baseRoot := RootA
 		if mnt.Target == "/" && rootAMounted {
@@ -978,37 +1653,9 @@ func (recipe *Recipe) SetupMountpoints() error {
 			rootAMounted = true
 		}
 
-		// LVM partition
-		if lvmExpr.MatchString(mnt.Partition) {
-			lvmPartition := disk.Partition{
-				Number: -1,
-				Path:   mnt.Partition,
-			}
-			err := lvmPartition.Mount(baseRoot + mnt.Target)
-			if err != nil {
-				return err
-			}
-			continue
-		}
-
-		// Regular partition
-		diskName, partName := util.SeparateDiskPart(mnt.Partition)
-		part, err := strconv.Atoi(partName)
-		if err != nil {
-			return err
-		}
-
-		target, ok := diskCache[diskName]
-		if !ok {
-			diskPtr, err := disk.LocateDisk(diskName)
-			if err != nil {
-				return err
-			}
-			diskCache[diskName] = diskPtr
-			target = diskCache[diskName]
-		}
-
-		err = target.GetPartition(part).Mount(baseRoot + mnt.Target)
+		// LVM volumes are mounted the same way as regular partitions
+		part := disk.Partition{Path: mnt.Partition}
+		err := part.Mount(baseRoot + mnt.Target)
 		if err != nil {
 			return err
 		}
@@ -1019,7 +1666,11 @@ func (recipe *Recipe) SetupMountpoints() error {
 
 func (recipe *Recipe) setupFstabEntries() ([][]string, error) {
 	fstabEntries := [][]string{}
-	for _, mnt := range recipe.Mountpoints {
+	mountpoints, err := recipe.resolvedMountpoints()
+	if err != nil {
+		return [][]string{}, err
+	}
+	for _, mnt := range mountpoints {
 		entry := []string{}
 
 		uuid, err := disk.GetUUIDByPath(mnt.Partition)
@@ -1071,9 +1722,26 @@ func (recipe *Recipe) setupFstabEntries() ([][]string, error) {
 	return fstabEntries, nil
 }
 
+// Fstab returns the fstab Install would generate for the recipe's
+// mountpoints. The partitions must already exist.
+func (recipe *Recipe) Fstab() ([]byte, error) {
+	defer recipe.use()()
+
+	entries, err := recipe.setupFstabEntries()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate fstab entries: %s", err)
+	}
+
+	return disk.FstabContent(entries), nil
+}
+
 func (recipe *Recipe) setupCrypttabEntries() ([][]string, error) {
 	crypttabEntries := [][]string{}
-	for _, mnt := range recipe.Mountpoints {
+	mountpoints, err := recipe.resolvedMountpoints()
+	if err != nil {
+		return [][]string{}, err
+	}
+	for _, mnt := range mountpoints {
 		dummyPart := disk.Partition{Path: mnt.Partition}
 		isLuks, err := luks.IsLuks(&dummyPart)
 		if err != nil {
@@ -1102,13 +1770,65 @@ func (recipe *Recipe) setupCrypttabEntries() ([][]string, error) {
 	return crypttabEntries, nil
 }
 
+// kernelCmdline returns the kernel options mounting the root partition of
+// the installed system, unlocking it first if it is encrypted.
+func (recipe *Recipe) kernelCmdline() (string, error) {
+	mountpoints, err := recipe.resolvedMountpoints()
+	if err != nil {
+		return "", err
+	}
+	for _, mnt := range mountpoints {
+		// With A/B roots, the first one is RootA
+		if mnt.Target != "/" {
+			continue
+		}
+
+		uuid, err := disk.GetUUIDByPath(mnt.Partition)
+		if err != nil {
+			return "", err
+		}
+		isLuks, err := luks.IsLuks(&disk.Partition{Path: mnt.Partition})
+		if err != nil {
+			return "", err
+		}
+		if isLuks {
+			// Same name as in crypttab, see setupCrypttabEntries
+			return fmt.Sprintf("rd.luks.name=%s=luks-%s root=/dev/mapper/luks-%s rw", uuid, uuid, uuid), nil
+		}
+		return fmt.Sprintf("root=UUID=%s rw", uuid), nil
+	}
+
+	return "", errors.New("no partition is mounted on /")
+}
+
 func (recipe *Recipe) Install() error {
+	defer recipe.use()()
+
+	return recipe.install()
+}
+
+func (recipe *Recipe) install() error {
+	err := recipe.copyInstallationFiles()
+	if err != nil {
+		return err
+	}
+
+	return recipe.configureInstallation()
+}
+
+// copyInstallationFiles copies the system image into RootA using the
+// recipe's installation method.
+func (recipe *Recipe) copyInstallationFiles() error {
 	var err error
 	switch recipe.Installation.Method {
 	case UNSQUASHFS:
 		err = disk.Unsquashfs(recipe.Installation.Source, RootA, true)
 	case OCI:
-		err = disk.OCISetup(recipe.Installation.Source, filepath.Join(RootA, "var"), RootA, false)
+		verify := disk.OCIVerification{
+			Digest:     recipe.Installation.Digest,
+			PolicyPath: recipe.Installation.SignaturePolicy,
+		}
+		err = disk.OCISetup(recipe.Installation.Source, filepath.Join(RootA, "var"), RootA, verify, false, recipe.reportOCIProgress)
 	default:
 		return fmt.Errorf("unsupported installation method '%s'", recipe.Installation.Method)
 	}
@@ -1116,6 +1836,12 @@ func (recipe *Recipe) Install() error {
 		return fmt.Errorf("failed to copy installation files: %s", err)
 	}
 
+	return nil
+}
+
+// configureInstallation generates crypttab and fstab for the installed
+// system and updates its initramfs.
+func (recipe *Recipe) configureInstallation() error {
 	// Setup crypttab (if needed)
 	crypttabEntries, err := recipe.setupCrypttabEntries()
 	if err != nil {
@@ -1138,9 +1864,9 @@ func (recipe *Recipe) Install() error {
 		return fmt.Errorf("failed to generate fstab: %s", err)
 	}
 
-	// Initramfs pre-scripts
+	// Initramfs pre-scripts, which are shell commands written by the user
 	for _, preCmd := range recipe.Installation.InitramfsPre {
-		err := util.RunInChroot(RootA, preCmd)
+		err := util.RunShell(RootA, preCmd)
 		if err != nil {
 			return fmt.Errorf("initramfs pre-script '%s' failed: %s", preCmd, err)
 		}
@@ -1154,7 +1880,7 @@ func (recipe *Recipe) Install() error {
 
 	// Initramfs post-scripts
 	for _, postCmd := range recipe.Installation.InitramfsPost {
-		err := util.RunInChroot(RootA, postCmd)
+		err := util.RunShell(RootA, postCmd)
 		if err != nil {
 			return fmt.Errorf("initramfs post-script '%s' failed: %s", postCmd, err)
 		}
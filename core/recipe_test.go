@@ -1,6 +1,22 @@
 package albius
 
-import "testing"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/albius/core/disk"
+	"github.com/vanilla-os/albius/core/system"
+	"github.com/vanilla-os/albius/core/util"
+	"github.com/vanilla-os/albius/core/util/exectest"
+)
 
 func TestJsonFieldToInt(t *testing.T) {
 	vstr := "2"
@@ -22,3 +38,1355 @@ func TestJsonFieldToInt(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestValidateTemplates(t *testing.T) {
+	for _, path := range []string{"../recipe_template.json", "../utils/sample_recipe.json"} {
+		recipe, err := ReadRecipe(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = recipe.Validate()
+		if err != nil {
+			t.Errorf("%s: %s", path, err)
+		}
+	}
+}
+
+func TestValidateCollectsAllErrors(t *testing.T) {
+	recipe := Recipe{
+		Setup: []SetupStep{
+			{Disk: "/dev/sda", Operation: "label", Params: []interface{}{"gpt"}},
+			{Disk: "/dev/sda", Operation: "setflag", Params: []interface{}{float64(4), "esp", true}},
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"root", "btrfs", "one", float64(-1)}},
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"home", "btrfs", float64(1)}},
+			{Disk: "/dev/sda", Operation: "explode", Params: []interface{}{}},
+			{Disk: "/dev/sda", Operation: "lvcreate", Params: []interface{}{"root", "vg", "linear", float64(100)}},
+		},
+		Mountpoints: []Mountpoint{
+			{Partition: "/dev/sda1", Target: "/"},
+			{Partition: "/dev/sda3", Target: "home"},
+		},
+		Installation: Installation{Method: "rsync"},
+		PostInstallation: []PostStep{
+			{Operation: "grub-install", Params: []interface{}{"/boot", "/dev/sda", "efi", "vanilla", false}},
+			{Operation: "hostname", Params: []interface{}{"vanilla", "extra"}},
+		},
+	}
+
+	err := recipe.Validate()
+	if err == nil {
+		t.Fatal("expected recipe to be invalid")
+	}
+
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("expected ValidationErrors, got %T", err)
+	}
+
+	expected := []struct {
+		section string
+		step    int
+	}{
+		{"setup", 1},            // partition 4 does not exist
+		{"setup", 2},            // Start is not a size
+		{"setup", 3},            // missing End
+		{"setup", 4},            // unknown operation
+		{"mountpoints", 1},      // relative target
+		{"installation", -1},    // unknown method
+		{"installation", -1},    // empty source
+		{"postInstallation", 0}, // missing EFI device
+		{"postInstallation", 1}, // too many params
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %d:\n%s", len(expected), len(errs), errs)
+	}
+	for i, exp := range expected {
+		if errs[i].Section != exp.section || errs[i].Step != exp.step {
+			t.Errorf("error %d: expected %s[%d], got %s", i, exp.section, exp.step, errs[i])
+		}
+	}
+}
+
+func TestValidateOCIVerification(t *testing.T) {
+	for _, test := range []struct {
+		installation Installation
+		valid        bool
+	}{
+		{Installation{Method: OCI, Source: "ghcr.io/vanilla-os/desktop:main", Digest: "sha256:" + strings.Repeat("a", 64), SignaturePolicy: "/cdrom/policy.json"}, true},
+		{Installation{Method: OCI, Source: "ghcr.io/vanilla-os/desktop:main", Digest: "sha256:1234"}, false},
+		{Installation{Method: UNSQUASHFS, Source: "/cdrom/filesystem.squashfs", SignaturePolicy: "/cdrom/policy.json"}, false},
+	} {
+		v := &validator{}
+		v.validateInstallation(test.installation)
+		if valid := len(v.errs) == 0; valid != test.valid {
+			t.Errorf("%+v: expected valid to be %t, got errors %v", test.installation, test.valid, v.errs)
+		}
+	}
+}
+
+func TestRecorderRecordsPostInstallSteps(t *testing.T) {
+	rec := newRecorder()
+	prevExecutor := util.SetExecutor(rec)
+	defer util.SetExecutor(prevExecutor)
+
+	err := runPostInstallOperation(true, "hostname", []interface{}{"vanilla"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runPostInstallOperation(true, "shell", []interface{}{"echo hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions := rec.flush()
+	if len(actions) != 3 {
+		t.Fatalf("expected 3 actions, got %d: %v", len(actions), actions)
+	}
+	if actions[0].File != RootA+"/etc/hostname" || actions[0].Content != "vanilla\n" {
+		t.Errorf("unexpected hostname action: %v", actions[0])
+	}
+	if actions[2].String() != "chroot "+RootA+" sh -c 'echo hi'" {
+		t.Errorf("unexpected shell action: %q", actions[2].String())
+	}
+	if len(rec.flush()) != 0 {
+		t.Error("flush did not clear recorded actions")
+	}
+}
+
+const emptyDiskJson = `{"disk": {"path": "/dev/sda", "size": "20480MiB", "model": "QEMU HARDDISK",
+	"transport": "scsi", "logical-sector-size": 512, "physical-sector-size": 512,
+	"label": "unknown", "max-partitions": 1}}`
+
+// testInstallation is the installation method of the recipes planned by
+// tests, which never touches the system while planning
+var testInstallation = Installation{
+	Method: UNSQUASHFS,
+	Source: "/cdrom/casper/filesystem.squashfs",
+}
+
+// fakeDisk returns an executor for which /dev/sda is the disk described by
+// partedJson, the output of parted -sj print.
+func fakeDisk(partedJson string) *exectest.Fake {
+	return exectest.New().Expect("parted -sj /dev/sda unit MiB print", partedJson)
+}
+
+// checkPlan plans recipe, and reports every expected action (or part of
+// one) which is missing from the plan.
+func checkPlan(t *testing.T, recipe *Recipe, expected ...string) *Plan {
+	t.Helper()
+
+	plan, err := recipe.Plan()
+	if err != nil {
+		t.Fatalf("%s\n%s", plan, err)
+	}
+
+	output := plan.String()
+	for _, action := range expected {
+		if !strings.Contains(output, action) {
+			t.Errorf("plan is missing %q:\n%s", action, plan)
+		}
+	}
+
+	return plan
+}
+
+func TestRunSetupUsesRecipeExecutor(t *testing.T) {
+	fake := fakeDisk(emptyDiskJson)
+
+	recipe := &Recipe{
+		Setup: []SetupStep{
+			{Disk: "/dev/sda", Operation: "label", Params: []interface{}{"gpt"}},
+		},
+		Executor: fake,
+	}
+
+	err := recipe.RunSetup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Contains(fake.Commands, "parted -s /dev/sda mklabel gpt") {
+		t.Errorf("label command was not executed, got %v", fake.Commands)
+	}
+
+	// The package-level executor must be restored after the run
+	other := exectest.New()
+	restore := other.Install()
+	defer restore()
+	recipe.Executor = nil
+	_ = recipe.RunSetup()
+	if len(other.Commands) == 0 {
+		t.Error("recipe without Executor did not use the package-level one")
+	}
+}
+
+func TestPlanWithFakeExecutor(t *testing.T) {
+	fake := fakeDisk(emptyDiskJson)
+
+	recipe := &Recipe{
+		Setup: []SetupStep{
+			{Disk: "/dev/sda", Operation: "label", Params: []interface{}{"gpt"}},
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"root", "btrfs", float64(1), float64(-1)}},
+		},
+		Mountpoints: []Mountpoint{
+			{Partition: "/dev/sda1", Target: "/"},
+		},
+		Installation: testInstallation,
+		Executor:     fake,
+	}
+
+	plan, err := recipe.Plan()
+	if err != nil {
+		t.Fatalf("%s\n%s", plan, err)
+	}
+
+	commands := []string{}
+	files := map[string]string{}
+	for _, step := range plan.Steps {
+		for _, action := range step.Actions {
+			if action.File != "" {
+				files[action.File] = action.Content
+			} else if action.Command != "" {
+				commands = append(commands, action.Command)
+			}
+		}
+	}
+
+	for _, expected := range []string{
+		"parted -s /dev/sda mklabel gpt",
+		"mkfs.btrfs -f /dev/sda1",
+	} {
+		if !slices.Contains(commands, expected) {
+			t.Errorf("plan is missing %q:\n%s", expected, plan)
+		}
+	}
+	if !strings.Contains(files[RootA+"/etc/fstab"], "UUID=<uuid:/dev/sda1> / btrfs") {
+		t.Errorf("unexpected fstab in plan:\n%s", files[RootA+"/etc/fstab"])
+	}
+
+	// Nothing but read-only queries may reach the executor
+	for _, command := range fake.Commands {
+		if strings.Contains(command, "mklabel") || strings.HasPrefix(command, "mkfs") {
+			t.Errorf("plan executed %q", command)
+		}
+	}
+}
+
+func TestPlanAutoLayout(t *testing.T) {
+	fake := fakeDisk(strings.Replace(emptyDiskJson, "20480MiB", "65536MiB", 1))
+
+	recipe := &Recipe{
+		Setup: []SetupStep{
+			{Disk: "/dev/sda", Operation: "auto-layout", Params: []interface{}{"efi", "secret"}},
+		},
+		Installation: testInstallation,
+		Executor:     fake,
+	}
+
+	checkPlan(t, recipe,
+		"parted -s /dev/sda mklabel gpt",
+		`parted -s /dev/sda unit MiB mkpart '"boot"' ext4 1 1025`,
+		"parted -s /dev/sda set 2 esp on",
+		"cryptsetup -q luksFormat /dev/sda5",
+		"mount -m /dev/sda2 /mnt/a/boot/efi",
+	)
+
+	// Mountpoints are checked against the partitions of the layout
+	recipe.Mountpoints = []Mountpoint{{Partition: "/dev/sda6", Target: "/srv"}}
+	err := recipe.Validate()
+	if err == nil || !strings.Contains(err.Error(), "/dev/sda6") {
+		t.Errorf("expected an error about /dev/sda6, got %v", err)
+	}
+}
+
+func TestPlanShrinkForInstall(t *testing.T) {
+	fake := fakeDisk(`{"disk": {"path": "/dev/sda", "size": "204800MiB",
+			"model": "QEMU HARDDISK", "transport": "scsi", "logical-sector-size": 512,
+			"physical-sector-size": 512, "label": "gpt", "max-partitions": 128, "partitions": [
+				{"number": 1, "start": "1.00MiB", "end": "102401MiB", "size": "102400MiB",
+				"type": "primary", "filesystem": "ntfs"}]}}`).
+		Expect("lsblk -d -n -o FSTYPE /dev/sda1", "ntfs")
+
+	recipe := &Recipe{
+		Setup: []SetupStep{
+			{Disk: "/dev/sda", Operation: "shrink-for-install", Params: []interface{}{float64(1), "-50GiB"}},
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"linux", "btrfs", "freed", "freed"}},
+		},
+		Installation: testInstallation,
+		Executor:     fake,
+	}
+
+	checkPlan(t, recipe,
+		// The filesystem is shrunk below the new size of the partition, then
+		// grown back to fill it
+		"ntfsresize --no-action --size 53686042624 /dev/sda1",
+		"parted -s /dev/sda unit MiB resizepart 1 51201",
+		"ntfsresize -f /dev/sda1",
+		`mkpart '"linux"' btrfs 51201 102401`,
+	)
+
+	// freed can only be used after a shrink-for-install step
+	recipe.Setup = recipe.Setup[1:]
+	err := recipe.Validate()
+	if err == nil || !strings.Contains(err.Error(), "no region was freed") {
+		t.Errorf("expected an error about freed, got %v", err)
+	}
+}
+
+func TestPlanMkpartInFreeRegion(t *testing.T) {
+	fake := fakeDisk(`{"disk": {"path": "/dev/sda", "size": "20480MiB",
+			"model": "QEMU HARDDISK", "transport": "scsi", "logical-sector-size": 512,
+			"physical-sector-size": 512, "label": "gpt", "max-partitions": 128, "partitions": [
+				{"number": 1, "start": "1.00MiB", "end": "1025MiB", "size": "1024MiB", "type": "primary"},
+				{"number": 2, "start": "4096MiB", "end": "6144MiB", "size": "2048MiB", "type": "primary"}]}}`)
+
+	recipe := &Recipe{
+		Setup: []SetupStep{
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"root", "btrfs", "free:largest", "8GiB"}},
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"home", "btrfs", "free:largest", "rest"}},
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"swap", "linux-swap", "free:1", "free:1"}},
+		},
+		Installation: testInstallation,
+		Executor:     fake,
+	}
+
+	checkPlan(t, recipe,
+		`mkpart '"root"' btrfs 6144 14336`,
+		`mkpart '"home"' btrfs 14336 20479`,
+		`mkpart '"swap"' linux-swap 1025 4096`,
+	)
+}
+
+func TestPlanMkpartReusesFreeNumber(t *testing.T) {
+	// Partition 2 was removed, so parted numbers the new partition 2
+	fake := fakeDisk(`{"disk": {"path": "/dev/sda", "size": "102400MiB",
+			"model": "QEMU HARDDISK", "transport": "scsi", "logical-sector-size": 512,
+			"physical-sector-size": 512, "label": "gpt", "max-partitions": 128, "partitions": [
+				{"number": 1, "start": "1.00MiB", "end": "1025MiB", "size": "1024MiB", "type": "primary"},
+				{"number": 3, "start": "51201MiB", "end": "102399MiB", "size": "51198MiB",
+				"type": "primary", "filesystem": "ntfs"}]}}`)
+
+	recipe := &Recipe{
+		Setup: []SetupStep{
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"linux", "btrfs", "free:largest", "free:largest"}},
+		},
+		Mountpoints:  []Mountpoint{{Partition: "/dev/sda2", Target: "/"}},
+		Installation: testInstallation,
+		Executor:     fake,
+	}
+
+	plan := checkPlan(t, recipe,
+		`mkpart '"linux"' btrfs 1025 51201`,
+		"mkfs.btrfs -f /dev/sda2",
+		"mount -m /dev/sda2 /mnt/a",
+	)
+	if strings.Contains(plan.String(), "/dev/sda3") {
+		t.Errorf("plan touches the existing partition 3:\n%s", plan)
+	}
+}
+
+func TestPlanStableDeviceRefs(t *testing.T) {
+	const diskRef = "/dev/disk/by-id/nvme-QEMU_NVMe_Ctrl_1234"
+	fake := exectest.New().
+		Expect("readlink -e "+diskRef, "/dev/nvme0n1").
+		Expect("parted -sj /dev/nvme0n1 unit MiB print", strings.Replace(emptyDiskJson, "/dev/sda", "/dev/nvme0n1", 1)).
+		// The partition table is replaced, so the current partition with
+		// the same name must be ignored
+		Expect("blkid -c /dev/null -o device -t PARTLABEL=root", "/dev/nvme0n1p2")
+
+	recipe := &Recipe{
+		Setup: []SetupStep{
+			{Disk: diskRef, Operation: "label", Params: []interface{}{"gpt"}},
+			{Disk: diskRef, Operation: "mkpart", Params: []interface{}{"root", "btrfs", 1, -1}},
+		},
+		Mountpoints:  []Mountpoint{{Partition: "PARTLABEL=root", Target: "/"}},
+		Installation: testInstallation,
+		PostInstallation: []PostStep{
+			{Chroot: true, Operation: "grub-install", Params: []interface{}{"/boot", diskRef, "efi", "vanilla", true}},
+		},
+		Executor: fake,
+	}
+
+	checkPlan(t, recipe,
+		"parted -s /dev/nvme0n1 mklabel gpt",
+		"mount -m /dev/nvme0n1p1 /mnt/a",
+		"--uefi-secure-boot /dev/nvme0n1",
+	)
+
+	recipe.Mountpoints = []Mountpoint{{Partition: "PARTNAME=root", Target: "/"}}
+	err := recipe.Validate()
+	if err == nil || !strings.Contains(err.Error(), "PARTNAME=root") {
+		t.Errorf("expected an error about PARTNAME=root, got %v", err)
+	}
+}
+
+func TestPlanGrubInstallFirmware(t *testing.T) {
+	fake := fakeDisk(emptyDiskJson)
+
+	recipe := &Recipe{
+		Setup: []SetupStep{
+			{Disk: "/dev/sda", Operation: "label", Params: []interface{}{"gpt"}},
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"bios", "none", float64(1), float64(2)}},
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"root", "btrfs", float64(2), float64(-1)}},
+		},
+		Mountpoints:  []Mountpoint{{Partition: "/dev/sda2", Target: "/"}},
+		Installation: testInstallation,
+		PostInstallation: []PostStep{
+			{Chroot: true, Operation: "grub-install", Params: []interface{}{"/boot", "/dev/sda", "auto", "vanilla", true}},
+		},
+		Facts:    &Facts{Firmware: disk.BIOS},
+		Executor: fake,
+	}
+
+	err := recipe.Validate()
+	if err == nil || !strings.Contains(err.Error(), "bios_grub") {
+		t.Errorf("expected an error about the missing bios_grub partition, got %v", err)
+	}
+
+	recipe.Setup = append(recipe.Setup, SetupStep{Disk: "/dev/sda", Operation: "setflag", Params: []interface{}{float64(1), "bios_grub", true}})
+	checkPlan(t, recipe,
+		"parted -s /dev/sda set 1 bios_grub on",
+		"--target=i386-pc",
+	)
+
+	grubTarget, err := system.GetGrubTarget("efi")
+	if err != nil {
+		t.Skip(err)
+	}
+	recipe.Facts.Firmware = disk.EFI
+	checkPlan(t, recipe, "--target="+grubTarget)
+}
+
+func TestValidateSkipsOtherFirmwareSteps(t *testing.T) {
+	bios := &Condition{Firmware: FactValues{"bios"}}
+	efi := &Condition{Firmware: FactValues{"efi"}}
+	recipe := &Recipe{
+		Setup: []SetupStep{
+			{Disk: "/dev/sda", Operation: "label", Params: []interface{}{"msdos"}, When: bios},
+			{Disk: "/dev/sda", Operation: "label", Params: []interface{}{"gpt"}, When: efi},
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"efi", "fat32", float64(1), float64(513)}, When: efi},
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"root", "btrfs", float64(513), float64(-1)}, ID: "root"},
+		},
+		Mountpoints:  []Mountpoint{{Partition: "${part.root}", Target: "/"}},
+		Installation: testInstallation,
+		PostInstallation: []PostStep{
+			{Chroot: true, Operation: "grub-install", Params: []interface{}{"/boot", "/dev/sda", "bios", "vanilla", false}, When: bios},
+			{Chroot: true, Operation: "grub-install", Params: []interface{}{"/boot/efi", "/dev/sda", "efi", "vanilla", true}, When: efi},
+		},
+		Facts: &Facts{Firmware: disk.BIOS, Arch: "x86_64"},
+	}
+
+	err := recipe.Validate()
+	if err != nil {
+		t.Errorf("expected the recipe to be valid on BIOS, got %v", err)
+	}
+
+	// Skipped steps and their conditions are still checked
+	recipe.Setup[2].Params = []interface{}{"efi", "fat32", float64(1)}
+	recipe.PostInstallation[1].When = &Condition{Firmware: FactValues{"uefi"}}
+	err = recipe.Validate()
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("expected 2 validation errors, got %v", err)
+	}
+	for i, expected := range []string{"mkpart", `unknown firmware "uefi"`} {
+		if !strings.Contains(errs[i].Error(), expected) {
+			t.Errorf("error %d: expected %q, got %s", i, expected, errs[i])
+		}
+	}
+}
+
+func TestPlanSystemdBoot(t *testing.T) {
+	fake := fakeDisk(emptyDiskJson)
+
+	recipe := &Recipe{
+		Setup: []SetupStep{
+			{Disk: "/dev/sda", Operation: "label", Params: []interface{}{"gpt"}},
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"efi", "fat32", float64(1), float64(513)}},
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"root", "luks-btrfs", float64(513), float64(-1), "secret"}},
+		},
+		Mountpoints: []Mountpoint{
+			{Partition: "/dev/sda2", Target: "/"},
+			{Partition: "/dev/sda1", Target: "/boot/efi"},
+		},
+		Installation: testInstallation,
+		PostInstallation: []PostStep{
+			{Chroot: true, Operation: "sdboot-install", Params: []interface{}{"/boot/efi", "/dev/sda1", "vanilla"}},
+			{Chroot: true, Operation: "sdboot-entry", Params: []interface{}{"/boot/efi", "vanilla", "Vanilla OS", "quiet"}},
+		},
+		Executor: fake,
+	}
+
+	checkPlan(t, recipe,
+		"bootctl install --esp-path=/boot/efi --no-variables",
+		"efibootmgr --create --disk=/dev/sda --part=1 --label=vanilla",
+		"install -D -m 0644 '/boot/vmlinuz-<kernel version>' '/boot/efi/vanilla/<kernel version>/vmlinuz'",
+		"write "+RootA+"/boot/efi/loader/loader.conf:\n    timeout 3\n",
+		"options rd.luks.name=<uuid:/dev/sda2>=luks-<uuid:/dev/sda2> root=/dev/mapper/luks-<uuid:/dev/sda2> rw quiet",
+	)
+
+	// Without chroot, the kernels are those in the host's /boot, and a
+	// kernel without initramfs has none in its entry
+	fake.Expect("ls -1 /boot", "config-6.1.0\nvmlinuz-6.1.0")
+	recipe.PostInstallation[1].Chroot = false
+	plan := checkPlan(t, recipe,
+		"install -D -m 0644 /boot/vmlinuz-6.1.0 /boot/efi/vanilla/6.1.0/vmlinuz",
+		"write /boot/efi/loader/entries/vanilla-6.1.0.conf:",
+	)
+	if strings.Contains(plan.String(), "initrd.img") {
+		t.Errorf("plan installs an initramfs which does not exist:\n%s", plan)
+	}
+
+	recipe.PostInstallation[1].Chroot = true
+	recipe.PostInstallation[1].Params[1] = "../vanilla"
+	err := recipe.Validate()
+	if err == nil || !strings.Contains(err.Error(), "invalid entry name") {
+		t.Errorf("expected an error about the entry name, got %v", err)
+	}
+}
+
+func TestPlanUKIInstall(t *testing.T) {
+	fake := fakeDisk(emptyDiskJson)
+
+	recipe := &Recipe{
+		Setup: []SetupStep{
+			{Disk: "/dev/sda", Operation: "label", Params: []interface{}{"gpt"}},
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"efi", "fat32", float64(1), float64(513)}},
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"root", "btrfs", float64(513), float64(-1)}},
+		},
+		Mountpoints: []Mountpoint{
+			{Partition: "/dev/sda2", Target: "/"},
+			{Partition: "/dev/sda1", Target: "/boot/efi"},
+		},
+		Installation: testInstallation,
+		PostInstallation: []PostStep{
+			{Chroot: true, Operation: "uki-install", Params: []interface{}{"/boot/efi", "/dev/sda1", "vanilla", "", "/etc/keys/db.key", "/etc/keys/db.crt"}},
+		},
+		Executor: fake,
+	}
+
+	const uki = "/boot/efi/EFI/Linux/vanilla-<kernel version>.efi"
+	checkPlan(t, recipe,
+		"ukify build '--linux=/boot/vmlinuz-<kernel version>' '--uname=<kernel version>' '--cmdline=root=UUID=<uuid:/dev/sda2> rw' '--output="+uki+"'",
+		"sbsign --key /etc/keys/db.key --cert /etc/keys/db.crt --output '"+RootA+uki+"' '"+RootA+uki+"'",
+		"efibootmgr --create --disk=/dev/sda --part=1 '--label=vanilla (<kernel version>)' '--loader=\\EFI\\Linux\\vanilla-<kernel version>.efi'",
+		"'--initrd=/boot/initrd.img-<kernel version>'",
+	)
+
+	// A kernel without initramfs is bundled alone
+	fake.Expect("ls -1 /boot", "vmlinuz-6.1.0")
+	recipe.PostInstallation[0].Chroot = false
+	plan := checkPlan(t, recipe, "ukify build --linux=/boot/vmlinuz-6.1.0 --uname=6.1.0")
+	if strings.Contains(plan.String(), "--initrd") {
+		t.Errorf("plan bundles an initramfs which does not exist:\n%s", plan)
+	}
+	recipe.PostInstallation[0].Chroot = true
+
+	recipe.PostInstallation[0].Params = recipe.PostInstallation[0].Params[:5]
+	err := recipe.Validate()
+	if err == nil || !strings.Contains(err.Error(), "must be given together") {
+		t.Errorf("expected an error about the signing certificate, got %v", err)
+	}
+}
+
+func TestPlanStepReferences(t *testing.T) {
+	fake := fakeDisk(emptyDiskJson)
+
+	recipe := &Recipe{
+		Setup: []SetupStep{
+			{Disk: "/dev/sda", Operation: "label", Params: []interface{}{"gpt"}},
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"boot", "ext4", float64(1), float64(1025)}, ID: "boot"},
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"pv", "none", float64(1025), float64(-1)}, ID: "pv"},
+			{Disk: "/dev/sda", Operation: "pvcreate", Params: []interface{}{"${part.pv}"}},
+			{Disk: "/dev/sda", Operation: "vgcreate", Params: []interface{}{"vos", []interface{}{map[string]interface{}{"ref": "pv"}}}},
+			{Disk: "/dev/sda", Operation: "lvcreate", Params: []interface{}{"root", "vos", "linear", "rest"}, ID: "root"},
+			{Disk: "/dev/sda", Operation: "lvm-format", Params: []interface{}{"vos/root", "btrfs"}},
+		},
+		Mountpoints: []Mountpoint{
+			{Partition: "${part.root}", Target: "/"},
+			{Partition: "${part.boot}", Target: "/boot"},
+		},
+		Installation: testInstallation,
+		PostInstallation: []PostStep{
+			{Chroot: true, Operation: "shell", Params: []interface{}{"echo boot=${part.boot.uuid}"}},
+		},
+		Executor: fake,
+	}
+
+	checkPlan(t, recipe,
+		"pvcreate -y /dev/sda2",
+		"vgcreate vos /dev/sda2",
+		"mount -m /dev/vos/root /mnt/a",
+		"mount -m /dev/sda1 /mnt/a/boot",
+		"echo boot=<uuid:/dev/sda1>",
+	)
+
+	// References must point to a previous step, and only steps creating a
+	// device can have an id
+	recipe.Setup[3].Params = []interface{}{"${part.root}"}
+	recipe.Setup[6].ID = "format"
+	recipe.Mountpoints[1].Partition = "${part.boot.size}"
+	err := recipe.Validate()
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("expected 3 validation errors, got %v", err)
+	}
+	for i, expected := range []string{`no previous setup step has id "root"`, "can have an id", `unknown field "size"`} {
+		if !strings.Contains(errs[i].Message, expected) {
+			t.Errorf("error %d: expected %q, got %s", i, expected, errs[i])
+		}
+	}
+}
+
+func TestRecipeVariables(t *testing.T) {
+	fake := fakeDisk(emptyDiskJson)
+
+	defaultFs := "ext4"
+	newRecipe := func() *Recipe {
+		return &Recipe{
+			Variables: map[string]Variable{
+				"disk":     {Description: "Target disk"},
+				"fs":       {Default: &defaultFs},
+				"hostname": {},
+				"password": {Type: VariableSecret},
+			},
+			Setup: []SetupStep{
+				{Disk: "${disk}", Operation: "label", Params: []interface{}{"gpt"}},
+				{Disk: "${disk}", Operation: "mkpart", Params: []interface{}{"root", "${fs}", float64(1), float64(-1)}},
+			},
+			Mountpoints: []Mountpoint{
+				{Partition: "${disk}1", Target: "/"},
+			},
+			Installation: testInstallation,
+			PostInstallation: []PostStep{
+				{Chroot: true, Operation: "shell", Params: []interface{}{"echo ${hostname} > /etc/hostname", "echo root:${password} | chpasswd -e ${HOME}"}},
+			},
+			Executor: fake,
+		}
+	}
+
+	// Declared variables must be given a value
+	recipe := newRecipe()
+	err := recipe.Validate()
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != 6 || !strings.Contains(errs[0].Message, "variable disk has no value") {
+		t.Fatalf("expected 6 validation errors for variables with no value, got %v", err)
+	}
+	err = recipe.SetVariables(VariableSources{Values: map[string]string{"disk": "/dev/sda"}})
+	if err == nil || !strings.Contains(err.Error(), "hostname, password") {
+		t.Fatalf("expected an error for missing values, got %v", err)
+	}
+	err = recipe.SetVariables(VariableSources{Values: map[string]string{"size": "10"}})
+	if err == nil || !strings.Contains(err.Error(), "size is not declared") {
+		t.Fatalf("expected an error for an undeclared variable, got %v", err)
+	}
+
+	t.Setenv(VariableEnvPrefix+"hostname", "vanilla")
+	recipe = newRecipe()
+	err = recipe.SetVariables(VariableSources{
+		Values: map[string]string{"disk": "/dev/sda"},
+		Prompt: func(name string, _ Variable) (string, error) { return "s3cr3t-pass", nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan := checkPlan(t, recipe,
+		`mkpart '"root"' ext4 1 100%`,
+		"mount -m /dev/sda1 /mnt/a",
+		"echo vanilla > /etc/hostname",
+		"echo root:******** | chpasswd -e ${HOME}",
+	)
+	if strings.Contains(plan.String(), "s3cr3t-pass") {
+		t.Errorf("plan shows a secret:\n%s", plan)
+	}
+}
+
+func TestReadRecipeFormats(t *testing.T) {
+	recipes := map[string]string{
+		"recipe.json": `{
+			"setup": [{"disk": "/dev/sda", "operation": "mkpart", "params": ["root", "btrfs", 1, -1]}],
+			"mountpoints": [{"partition": "/dev/sda1", "target": "/"}],
+			"installation": {"method": "unsquashfs", "source": "/cdrom/casper/filesystem.squashfs"},
+			"postInstallation": [{"chroot": true, "operation": "adduser", "params": ["vanilla", "Vanilla", ["sudo"], "", 1000]}]
+		}`,
+		"recipe.yaml": `
+# The root partition uses the whole disk
+setup:
+  - disk: /dev/sda
+    operation: mkpart
+    params: [root, btrfs, 1, -1]
+mountpoints:
+  - partition: /dev/sda1
+    target: /
+installation:
+  method: unsquashfs
+  source: /cdrom/casper/filesystem.squashfs
+postInstallation:
+  - chroot: true
+    operation: adduser
+    params: [vanilla, Vanilla, [sudo], "", 1000]
+`,
+		"recipe.toml": `
+# The root partition uses the whole disk
+[[setup]]
+disk = "/dev/sda"
+operation = "mkpart"
+params = ["root", "btrfs", 1, -1]
+
+[[mountpoints]]
+partition = "/dev/sda1"
+target = "/"
+
+[installation]
+method = "unsquashfs"
+source = "/cdrom/casper/filesystem.squashfs"
+
+[[postInstallation]]
+chroot = true
+operation = "adduser"
+params = ["vanilla", "Vanilla", ["sudo"], "", 1000]
+`,
+	}
+
+	dir := t.TempDir()
+	read := func(name, content string) *Recipe {
+		path := filepath.Join(dir, name)
+		err := os.WriteFile(path, []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recipe, err := ReadRecipe(path)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		return recipe
+	}
+
+	expected := read("recipe.json", recipes["recipe.json"])
+	for name, content := range recipes {
+		// By extension, and then by content
+		for _, path := range []string{name, strings.TrimSuffix(name, filepath.Ext(name)) + ".recipe"} {
+			recipe := read(path, content)
+			if !reflect.DeepEqual(recipe, expected) {
+				t.Errorf("%s: expected %+v, got %+v", path, expected, recipe)
+			}
+		}
+	}
+}
+
+func TestReadRecipeIncludes(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"base.yaml": `
+include: [common/locale.toml]
+variables:
+  disk: {default: /dev/sda}
+setup:
+  - {disk: "${disk}", operation: label, params: [gpt]}
+mountpoints:
+  - {partition: "${disk}1", target: /}
+installation:
+  method: unsquashfs
+  source: /cdrom/casper/filesystem.squashfs
+postInstallation:
+  - {chroot: true, operation: hostname, params: [vanilla]}
+`,
+		"common/locale.toml": `
+[[postInstallation]]
+chroot = true
+operation = "locale"
+params = ["en_US.UTF-8"]
+`,
+		"editions/desktop.json": `{
+			"include": ["../base.yaml"],
+			"override": ["mountpoints"],
+			"mountpoints": [{"partition": "${disk}2", "target": "/"}],
+			"installation": {"source": "/cdrom/desktop.squashfs"},
+			"postInstallation": [{"chroot": true, "operation": "shell", "params": ["echo desktop"]}]
+		}`,
+		"cycle/a.json":  `{"include": ["b.json"]}`,
+		"cycle/b.json":  `{"include": ["a.json"]}`,
+		"override.json": `{"include": ["base.yaml"], "override": ["installation"]}`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err == nil {
+			err = os.WriteFile(path, []byte(content), 0o644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recipe, err := ReadRecipe(filepath.Join(dir, "editions/desktop.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recipe.Setup) != 1 || recipe.Setup[0].Operation != "label" {
+		t.Errorf("expected the setup of base.yaml, got %+v", recipe.Setup)
+	}
+	if len(recipe.Mountpoints) != 1 || recipe.Mountpoints[0].Partition != "${disk}2" {
+		t.Errorf("expected the overridden mountpoints, got %+v", recipe.Mountpoints)
+	}
+	if recipe.Installation.Method != UNSQUASHFS || recipe.Installation.Source != "/cdrom/desktop.squashfs" {
+		t.Errorf("expected the merged installation, got %+v", recipe.Installation)
+	}
+	operations := []string{}
+	for _, step := range recipe.PostInstallation {
+		operations = append(operations, step.Operation)
+	}
+	if !slices.Equal(operations, []string{"locale", "hostname", "shell"}) {
+		t.Errorf("expected the post-installation steps of every fragment in order, got %v", operations)
+	}
+	if _, ok := recipe.Variables["disk"]; !ok || recipe.Include != nil || recipe.Override != nil {
+		t.Errorf("expected the variables of base.yaml and no includes left, got %+v", recipe)
+	}
+
+	_, err = ReadRecipe(filepath.Join(dir, "cycle/a.json"))
+	if err == nil || !strings.Contains(err.Error(), "include cycle") || !strings.Contains(err.Error(), "b.json -> ") {
+		t.Errorf("expected an include cycle error, got %v", err)
+	}
+	_, err = ReadRecipe(filepath.Join(dir, "override.json"))
+	if err == nil || !strings.Contains(err.Error(), `cannot override "installation"`) {
+		t.Errorf("expected an error for an invalid override, got %v", err)
+	}
+}
+
+// TestRecipeSchema checks that recipe.schema.json, generated from the
+// documentation of the operations, agrees with the validator.
+func TestRecipeSchema(t *testing.T) {
+	content, err := os.ReadFile("../recipe.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type paramsSchema struct {
+		PrefixItems []json.RawMessage
+		Items       json.RawMessage
+		MinItems    int
+		MaxItems    *int
+	}
+	type stepSchema struct {
+		Properties struct {
+			Operation struct {
+				AnyOf []struct{ Const string }
+			}
+		}
+		AllOf []struct {
+			If struct {
+				Properties struct{ Operation struct{ Const string } }
+			}
+			Then struct {
+				Properties struct{ Params paramsSchema }
+			}
+		}
+	}
+	var schema struct {
+		Properties struct {
+			Setup            struct{ Items stepSchema }
+			PostInstallation struct{ Items stepSchema }
+		}
+	}
+	err = json.Unmarshal(content, &schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, section := range []struct {
+		name  string
+		step  stepSchema
+		specs map[string][]paramSpec
+	}{
+		{"setup", schema.Properties.Setup.Items, setupOperationParams},
+		{"postInstallation", schema.Properties.PostInstallation.Items, postInstallOperationParams},
+	} {
+		operations := []string{}
+		for _, op := range section.step.Properties.Operation.AnyOf {
+			operations = append(operations, op.Const)
+		}
+		slices.Sort(operations)
+		if expected := slices.Sorted(maps.Keys(section.specs)); !slices.Equal(operations, expected) {
+			t.Errorf("%s: schema has operations %v, validator has %v", section.name, operations, expected)
+		}
+
+		for _, cond := range section.step.AllOf {
+			operation := cond.If.Properties.Operation.Const
+			specs := section.specs[operation]
+			params := cond.Then.Properties.Params
+			required := 0
+			for _, spec := range specs {
+				if !spec.optional {
+					required++
+				}
+			}
+
+			if len(specs) > 0 && specs[len(specs)-1].variadic {
+				if params.Items == nil || params.MaxItems != nil {
+					t.Errorf("%s: %s should accept any number of parameters", section.name, operation)
+				}
+				continue
+			}
+			maxItems := -1
+			if params.MaxItems != nil {
+				maxItems = *params.MaxItems
+			}
+			if len(params.PrefixItems) != len(specs) || params.MinItems != required || maxItems != len(specs) {
+				t.Errorf("%s: %s should accept %d to %d parameters, schema describes %d and accepts %d to %d", section.name, operation, required, len(specs), len(params.PrefixItems), params.MinItems, maxItems)
+			}
+		}
+	}
+}
+
+func TestPlanConditions(t *testing.T) {
+	fake := fakeDisk(emptyDiskJson)
+
+	existingOS := true
+	recipe := &Recipe{
+		Setup: []SetupStep{
+			{Disk: "/dev/sda", Operation: "label", Params: []interface{}{"gpt"}},
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"bios", "none", float64(1), float64(2)}, When: &Condition{Firmware: FactValues{"bios"}}},
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"efi", "fat32", float64(2), float64(514)}, When: &Condition{Firmware: FactValues{"efi"}}},
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"root", "btrfs", float64(514), float64(-1)}, When: &Condition{Transport: FactValues{"!usb"}, MinSize: "16GiB"}},
+			{Disk: "/dev/sda", Operation: "mkpart", Params: []interface{}{"home", "btrfs", float64(514), float64(-1)}, When: &Condition{MinSize: "1TB"}},
+		},
+		Mountpoints: []Mountpoint{
+			{Partition: "/dev/sda2", Target: "/"},
+		},
+		Installation: testInstallation,
+		PostInstallation: []PostStep{
+			{Chroot: true, Operation: "shell", Params: []interface{}{"echo dual boot"}, When: &Condition{ExistingOS: &existingOS}},
+			{Chroot: true, Operation: "shell", Params: []interface{}{"echo virtual machine"}, When: &Condition{Arch: FactValues{"x86_64", "aarch64"}, Virtualization: FactValues{"!none"}}},
+		},
+		Facts:    &Facts{Firmware: disk.BIOS, Arch: "x86_64", Virtualization: "kvm"},
+		Executor: fake,
+	}
+
+	plan := checkPlan(t, recipe,
+		`mkpart '"bios"' 1 2`,
+		"# skipped: firmware is bios, expected efi",
+		`mkpart '"root"' btrfs 514 100%`,
+		"# skipped: /dev/sda is smaller than 1TB",
+		"# skipped: no existing operating system was found",
+		"echo virtual machine",
+	)
+	if output := plan.String(); strings.Contains(output, `mkpart '"efi"'`) || strings.Contains(output, "echo dual boot") {
+		t.Errorf("plan runs skipped steps:\n%s", plan)
+	}
+
+	recipe.Setup[1].When = &Condition{Firmware: FactValues{"uefi"}}
+	recipe.Setup[2].When = &Condition{MinSize: "50%"}
+	recipe.PostInstallation[0].When = &Condition{Transport: FactValues{"nvme"}}
+	err := recipe.Validate()
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("expected 3 validation errors, got %v", err)
+	}
+	for i, expected := range []string{`unknown firmware "uefi"`, "minSize must be a positive absolute size", "require a disk"} {
+		if !strings.Contains(errs[i].Message, expected) {
+			t.Errorf("error %d: expected %q, got %s", i, expected, errs[i])
+		}
+	}
+
+	var step SetupStep
+	err = json.Unmarshal([]byte(`{"disk": "/dev/sda", "operation": "label", "params": ["gpt"], "when": {"firmwre": "efi"}}`), &step)
+	if err == nil || !strings.Contains(err.Error(), "firmwre") {
+		t.Errorf("expected an error for an unknown fact, got %v", err)
+	}
+}
+
+func TestListDisks(t *testing.T) {
+	fake := exectest.New().
+		Expect("lsblk -J -b -o NAME,PATH,TYPE,SIZE,SERIAL,RM,ROTA,FSTYPE,LABEL,UUID,PARTLABEL,PARTUUID,MOUNTPOINTS", `{"blockdevices": [
+			{"name": "loop0", "path": "/dev/loop0", "type": "loop", "size": 4096, "rm": false, "rota": false, "mountpoints": [null]},
+			{"name": "sda", "path": "/dev/sda", "type": "disk", "size": 21474836480, "serial": "QM0001", "rm": "0", "rota": "1", "mountpoints": [null],
+				"children": [
+					{"name": "sda1", "path": "/dev/sda1", "type": "part", "fstype": "vfat", "uuid": "ABCD-1234", "partlabel": "efi", "partuuid": "1111", "mountpoints": ["/boot/efi"]},
+					{"name": "sda2", "path": "/dev/sda2", "type": "part", "fstype": "crypto_LUKS", "uuid": "2222", "mountpoints": [null],
+						"children": [{"name": "luks-2222", "path": "/dev/mapper/luks-2222", "type": "crypt", "fstype": "btrfs", "mountpoints": ["/", "/home"]}]},
+					{"name": "sda3", "path": "/dev/sda3", "type": "part", "fstype": "LVM2_member", "mountpoints": [null]}
+				]},
+			{"name": "sdb", "path": "/dev/sdb", "type": "disk", "size": 0, "rm": true, "rota": false, "mountpoints": [null]}
+		]}`).
+		Expect("parted -sj /dev/sda unit MiB print", `{"disk": {"path": "/dev/sda", "size": "20480MiB",
+			"model": "QEMU HARDDISK", "transport": "scsi", "logical-sector-size": 512,
+			"physical-sector-size": 512, "label": "gpt", "max-partitions": 128, "partitions": [
+				{"number": 1, "start": "1.00MiB", "end": "513MiB", "size": "512MiB", "type": "primary", "filesystem": "fat32"},
+				{"number": 2, "start": "513MiB", "end": "10240MiB", "size": "9727MiB", "type": "primary"},
+				{"number": 3, "start": "10240MiB", "end": "20479MiB", "size": "10239MiB", "type": "primary"}]}}`).
+		Expect("pvs --noheadings --units m --nosuffix --separator ,", "/dev/sda3,vos-var,lvm2,a--,10236.00,0").
+		ExpectError("pvs --noheadings --units m --nosuffix --separator ,", "", &util.ExitError{Code: 127, Stderr: "pvs: command not found"})
+	restore := fake.Install()
+	defer restore()
+
+	disks, err := disk.ListDisks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(disks) != 1 {
+		t.Fatalf("expected only /dev/sda to be listed, got %+v", disks)
+	}
+
+	sda := disks[0]
+	if sda.Serial != "QM0001" || sda.Removable || !sda.Rotational || sda.Model != "QEMU HARDDISK" || len(sda.Partitions) != 3 {
+		t.Errorf("unexpected disk %+v", sda)
+	}
+	if efi := sda.Partitions[0]; efi.Filesystem != disk.FAT32 || efi.PartLabel != "efi" || efi.FsUUID != "ABCD-1234" || !slices.Equal(efi.MountedAt, []string{"/boot/efi"}) {
+		t.Errorf("unexpected EFI partition %+v", efi)
+	}
+	if root := sda.Partitions[1]; !root.LUKS || !slices.Equal(root.MountedAt, []string{"/", "/home"}) {
+		t.Errorf("unexpected encrypted partition %+v", root)
+	}
+	if pv := sda.Partitions[2]; pv.VG != "vos-var" {
+		t.Errorf("expected %s to belong to vos-var, got %+v", pv.Path, pv)
+	}
+
+	// Disks are still listed if pvs fails, with no VG
+	disks, err = disk.ListDisks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv := disks[0].Partitions[2]; pv.VG != "" {
+		t.Errorf("expected %s to belong to no VG, got %+v", pv.Path, pv)
+	}
+}
+
+func TestAddUserDoesNotInterpolateArguments(t *testing.T) {
+	fake := exectest.New()
+	restore := fake.Install()
+	defer restore()
+
+	fullname := `Jane "$(reboot)" O'Neil`
+	password := `pa$$"word`
+	err := runPostInstallOperation(true, "adduser", []interface{}{"jane", fullname, []interface{}{"sudo"}, password})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"chroot /mnt/a useradd --shell /bin/bash jane",
+		`chroot /mnt/a usermod -c 'Jane "$(reboot)" O'\''Neil' jane`,
+		"chroot /mnt/a chpasswd",
+		"chroot /mnt/a usermod -a -G sudo jane",
+	}
+	if !slices.Equal(fake.Commands, expected) {
+		t.Errorf("expected commands %q, got %q", expected, fake.Commands)
+	}
+	if len(fake.Stdin) != 1 || fake.Stdin[0] != "jane:"+password+"\n" {
+		t.Errorf("password was not passed through stdin: %q", fake.Stdin)
+	}
+}
+
+func TestRunSelectedStages(t *testing.T) {
+	fake := exectest.New().
+		ExpectError("chroot /mnt/a sh -c false", "", &util.ExitError{Code: 1})
+
+	recipe := &Recipe{
+		PostInstallation: []PostStep{
+			{Chroot: true, Operation: "shell", Params: []interface{}{"echo skipped"}},
+			{Chroot: true, Operation: "shell", Params: []interface{}{"echo run"}},
+			{Chroot: true, Operation: "shell", Params: []interface{}{"false"}},
+		},
+		Executor: fake,
+	}
+
+	err := recipe.Run(RunOptions{Stages: []Stage{StagePost}, FromStep: 1, NoRollback: true})
+	var stageErr *StageError
+	if !errors.As(err, &stageErr) {
+		t.Fatalf("expected a StageError, got %v", err)
+	}
+	if stageErr.Stage != StagePost || stageErr.Step != 2 {
+		t.Errorf("expected failure at post[2], got %s[%d]", stageErr.Stage, stageErr.Step)
+	}
+
+	expected := []string{"chroot /mnt/a sh -c 'echo run'", "chroot /mnt/a sh -c false"}
+	if !slices.Equal(fake.Commands, expected) {
+		t.Errorf("expected commands %q, got %q", expected, fake.Commands)
+	}
+
+	for _, opts := range []RunOptions{
+		{Stages: []Stage{StagePost}, FromStep: 3},
+		{Stages: []Stage{StageMount, StagePost}, FromStep: 1},
+		{Stages: []Stage{"bogus"}},
+	} {
+		err := recipe.Run(opts)
+		if !errors.Is(err, ErrInvalidRunOptions) {
+			t.Errorf("expected invalid options error for %+v, got %v", opts, err)
+		}
+	}
+}
+
+func TestResumeContinuesFromFailedStep(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	fake := exectest.New().
+		ExpectError("chroot /mnt/a sh -c 'echo 2'", "", &util.ExitError{Code: 1})
+
+	recipe := &Recipe{
+		PostInstallation: []PostStep{
+			{Chroot: true, Operation: "shell", Params: []interface{}{"echo 0"}},
+			{Chroot: true, Operation: "shell", Params: []interface{}{"echo 1"}},
+			{Chroot: true, Operation: "shell", Params: []interface{}{"echo 2"}},
+			{Chroot: true, Operation: "shell", Params: []interface{}{"echo 3"}},
+		},
+		Executor: fake,
+	}
+
+	err := recipe.Run(RunOptions{Stages: []Stage{StagePost}, StatePath: statePath, NoRollback: true})
+	if err == nil {
+		t.Fatal("expected step 2 to fail")
+	}
+
+	state, err := LoadState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post := state.Stages[StagePost]; post.Completed || post.Steps != 2 {
+		t.Errorf("unexpected post stage state: %+v", post)
+	}
+
+	fake = exectest.New()
+	recipe.Executor = fake
+	err = recipe.Resume(RunOptions{StatePath: statePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"chroot /mnt/a sh -c 'echo 2'", "chroot /mnt/a sh -c 'echo 3'"}
+	if !slices.Equal(fake.Commands, expected) {
+		t.Errorf("expected commands %q, got %q", expected, fake.Commands)
+	}
+
+	state, err = LoadState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.Stages[StagePost].Completed {
+		t.Error("post stage was not marked as completed")
+	}
+
+	// A different recipe must not be resumed with this state
+	recipe.PostInstallation = recipe.PostInstallation[:1]
+	err = recipe.Resume(RunOptions{StatePath: statePath})
+	if !errors.Is(err, ErrStateMismatch) {
+		t.Errorf("expected ErrStateMismatch, got %v", err)
+	}
+
+	err = recipe.Resume(RunOptions{StatePath: filepath.Join(t.TempDir(), "missing.json")})
+	if !errors.Is(err, ErrNoState) {
+		t.Errorf("expected ErrNoState, got %v", err)
+	}
+}
+
+func TestResumeRestoresFreedRegion(t *testing.T) {
+	diskJson := func(diskPath, end string) string {
+		return fmt.Sprintf(`{"disk": {"path": %q, "size": "204800MiB",
+			"model": "QEMU HARDDISK", "transport": "scsi", "logical-sector-size": 512,
+			"physical-sector-size": 512, "label": "gpt", "max-partitions": 128, "partitions": [
+				{"number": 1, "start": "1.00MiB", "end": %q, "size": "102400MiB",
+				"type": "primary", "filesystem": "ntfs"}]}}`, diskPath, end)
+	}
+	newRecipe := func(diskPath string, fake *exectest.Fake) *Recipe {
+		return &Recipe{
+			Setup: []SetupStep{
+				{Disk: diskPath, Operation: "shrink-for-install", Params: []interface{}{float64(1), "-50GiB"}},
+				{Disk: diskPath, Operation: "mkpart", Params: []interface{}{"linux", "btrfs", "freed", "freed"}},
+			},
+			Installation: testInstallation,
+			Executor:     fake,
+		}
+	}
+
+	// The disk is listed as it was before shrinking, so mkpart fails
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	fake := exectest.New().
+		Expect("parted -sj /dev/sdb unit MiB print", diskJson("/dev/sdb", "102401MiB")).
+		Expect("lsblk -d -n -o FSTYPE /dev/sdb1", "ntfs")
+	err := newRecipe("/dev/sdb", fake).Run(RunOptions{Stages: []Stage{StageSetup}, StatePath: statePath, NoRollback: true})
+	if err == nil {
+		t.Fatal("expected mkpart to fail")
+	}
+
+	state, err := LoadState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := disk.FreeRegion{Start: util.MiBSize(51201), End: util.MiBSize(102401)}
+	if region, ok := state.Freed["/dev/sdb"]; !ok || region != expected {
+		t.Fatalf("expected the freed region %v to be saved, got %v", expected, state.Freed)
+	}
+
+	// A new process only knows about the freed region from the state
+	statePath = filepath.Join(t.TempDir(), "state.json")
+	created := strings.Replace(diskJson("/dev/sdc", "51201MiB"), `"filesystem": "ntfs"}`, `"filesystem": "ntfs"},
+				{"number": 2, "start": "51201MiB", "end": "102401MiB", "size": "51200MiB",
+				"type": "primary", "name": "linux"}`, 1)
+	fake = exectest.New().
+		Expect("parted -sj /dev/sdc unit MiB print", diskJson("/dev/sdc", "51201MiB")).
+		Expect("parted -sj /dev/sdc unit MiB print", created)
+	recipe := newRecipe("/dev/sdc", fake)
+	state, err = newState(recipe, []Stage{StageSetup})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.stage(StageSetup).Steps = 1
+	state.Freed = map[string]disk.FreeRegion{"/dev/sdc": expected}
+	err = (&checkpoint{path: statePath, state: state}).save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = recipe.Resume(RunOptions{StatePath: statePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkpart := "parted -s /dev/sdc unit MiB mkpart '\"linux\"' btrfs 51201 102401"
+	if !slices.Contains(fake.Commands, mkpart) {
+		t.Errorf("expected %q, got %q", mkpart, fake.Commands)
+	}
+}
+
+// inactiveVG is an executor for which the LVs of the volume group vg only
+// exist once it was activated, like after a rollback.
+type inactiveVG struct {
+	*exectest.Fake
+	active bool
+}
+
+func (e *inactiveVG) respond(cmd util.Command) error {
+	if cmd.String() == "vgchange -ay vg" {
+		e.active = true
+	}
+	if !e.active && strings.Contains(cmd.String(), "/dev/vg/") {
+		return &util.ExitError{Code: 32, Stderr: "not a block device"}
+	}
+	return nil
+}
+
+func (e *inactiveVG) Run(cmd util.Command) error {
+	if err := e.respond(cmd); err != nil {
+		return err
+	}
+	return e.Fake.Run(cmd)
+}
+
+func (e *inactiveVG) Output(cmd util.Command) (string, error) {
+	if err := e.respond(cmd); err != nil {
+		return "", err
+	}
+	return e.Fake.Output(cmd)
+}
+
+func TestResumeAfterRollbackReactivatesVG(t *testing.T) {
+	lvcreate := []SetupStep{
+		{Disk: "/dev/sda", Operation: "lvcreate", Params: []interface{}{"root", "vg", "linear", "rest"}, ID: "root"},
+	}
+
+	for _, root := range []string{"/dev/vg/root", "${part.root}"} {
+		statePath := filepath.Join(t.TempDir(), "state.json")
+		fake := exectest.New().
+			ExpectError("cryptsetup isLuks *", "", &util.ExitError{Code: 1}).
+			Expect("lsblk -d -n -o UUID /dev/vg/root", "1234")
+
+		recipe := &Recipe{
+			Setup:        lvcreate,
+			Mountpoints:  []Mountpoint{{Partition: root, Target: "/"}},
+			Installation: testInstallation,
+			Executor:     &inactiveVG{Fake: fake},
+		}
+
+		state, err := newState(recipe, []Stage{StageSetup, StageMount})
+		if err != nil {
+			t.Fatal(err)
+		}
+		state.stage(StageSetup).Completed = true
+		state.stage(StageSetup).Steps = len(lvcreate)
+		state.Partitions = []PartitionState{{Path: root, UUID: "1234", Target: "/"}}
+		state.Devices = map[string]string{"root": "/dev/vg/root"}
+		err = (&checkpoint{path: statePath, state: state}).save()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = recipe.Resume(RunOptions{StatePath: statePath})
+		if err != nil {
+			t.Fatalf("%s: %s", root, err)
+		}
+
+		activated := slices.Index(fake.Commands, "vgchange -ay vg")
+		checked := slices.Index(fake.Commands, "lsblk -d -n -o UUID /dev/vg/root")
+		if activated < 0 || checked < activated {
+			t.Errorf("%s: expected vg to be activated before checking its LVs, got %q", root, fake.Commands)
+		}
+		if !slices.Contains(fake.Commands, "mount -m /dev/vg/root /mnt/a/") {
+			t.Errorf("%s: expected the LV to be mounted, got %q", root, fake.Commands)
+		}
+	}
+}
+
+func TestRunRollsBackOnFailure(t *testing.T) {
+	fake := exectest.New().
+		ExpectError("cryptsetup isLuks *", "", &util.ExitError{Code: 1}).
+		ExpectError("unsquashfs *", "", &util.ExitError{Code: 1, Stderr: "no space left"}).
+		ExpectError("findmnt *", "", &util.ExitError{Code: 1})
+
+	recipe := &Recipe{
+		Mountpoints: []Mountpoint{
+			{Partition: "/dev/vg/root", Target: "/"},
+			{Partition: "/dev/vg/home", Target: "/home"},
+		},
+		Installation: Installation{Method: UNSQUASHFS, Source: "/cdrom/filesystem.squashfs"},
+		Executor:     fake,
+	}
+
+	err := recipe.Run(RunOptions{})
+	var stageErr *StageError
+	if !errors.As(err, &stageErr) || stageErr.Stage != StageInstall {
+		t.Fatalf("expected the install stage to fail, got %v", err)
+	}
+
+	// Nested mounts must be undone first
+	failed := slices.IndexFunc(fake.Commands, func(c string) bool { return strings.HasPrefix(c, "unsquashfs") })
+	rollback := fake.Commands[failed+1:]
+	expected := []string{"umount /mnt/a/home", "umount /mnt/a/"}
+	if len(rollback) < 2 || !slices.Equal(rollback[:2], expected) {
+		t.Errorf("expected rollback to start with %q, got %q", expected, rollback)
+	}
+	if pending := util.PendingCleanups(); len(pending) != 0 {
+		t.Errorf("cleanups left after rollback: %q", pending)
+	}
+}
+
+func TestRunReportsEvents(t *testing.T) {
+	fake := exectest.New().
+		ExpectError("chroot /mnt/a sh -c false", "", &util.ExitError{Code: 1, Stderr: "failed"})
+
+	events := []string{}
+	recipe := &Recipe{
+		PostInstallation: []PostStep{
+			{Chroot: true, Operation: "shell", Params: []interface{}{"true"}},
+			{Chroot: true, Operation: "shell", Params: []interface{}{"false"}},
+		},
+		Executor: fake,
+		OnEvent: func(event Event) {
+			events = append(events, fmt.Sprintf("%s %s[%d/%d]", event.Type, event.Stage, event.Step, event.Steps))
+		},
+	}
+
+	_ = recipe.Run(RunOptions{Stages: []Stage{StagePost}, NoRollback: true})
+	expected := []string{
+		"stage-started post[-1/2]",
+		"step-started post[0/2]",
+		"log post[0/2]",
+		"step-finished post[0/2]",
+		"step-started post[1/2]",
+		"log post[1/2]",
+		"step-failed post[1/2]",
+		"stage-failed post[-1/2]",
+	}
+	if !slices.Equal(events, expected) {
+		t.Errorf("expected events %q, got %q", expected, events)
+	}
+}
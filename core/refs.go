@@ -0,0 +1,206 @@
+package albius
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/vanilla-os/albius/core/disk"
+)
+
+// refExpr matches references to the device created by a setup step with an
+// id (see SetupStep.ID), e.g. ${part.root_a} or ${part.root_a.uuid}
+var refExpr = regexp.MustCompile(`\$\{part\.([^.}]*)(?:\.([^}]*))?\}`)
+
+// idExpr matches the ids which can be given to setup steps
+var idExpr = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// refFields are what a reference can resolve to: the device's path, which
+// is the default, its UUID or the path of its opened LUKS mapping
+var refFields = []string{"path", "uuid", "mapper"}
+
+// idOperations are the setup operations which can be given an id
+var idOperations = []string{"mkpart", "lvcreate", "luks-format"}
+
+// refResolver returns field (one of refFields) of the device created by the
+// step with id.
+type refResolver func(id, field string) (string, error)
+
+// expandRefs returns value, a recipe parameter, with its references replaced
+// by what resolve returns for them. References are either ${part.ID} or
+// ${part.ID.FIELD} anywhere in a string, or an object like
+// {"ref": "ID", "field": "FIELD"} in place of the whole parameter. Lists are
+// expanded recursively. If some reference cannot be resolved, the first error
+// is returned along with value, where only the references which could be
+// resolved are replaced.
+func expandRefs(value any, resolve refResolver) (any, error) {
+	switch v := value.(type) {
+	case string:
+		var err error
+		expanded := refExpr.ReplaceAllStringFunc(v, func(ref string) string {
+			match := refExpr.FindStringSubmatch(ref)
+			resolved, resolveErr := resolveRef(match[1], match[2], resolve)
+			if resolveErr != nil {
+				if err == nil {
+					err = resolveErr
+				}
+				return ref
+			}
+			return resolved
+		})
+		return expanded, err
+	case map[string]interface{}:
+		id, field, isRef, err := objectRef(v)
+		if !isRef || err != nil {
+			return value, err
+		}
+		resolved, err := resolveRef(id, field, resolve)
+		if err != nil {
+			return value, err
+		}
+		return resolved, nil
+	case []interface{}:
+		var err error
+		expanded := make([]interface{}, len(v))
+		for i, item := range v {
+			var itemErr error
+			expanded[i], itemErr = expandRefs(item, resolve)
+			if itemErr != nil && err == nil {
+				err = itemErr
+			}
+		}
+		return expanded, err
+	}
+
+	return value, nil
+}
+
+// objectRef reads a reference written as an object. Objects without a "ref"
+// key are other parameters (e.g. layout policies) and left alone.
+func objectRef(obj map[string]interface{}) (string, string, bool, error) {
+	refValue, ok := obj["ref"]
+	if !ok {
+		return "", "", false, nil
+	}
+
+	id, ok := refValue.(string)
+	if !ok {
+		return "", "", true, fmt.Errorf("invalid reference %v: ref must be a string", obj)
+	}
+	field := ""
+	for key, value := range obj {
+		switch key {
+		case "ref":
+		case "field":
+			field, ok = value.(string)
+			if !ok {
+				return "", "", true, fmt.Errorf("invalid reference to %s: field must be a string", id)
+			}
+		default:
+			return "", "", true, fmt.Errorf("invalid reference to %s: unknown key %q", id, key)
+		}
+	}
+
+	return id, field, true, nil
+}
+
+func resolveRef(id, field string, resolve refResolver) (string, error) {
+	if field == "" {
+		field = "path"
+	}
+	if !slices.Contains(refFields, field) {
+		return "", fmt.Errorf("invalid reference to %s: unknown field %q, expected one of %s", id, field, strings.Join(refFields, ", "))
+	}
+
+	return resolve(id, field)
+}
+
+// expandParams expands the references in every parameter of a step.
+func expandParams(params []interface{}, resolve refResolver) ([]interface{}, error) {
+	if params == nil {
+		return nil, nil
+	}
+
+	expanded, err := expandRefs(params, resolve)
+	return expanded.([]interface{}), err
+}
+
+// resolveRef returns field of the device created by the setup step with id.
+// Devices are recorded when their step runs. If it ran in a previous run,
+// the device is found from the step's parameters instead: partitions
+// created by mkpart by their name, LVs by their path and partitions
+// formatted by luks-format by their number.
+func (recipe *Recipe) resolveRef(id, field string) (string, error) {
+	path, ok := recipe.devices[id]
+	if !ok {
+		idx := slices.IndexFunc(recipe.Setup, func(step SetupStep) bool { return step.ID == id })
+		if idx < 0 {
+			return "", fmt.Errorf("no setup step has id %q", id)
+		}
+
+		var err error
+		path, err = stepDevice(recipe.Setup[idx])
+		if err != nil {
+			return "", fmt.Errorf("failed to find the device of %s: %s", id, err)
+		}
+	}
+
+	switch field {
+	case "uuid":
+		return disk.GetUUIDByPath(path)
+	case "mapper":
+		part := disk.Partition{Path: path}
+		return part.GetLUKSMapperPath()
+	default:
+		return path, nil
+	}
+}
+
+// stepDevice finds the device created by step when it is not recorded.
+func stepDevice(step SetupStep) (string, error) {
+	switch step.Operation {
+	case "mkpart":
+		name, _ := step.Params[0].(string)
+		return disk.ResolveDevice("PARTLABEL=" + name)
+	case "lvcreate":
+		return fmt.Sprintf("/dev/%s/%s", step.Params[1], step.Params[0]), nil
+	case "luks-format":
+		partNum, err := jsonFieldToInt(step.Params[0])
+		if err != nil {
+			return "", err
+		}
+		diskPath, err := disk.ResolveDevice(step.Disk)
+		if err != nil {
+			return "", err
+		}
+		return partitionPath(diskPath, partNum), nil
+	default:
+		return "", fmt.Errorf("operation %s cannot have an id", step.Operation)
+	}
+}
+
+// setDevice records the device created by the setup step with id, saving it
+// along with the run's progress so resumed runs find it too.
+func (recipe *Recipe) setDevice(id, path string) {
+	if recipe.devices == nil {
+		recipe.devices = map[string]string{}
+	}
+	recipe.devices[id] = path
+
+	if recipe.checkpoint != nil {
+		recipe.checkpoint.state.Devices = maps.Clone(recipe.devices)
+	}
+}
+
+// resolveDevice resolves the references to setup steps in ref, and then the
+// device reference itself (see disk.ResolveDevice).
+func (recipe *Recipe) resolveDevice(ref string) (string, error) {
+	expanded, err := expandRefs(ref, recipe.resolveRef)
+	if err != nil {
+		return "", err
+	}
+
+	return disk.ResolveDevice(expanded.(string))
+}
@@ -0,0 +1,287 @@
+package albius
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+
+	"github.com/vanilla-os/albius/core/disk"
+	luks "github.com/vanilla-os/albius/core/disk/luks"
+	"github.com/vanilla-os/albius/core/util"
+)
+
+// Stage is one of the sections of a recipe, which are always run in the
+// order listed in Stages.
+type Stage string
+
+const (
+	StageSetup   Stage = "setup"
+	StageMount   Stage = "mount"
+	StageInstall Stage = "install"
+	StagePost    Stage = "post"
+)
+
+// Stages lists every stage in the order they are run.
+var Stages = []Stage{StageSetup, StageMount, StageInstall, StagePost}
+
+// ParseStage returns the Stage named name.
+func ParseStage(name string) (Stage, error) {
+	stage := Stage(name)
+	if !slices.Contains(Stages, stage) {
+		return "", fmt.Errorf("unknown stage %q, expected one of %v", name, Stages)
+	}
+
+	return stage, nil
+}
+
+// StageError is returned when a stage fails. Step is the index of the
+// failed step inside the stage, or -1 if the stage has no steps.
+type StageError struct {
+	Stage Stage
+	Step  int
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return util.MaskSecrets(e.Err.Error())
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// ErrInvalidRunOptions is returned by Recipe.Run when the options cannot be
+// applied to the recipe.
+var ErrInvalidRunOptions = errors.New("invalid run options")
+
+// RunOptions selects which parts of a recipe Recipe.Run executes.
+type RunOptions struct {
+	// Stages to run. If empty, every stage is run.
+	Stages []Stage
+	// FromStep skips the steps before this index in the first selected
+	// stage, which must be either StageSetup or StagePost. Indices are the
+	// same reported by Validate, Plan and StageError.
+	FromStep int
+	// StatePath is the file progress is saved to, if not empty. See Resume.
+	StatePath string
+	// NoRollback leaves everything mounted and open when a stage fails,
+	// instead of calling Teardown.
+	NoRollback bool
+}
+
+// stepCount returns the number of steps in stage, or -1 if it does not
+// have separate steps.
+func (recipe *Recipe) stepCount(stage Stage) int {
+	switch stage {
+	case StageSetup:
+		return len(recipe.Setup)
+	case StagePost:
+		return len(recipe.PostInstallation)
+	default:
+		return -1
+	}
+}
+
+// Run executes the stages selected in opts, in order. It is equivalent to
+// calling RunSetup, SetupMountpoints, Install and RunPostInstall, except
+// that failures are reported as a *StageError.
+//
+// If opts.StatePath is set, progress is saved to it after every step, so
+// that an interrupted run can be continued with Resume. Unless
+// opts.NoRollback is set, a failure reverts every mount, LUKS mapping and
+// volume group activation made so far (see Teardown) before returning.
+func (recipe *Recipe) Run(opts RunOptions) error {
+	defer recipe.use()()
+
+	stages := []Stage{}
+	for _, stage := range Stages {
+		if len(opts.Stages) == 0 || slices.Contains(opts.Stages, stage) {
+			stages = append(stages, stage)
+		}
+	}
+	for _, stage := range opts.Stages {
+		if !slices.Contains(Stages, stage) {
+			return fmt.Errorf("%w: unknown stage %q", ErrInvalidRunOptions, stage)
+		}
+	}
+
+	if opts.FromStep != 0 {
+		count := recipe.stepCount(stages[0])
+		if count < 0 {
+			return fmt.Errorf("%w: stage %s has no steps to start from", ErrInvalidRunOptions, stages[0])
+		}
+		if opts.FromStep < 0 || opts.FromStep >= count {
+			return fmt.Errorf("%w: stage %s has %d steps, cannot start from step %d", ErrInvalidRunOptions, stages[0], count, opts.FromStep)
+		}
+	}
+
+	runs := make([]stageRun, 0, len(stages))
+	for i, stage := range stages {
+		run := stageRun{stage: stage}
+		if i == 0 {
+			run.from = opts.FromStep
+		}
+		runs = append(runs, run)
+	}
+
+	// Devices of steps which are skipped are found when referenced
+	recipe.devices = nil
+	recipe.detectedFacts = nil
+
+	// Facts are detected before any step can change them, e.g. by erasing
+	// an existing OS
+	err := recipe.detectFacts()
+	if err != nil {
+		return err
+	}
+
+	if opts.StatePath != "" {
+		state, err := newState(recipe, stages)
+		if err != nil {
+			return err
+		}
+		state.Facts = recipe.detectedFacts
+		// Steps skipped with FromStep are assumed to be done
+		if opts.FromStep > 0 {
+			state.stage(stages[0]).Steps = opts.FromStep
+		}
+		recipe.checkpoint = &checkpoint{path: opts.StatePath, state: state}
+		defer func() { recipe.checkpoint = nil }()
+
+		err = recipe.checkpoint.save()
+		if err != nil {
+			return err
+		}
+	}
+
+	return recipe.runStages(runs, opts.NoRollback)
+}
+
+// stageRun is a stage to be run, starting at step from.
+type stageRun struct {
+	stage Stage
+	from  int
+}
+
+func (recipe *Recipe) runStages(runs []stageRun, noRollback bool) error {
+	err := recipe.runStagesOnce(runs)
+	if err == nil || noRollback {
+		return err
+	}
+
+	util.Logf("Rolling back after failure")
+	rollbackErr := recipe.teardown()
+	if rollbackErr == nil {
+		return err
+	}
+
+	var stageErr *StageError
+	errors.As(err, &stageErr)
+	stageErr.Err = errors.Join(stageErr.Err, fmt.Errorf("rollback failed: %w", rollbackErr))
+	return stageErr
+}
+
+func (recipe *Recipe) runStagesOnce(runs []stageRun) error {
+	for _, run := range runs {
+		recipe.emit(recipe.stageEvent(EventStageStarted, run.stage, nil))
+
+		var err error
+		switch run.stage {
+		case StageSetup:
+			err = recipe.runSetup(run.from)
+		case StageMount:
+			err = recipe.setupMountpoints()
+		case StageInstall:
+			err = recipe.install()
+		case StagePost:
+			err = recipe.runPostInstall(run.from)
+		}
+		if err == nil {
+			err = recipe.stageDone(run.stage)
+		}
+		if err != nil {
+			recipe.emit(recipe.stageEvent(EventStageFailed, run.stage, err))
+
+			var stageErr *StageError
+			if errors.As(err, &stageErr) {
+				return err
+			}
+			return &StageError{Stage: run.stage, Step: -1, Err: err}
+		}
+
+		recipe.emit(recipe.stageEvent(EventStageFinished, run.stage, nil))
+	}
+
+	return nil
+}
+
+// Teardown reverts every mount, LUKS mapping and volume group activation
+// registered with util.AddCleanup while applying the recipe, in reverse
+// order. It then unmounts anything still mounted under RootA and RootB and
+// closes the LUKS mappings for the recipe's mountpoints, which covers runs
+// made by another process. Afterwards a failed installation can be retried
+// from a clean state.
+//
+// Errors are collected, and every action is attempted regardless of
+// previous failures.
+func (recipe *Recipe) Teardown() error {
+	defer recipe.use()()
+
+	return recipe.teardown()
+}
+
+func (recipe *Recipe) teardown() error {
+	errs := []error{}
+
+	// Undo everything this process did, in reverse order
+	err := util.RunCleanups()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	// Anything left was done by a previous process, e.g. when the CLI is
+	// called again after a failed run
+	for _, root := range []string{RootB, RootA} {
+		// findmnt exits with status 1 if root is not a mountpoint
+		_, err := util.OutputCommand("findmnt", "-n", root)
+		if err != nil {
+			continue
+		}
+
+		err = util.RunCommand("umount", "-R", root)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to unmount %s: %s", root, err))
+		}
+	}
+
+	for _, mnt := range recipe.mountpoints() {
+		path, err := recipe.resolveDevice(mnt.Partition)
+		if err != nil {
+			continue
+		}
+		part := disk.Partition{Path: path}
+		isLuks, err := luks.IsLuks(&part)
+		if err != nil || !isLuks {
+			continue
+		}
+
+		mapperPath, err := part.GetLUKSMapperPath()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		_, err = util.OutputCommand("cryptsetup", "status", filepath.Base(mapperPath))
+		if err != nil { // Mapping is not open
+			continue
+		}
+
+		err = luks.LuksClose(filepath.Base(mapperPath))
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,380 @@
+package albius
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/vanilla-os/albius/core/disk"
+	luks "github.com/vanilla-os/albius/core/disk/luks"
+	"github.com/vanilla-os/albius/core/lvm"
+	"github.com/vanilla-os/albius/core/util"
+)
+
+// DefaultStatePath is where the CLI saves progress by default. /run is
+// cleared on reboot, which also invalidates any mounts and LUKS mappings a
+// resumed run could rely on.
+const DefaultStatePath = "/run/albius/state.json"
+
+var (
+	// ErrNoState is returned by Resume when there is no state file.
+	ErrNoState = errors.New("no saved state to resume from")
+	// ErrStateMismatch is returned by Resume when the saved state does not
+	// belong to the recipe or the disks changed since it was saved.
+	ErrStateMismatch = errors.New("saved state does not match")
+)
+
+// StageState is the progress of a single stage.
+type StageState struct {
+	// Completed is set once every step in the stage succeeded
+	Completed bool `json:"completed"`
+	// Steps is the number of steps which succeeded, always counting from
+	// the start of the stage
+	Steps int `json:"steps"`
+}
+
+// PartitionState records a partition used by the recipe's mountpoints as
+// it was after the setup stage.
+type PartitionState struct {
+	Path   string `json:"path"`
+	UUID   string `json:"uuid"`
+	Target string `json:"target"`
+}
+
+// State is the progress of a recipe run, saved after every step so that
+// Resume can continue from where the run stopped.
+type State struct {
+	// Recipe is a hash of the recipe the state belongs to
+	Recipe string `json:"recipe"`
+	// Selected lists the stages the run was asked to execute
+	Selected   []Stage               `json:"selected"`
+	Stages     map[Stage]*StageState `json:"stages"`
+	Partitions []PartitionState      `json:"partitions,omitempty"`
+	// Devices holds the device created by each setup step with an id
+	Devices map[string]string `json:"devices,omitempty"`
+	// Freed holds the region freed by shrink-for-install on each disk, by
+	// the disk reference of the step
+	Freed map[string]disk.FreeRegion `json:"freed,omitempty"`
+	// Facts are those the steps' conditions were tested against, which
+	// resumed runs reuse since the steps already run may have changed them
+	Facts     *Facts    `json:"facts,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func recipeHash(recipe *Recipe) (string, error) {
+	content, err := json.Marshal(recipe)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash recipe: %s", err)
+	}
+
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+func newState(recipe *Recipe, selected []Stage) (*State, error) {
+	hash, err := recipeHash(recipe)
+	if err != nil {
+		return nil, err
+	}
+
+	return &State{
+		Recipe:   hash,
+		Selected: selected,
+		Stages:   map[Stage]*StageState{},
+	}, nil
+}
+
+func (state *State) stage(stage Stage) *StageState {
+	if state.Stages[stage] == nil {
+		state.Stages[stage] = &StageState{}
+	}
+
+	return state.Stages[stage]
+}
+
+// LoadState reads the state file at path.
+func LoadState(path string) (*State, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s does not exist", ErrNoState, path)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read state: %s", err)
+	}
+
+	state := &State{}
+	err = json.Unmarshal(content, state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state: %s", err)
+	}
+	if state.Stages == nil {
+		state.Stages = map[Stage]*StageState{}
+	}
+
+	return state, nil
+}
+
+// checkpoint saves the state of a run to path whenever progress is made.
+type checkpoint struct {
+	path  string
+	state *State
+}
+
+func (c *checkpoint) save() error {
+	c.state.UpdatedAt = time.Now().UTC()
+	content, err := json.MarshalIndent(c.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to save state: %s", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(c.path), 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to save state: %s", err)
+	}
+
+	// Write to a temporary file first so an interruption never leaves a
+	// truncated state behind
+	tmpPath := c.path + ".tmp"
+	err = os.WriteFile(tmpPath, content, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to save state: %s", err)
+	}
+	err = os.Rename(tmpPath, c.path)
+	if err != nil {
+		return fmt.Errorf("failed to save state: %s", err)
+	}
+
+	return nil
+}
+
+// stepDone records that step of stage succeeded.
+func (recipe *Recipe) stepDone(stage Stage, step int) error {
+	if recipe.checkpoint == nil {
+		return nil
+	}
+
+	recipe.checkpoint.state.stage(stage).Steps = step + 1
+	return recipe.checkpoint.save()
+}
+
+// resolvedUUID returns the UUID of the device ref refers to. Partitions are
+// recorded by reference, so resuming works even if the kernel names of the
+// disks changed since the first run.
+func (recipe *Recipe) resolvedUUID(ref string) (string, error) {
+	path, err := recipe.resolveDevice(ref)
+	if err != nil {
+		return "", err
+	}
+
+	return disk.GetUUIDByPath(path)
+}
+
+// saveFreedRegion records the region freed by shrink-for-install on the
+// disk referenced by diskRef along with the run's progress, so later mkpart
+// steps of resumed runs can still refer to it.
+func (recipe *Recipe) saveFreedRegion(diskRef string) error {
+	if recipe.checkpoint == nil {
+		return nil
+	}
+
+	diskPath, err := disk.ResolveDevice(diskRef)
+	if err != nil {
+		return err
+	}
+	region, ok := disk.FreedRegion(diskPath)
+	if !ok {
+		return nil
+	}
+
+	state := recipe.checkpoint.state
+	if state.Freed == nil {
+		state.Freed = map[string]disk.FreeRegion{}
+	}
+	state.Freed[diskRef] = region
+	return nil
+}
+
+// stageDone records that every step of stage succeeded. After the setup
+// stage, the partitions used by the mountpoints are recorded as well so
+// Resume can make sure it is working on the same disks.
+func (recipe *Recipe) stageDone(stage Stage) error {
+	if recipe.checkpoint == nil {
+		return nil
+	}
+
+	state := recipe.checkpoint.state
+	if stage == StageSetup {
+		state.Partitions = []PartitionState{}
+		for _, mnt := range recipe.mountpoints() {
+			uuid, err := recipe.resolvedUUID(mnt.Partition)
+			if err != nil {
+				return err
+			}
+			state.Partitions = append(state.Partitions, PartitionState{
+				Path:   mnt.Partition,
+				UUID:   uuid,
+				Target: mnt.Target,
+			})
+		}
+	}
+
+	state.stage(stage).Completed = true
+	if count := recipe.stepCount(stage); count >= 0 {
+		state.stage(stage).Steps = count
+	}
+
+	return recipe.checkpoint.save()
+}
+
+// Resume continues a run interrupted by a failure, using the state Run saved
+// to opts.StatePath. Completed setup steps are not repeated, so the disks are
+// not wiped again, the mountpoints are set up again if anything after them
+// is left, and the run continues from the step which failed. Volume groups
+// and LUKS containers closed by a rollback are opened again first, and the
+// regions freed by shrink-for-install are restored.
+//
+// opts.Stages and opts.FromStep must not be set, as they are taken from the
+// state. ErrNoState is returned if there is no state, and ErrStateMismatch
+// if the recipe or the partitions it uses changed since the state was saved.
+func (recipe *Recipe) Resume(opts RunOptions) error {
+	defer recipe.use()()
+
+	if len(opts.Stages) > 0 || opts.FromStep != 0 {
+		return fmt.Errorf("%w: stages and steps to resume are read from the state", ErrInvalidRunOptions)
+	}
+	statePath := opts.StatePath
+	if statePath == "" {
+		return fmt.Errorf("%w: no state path given", ErrInvalidRunOptions)
+	}
+
+	state, err := LoadState(statePath)
+	if err != nil {
+		return err
+	}
+
+	hash, err := recipeHash(recipe)
+	if err != nil {
+		return err
+	}
+	if hash != state.Recipe {
+		return fmt.Errorf("%w: the recipe changed since %s was saved", ErrStateMismatch, statePath)
+	}
+	recipe.devices = maps.Clone(state.Devices)
+	recipe.detectedFacts = state.Facts
+	for diskRef, region := range state.Freed {
+		diskPath, err := disk.ResolveDevice(diskRef)
+		if err != nil {
+			return err
+		}
+		disk.SetFreedRegion(diskPath, region)
+	}
+
+	// The partitions cannot be checked while their VG is inactive
+	recipe.reactivate()
+
+	for _, part := range state.Partitions {
+		uuid, err := recipe.resolvedUUID(part.Path)
+		if err != nil {
+			return err
+		}
+		if uuid != part.UUID {
+			return fmt.Errorf("%w: %s has UUID %q, expected %q", ErrStateMismatch, part.Path, uuid, part.UUID)
+		}
+	}
+
+	selected := state.Selected
+	if len(selected) == 0 {
+		selected = Stages
+	}
+
+	runs := []stageRun{}
+	for _, stage := range Stages {
+		if !slices.Contains(selected, stage) || state.stage(stage).Completed {
+			continue
+		}
+		runs = append(runs, stageRun{stage: stage, from: state.stage(stage).Steps})
+	}
+	if len(runs) == 0 {
+		util.Logf("Nothing to resume, every stage was completed")
+		return nil
+	}
+
+	// Everything after setup needs the target mounted. Mounting is
+	// idempotent, so do it even if the previous run already did.
+	if runs[0].stage == StageInstall || runs[0].stage == StagePost {
+		runs = append([]stageRun{{stage: StageMount}}, runs...)
+	}
+
+	recipe.checkpoint = &checkpoint{path: statePath, state: state}
+	defer func() { recipe.checkpoint = nil }()
+
+	return recipe.runStages(runs, opts.NoRollback)
+}
+
+// luksPasswords returns the passwords of every LUKS container created by
+// the setup steps.
+func (recipe *Recipe) luksPasswords() []string {
+	passwords := []string{}
+	for _, step := range recipe.Setup {
+		idx := -1
+		switch step.Operation {
+		case "mkpart":
+			idx = 4
+		case "auto-layout":
+			idx = 1
+		case "luks-format", "lvm-luks-format":
+			idx = 2
+		}
+		if idx < 0 || idx >= len(step.Params) {
+			continue
+		}
+
+		password, ok := step.Params[idx].(string)
+		if ok && password != "" && !slices.Contains(passwords, password) {
+			passwords = append(passwords, password)
+		}
+	}
+
+	return passwords
+}
+
+// reactivate activates the volume groups and opens the LUKS containers used
+// by the mountpoints, which a rollback deactivates and closes. This is best
+// effort, since the devices may not exist yet; mounting them reports any
+// problem left.
+func (recipe *Recipe) reactivate() {
+	passwords := recipe.luksPasswords()
+	for _, mnt := range recipe.mountpoints() {
+		// Mountpoints may refer to LVs through the ids of lvcreate steps
+		path, err := recipe.resolveDevice(mnt.Partition)
+		if err != nil {
+			continue
+		}
+		if match := lvmPathExpr.FindStringSubmatch(path); match != nil {
+			_ = lvm.Vgactivate(match[lvmPathExpr.SubexpIndex("vg")])
+		}
+
+		part := disk.Partition{Path: path}
+		isLuks, err := luks.IsLuks(&part)
+		if err != nil || !isLuks {
+			continue
+		}
+		uuid, err := part.GetUUID()
+		if err != nil {
+			continue
+		}
+
+		// The password is not known, so try every one in the recipe
+		for _, password := range passwords {
+			if luks.LuksTryOpen(&part, "luks-"+uuid, password) == nil {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/vanilla-os/albius/core/util"
+)
+
+// efiPlatformSizeFile holds the bitness of the UEFI firmware, which can be
+// 32 on 64-bit x86 machines
+const efiPlatformSizeFile = "/sys/firmware/efi/fw_platform_size"
+
+// efiPlatform describes how bootloaders boot with UEFI on an architecture.
+type efiPlatform struct {
+	grubTarget string
+	// shim is the first stage loader installed by grub-install
+	// --uefi-secure-boot, or empty if shim is not available
+	shim string
+	// grub is GRUB's EFI image, booted directly if there is no shim
+	grub string
+	// systemdBoot is systemd-boot's EFI image, installed by bootctl in
+	// \EFI\systemd
+	systemdBoot string
+}
+
+// efiPlatforms are the supported EFI architectures, see efiArch
+var efiPlatforms = map[string]efiPlatform{
+	"amd64":   {grubTarget: "x86_64-efi", shim: "shimx64.efi", grub: "grubx64.efi", systemdBoot: "systemd-bootx64.efi"},
+	"386":     {grubTarget: "i386-efi", shim: "shimia32.efi", grub: "grubia32.efi", systemdBoot: "systemd-bootia32.efi"},
+	"arm64":   {grubTarget: "arm64-efi", shim: "shimaa64.efi", grub: "grubaa64.efi", systemdBoot: "systemd-bootaa64.efi"},
+	"riscv64": {grubTarget: "riscv64-efi", grub: "grubriscv64.efi", systemdBoot: "systemd-bootriscv64.efi"},
+	"loong64": {grubTarget: "loongarch64-efi", grub: "grubloongarch64.efi", systemdBoot: "systemd-bootloongarch64.efi"},
+}
+
+// efiArch returns the architecture of the UEFI firmware, as a GOARCH. It is
+// the architecture of the system, except for 64-bit x86 machines with a
+// 32-bit UEFI.
+func efiArch() string {
+	arch := runtime.GOARCH
+	if arch == "amd64" {
+		size, err := os.ReadFile(efiPlatformSizeFile)
+		if err == nil && strings.TrimSpace(string(size)) == "32" {
+			arch = "386"
+		}
+	}
+
+	return arch
+}
+
+func getEFIPlatform() (efiPlatform, error) {
+	arch := efiArch()
+	platform, ok := efiPlatforms[arch]
+	if !ok {
+		return efiPlatform{}, fmt.Errorf("unsupported architecture for EFI: %s", arch)
+	}
+
+	return platform, nil
+}
+
+// bindChrootMounts bind mounts the API filesystems bootloader installers
+// need into targetRoot. Nothing is mounted if targetRoot is empty.
+func bindChrootMounts(targetRoot string) error {
+	if targetRoot == "" {
+		return nil
+	}
+
+	requiredBinds := []string{"/dev", "/dev/pts", "/proc", "/sys", "/run"}
+	for _, bind := range requiredBinds {
+		targetBind := filepath.Join(targetRoot, bind)
+		err := util.RunCommand("mount", "--bind", bind, targetBind)
+		if err != nil {
+			return fmt.Errorf("failed to mount %s to %s: %s", bind, targetRoot, err)
+		}
+		util.AddCleanup("mount:"+targetBind, "unmount "+targetBind, func() error {
+			return util.RunCommand("umount", targetBind)
+		})
+	}
+
+	return nil
+}
+
+// CreateEFIBootEntry adds a boot entry named label to the firmware, loading
+// loader (e.g. \EFI\vanilla\shimx64.efi) from the EFI partition efiDevice.
+func CreateEFIBootEntry(efiDevice, label, loader string) error {
+	diskName, part := util.SeparateDiskPart(efiDevice)
+	if part == "" {
+		return fmt.Errorf("%s is not a partition", efiDevice)
+	}
+
+	err := util.RunCommand("efibootmgr", "--create",
+		"--disk="+diskName,
+		"--part="+part,
+		"--label="+label,
+		"--loader="+loader,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to run efibootmgr: %s", err)
+	}
+
+	return nil
+}
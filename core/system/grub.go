@@ -6,46 +6,90 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 
+	"github.com/vanilla-os/albius/core/disk"
 	"github.com/vanilla-os/albius/core/util"
 )
 
 type GrubConfig map[string]string
 
-func GetGrubTarget(target string) (string, error) {
-	var grubTarget string
+// Firmware types RunGrubInstall accepts besides disk.EFI and disk.BIOS
+const (
+	// FirmwareAuto is the firmware the running system booted with, see
+	// disk.DetectFirmware
+	FirmwareAuto = "auto"
+)
+
+// ResolveFirmware returns the firmware target stands for, which is either
+// "bios", "efi" or FirmwareAuto.
+func ResolveFirmware(target string) (disk.Firmware, error) {
 	switch target {
-	case "bios":
-		grubTarget = "i386-pc"
-	case "efi":
-		arch := runtime.GOARCH
-		switch arch {
-		case "amd64":
-			grubTarget = "x86_64-efi"
-		case "arm64":
-			grubTarget = "arm64-efi"
-		default:
-			return "", fmt.Errorf("unsupported architecture: %s", arch)
-		}
+	case string(disk.BIOS), string(disk.EFI):
+		return disk.Firmware(target), nil
+	case FirmwareAuto:
+		return disk.DetectFirmware(), nil
 	default:
 		return "", fmt.Errorf("unrecognized firmware type: %s", target)
 	}
-	return grubTarget, nil
 }
 
+// GetGrubTarget returns the GRUB target for firmware target (see
+// ResolveFirmware) on the running system's architecture.
+func GetGrubTarget(target string) (string, error) {
+	firmware, err := ResolveFirmware(target)
+	if err != nil {
+		return "", err
+	}
+
+	if firmware == disk.BIOS {
+		if runtime.GOARCH != "amd64" && runtime.GOARCH != "386" {
+			return "", fmt.Errorf("unsupported architecture for BIOS: %s", runtime.GOARCH)
+		}
+		return "i386-pc", nil
+	}
+
+	platform, err := getEFIPlatform()
+	if err != nil {
+		return "", err
+	}
+	return platform.grubTarget, nil
+}
+
+// GetEFIBootloaderFile returns the file EFI boot entries must load: shim if
+// it is available on the architecture, GRUB otherwise.
 func GetEFIBootloaderFile() (string, error) {
-	arch := runtime.GOARCH
-	var bootloaderFile string
-	switch arch {
-	case "amd64":
-		bootloaderFile = "shimx64.efi"
-	case "arm64":
-		bootloaderFile = "shimaa64.efi"
-	default:
-		return "", fmt.Errorf("unsupported architecture: %s", arch)
+	platform, err := getEFIPlatform()
+	if err != nil {
+		return "", err
+	}
+
+	if platform.shim != "" {
+		return platform.shim, nil
+	}
+	return platform.grub, nil
+}
+
+// CheckBIOSBootPartition returns an error if GRUB cannot be installed on
+// diskPath for BIOS, which on GPT disks requires a partition with the
+// bios_grub flag.
+func CheckBIOSBootPartition(diskPath string) error {
+	target, err := disk.LocateDisk(diskPath)
+	if err != nil {
+		return err
+	}
+	if target.Label != disk.GPT {
+		return nil
+	}
+
+	for _, part := range target.Partitions {
+		if slices.Contains(part.Flags, "bios_grub") {
+			return nil
+		}
 	}
-	return bootloaderFile, nil
+
+	return fmt.Errorf("%s has a GPT partition table but no partition with the bios_grub flag, which GRUB needs to boot with BIOS", diskPath)
 }
 
 func GetGrubConfig(targetRoot string) (GrubConfig, error) {
@@ -82,7 +126,7 @@ func WriteGrubConfig(targetRoot string, config GrubConfig) error {
 	}
 
 	targetRootGrubFile := filepath.Join(targetRoot, "/etc/default/grub")
-	err := os.WriteFile(targetRootGrubFile, fileContents, 0o644)
+	err := util.WriteFile(targetRootGrubFile, fileContents, 0o644)
 	if err != nil {
 		return fmt.Errorf("failed to write GRUB config file: %s", err)
 	}
@@ -102,7 +146,7 @@ func AddGrubScript(targetRoot, scriptPath string) error {
 	}
 
 	targetRootPath := filepath.Join(targetRoot, "/etc/grub.d", filepath.Base(scriptPath))
-	err = os.WriteFile(targetRootPath, contents, 0o755) // Grub expects script to be executable
+	err = util.WriteFile(targetRootPath, contents, 0o755) // Grub expects script to be executable
 	if err != nil {
 		return fmt.Errorf("failed to writing GRUB script to %s: %s", targetRootPath, err)
 	}
@@ -113,61 +157,72 @@ func AddGrubScript(targetRoot, scriptPath string) error {
 func RemoveGrubScript(targetRoot, scriptName string) error {
 	targetRootPath := filepath.Join(targetRoot, "/etc/grub.d", scriptName)
 
-	// Ensure script exists
-	if _, err := os.Stat(targetRootPath); os.IsNotExist(err) {
+	err := util.RemoveFile(targetRootPath)
+	if os.IsNotExist(err) {
 		return fmt.Errorf("error removing GRUB script: %s does not exist", targetRootPath)
-	}
-
-	err := os.Remove(targetRootPath)
-	if err != nil {
+	} else if err != nil {
 		return fmt.Errorf("error removing GRUB script: %s", err)
 	}
 
 	return nil
 }
 
+// RunGrubInstall installs GRUB on diskPath for firmware target (see
+// ResolveFirmware). EFI installations, unless removable, also get a boot
+// entry loading from the EFI partition efiDevice.
 func RunGrubInstall(targetRoot, bootDirectory, diskPath string, target string, entryName string, removable bool, efiDevice ...string) error {
-	// Mount necessary targets for chroot
-	if targetRoot != "" {
-		requiredBinds := []string{"/dev", "/dev/pts", "/proc", "/sys", "/run"}
-		for _, bind := range requiredBinds {
-			targetBind := filepath.Join(targetRoot, bind)
-			err := util.RunCommand(fmt.Sprintf("mount --bind %s %s", bind, targetBind))
-			if err != nil {
-				return fmt.Errorf("failed to mount %s to %s: %s", bind, targetRoot, err)
-			}
+	firmware, err := ResolveFirmware(target)
+	if err != nil {
+		return err
+	}
+	if firmware == disk.BIOS {
+		err = CheckBIOSBootPartition(diskPath)
+		if err != nil {
+			return err
 		}
 	}
 
-	grubInstallCmd := "grub-install --no-nvram %s --bootloader-id=%s --boot-directory %s --target=%s --uefi-secure-boot %s"
+	err = bindChrootMounts(targetRoot)
+	if err != nil {
+		return err
+	}
 
-	removableStr := ""
+	grubInstallArgs := []string{"--no-nvram"}
 	if removable {
-		removableStr = "--removable"
+		grubInstallArgs = append(grubInstallArgs, "--removable")
 	}
 
-	grubTarget, err := GetGrubTarget(target)
+	grubTarget, err := GetGrubTarget(string(firmware))
 	if err != nil {
 		return err
 	}
 
-	command := fmt.Sprintf(grubInstallCmd, removableStr, entryName, bootDirectory, grubTarget, diskPath)
-
-	if targetRoot != "" {
-		err = util.RunInChroot(targetRoot, command)
-	} else {
-		err = util.RunCommand(command)
+	grubInstallArgs = append(grubInstallArgs,
+		"--bootloader-id="+entryName,
+		"--boot-directory", bootDirectory,
+		"--target="+grubTarget,
+	)
+	// Architectures without shim have no signed GRUB either. The platform
+	// was already checked by GetGrubTarget.
+	secureBoot := true
+	if firmware == disk.EFI {
+		platform, _ := getEFIPlatform()
+		secureBoot = platform.shim != ""
+	}
+	if secureBoot {
+		grubInstallArgs = append(grubInstallArgs, "--uefi-secure-boot")
 	}
+	grubInstallArgs = append(grubInstallArgs, diskPath)
+
+	err = util.RunInChroot(targetRoot, "grub-install", grubInstallArgs...)
 	if err != nil {
 		return fmt.Errorf("failed to run grub-install: %s", err)
 	}
 
-	if !removable && target == "efi" {
-		efibootmgrCmd := "efibootmgr --create --disk=%s --part=%s --label=%s --loader=\"\\EFI\\%s\\%s\""
+	if !removable && firmware == disk.EFI {
 		if len(efiDevice) == 0 || efiDevice[0] == "" {
 			return errors.New("EFI device was not specified")
 		}
-		diskName, part := util.SeparateDiskPart(efiDevice[0])
 
 		var bootloaderFile string
 		bootloaderFile, err = GetEFIBootloaderFile()
@@ -175,9 +230,9 @@ func RunGrubInstall(targetRoot, bootDirectory, diskPath string, target string, e
 			return err
 		}
 
-		err = util.RunCommand(fmt.Sprintf(efibootmgrCmd, diskName, part, entryName, entryName, bootloaderFile))
+		err = CreateEFIBootEntry(efiDevice[0], entryName, fmt.Sprintf(`\EFI\%s\%s`, entryName, bootloaderFile))
 		if err != nil {
-			return fmt.Errorf("failed to run efibootmgr for grub-install: %s", err)
+			return fmt.Errorf("failed to create boot entry for grub-install: %s", err)
 		}
 	}
 
@@ -185,14 +240,7 @@ func RunGrubInstall(targetRoot, bootDirectory, diskPath string, target string, e
 }
 
 func RunGrubMkconfig(targetRoot, output string) error {
-	grubMkconfigCmd := "grub-mkconfig -o %s"
-
-	var err error
-	if targetRoot != "" {
-		err = util.RunInChroot(targetRoot, fmt.Sprintf(grubMkconfigCmd, output))
-	} else {
-		err = util.RunCommand(fmt.Sprintf(grubMkconfigCmd, output))
-	}
+	err := util.RunInChroot(targetRoot, "grub-mkconfig", "-o", output)
 	if err != nil {
 		return err
 	}
@@ -12,17 +12,12 @@ import (
 func SetTimezone(targetRoot, tz string) error {
 	tzPath := targetRoot + "/etc/timezone"
 
-	err := os.WriteFile(tzPath, []byte(tz), 0o644)
+	err := util.WriteFile(tzPath, []byte(tz), 0o644)
 	if err != nil {
 		return fmt.Errorf("failed to set timezone: %s", err)
 	}
 
-	linkZoneinfoCmd := "ln -sf /usr/share/zoneinfo/%s /etc/localtime"
-	if targetRoot != "" {
-		err = util.RunInChroot(targetRoot, fmt.Sprintf(linkZoneinfoCmd, tz))
-	} else {
-		err = util.RunCommand(fmt.Sprintf(linkZoneinfoCmd, tz))
-	}
+	err = util.RunInChroot(targetRoot, "ln", "-sf", "/usr/share/zoneinfo/"+tz, "/etc/localtime")
 	if err != nil {
 		return fmt.Errorf("failed to set timezone: %s", err)
 	}
@@ -35,33 +30,29 @@ func SetTimezone(targetRoot, tz string) error {
 // If password is left empty, password login will be disabled.
 // If uid and/or gid are -1, they will be ignored.
 func AddUser(targetRoot, username, fullname string, groups []string, password string, uid, gid int) error {
-	adduserCmd := "useradd --shell /bin/bash %s %s && usermod -c \"%s\" %s"
-
-	extraArgs := ""
+	adduserArgs := []string{"--shell", "/bin/bash"}
 	if uid != -1 {
-		extraArgs = " --uid " + fmt.Sprint(uid)
+		adduserArgs = append(adduserArgs, "--uid", fmt.Sprint(uid))
 	}
 	if gid != -1 {
-		extraArgs = " --gid " + fmt.Sprint(gid)
+		adduserArgs = append(adduserArgs, "--gid", fmt.Sprint(gid))
 	}
 
-	var err error
-	if targetRoot != "" {
-		err = util.RunInChroot(targetRoot, fmt.Sprintf(adduserCmd, extraArgs, username, fullname, username))
-	} else {
-		err = util.RunCommand(fmt.Sprintf(adduserCmd, extraArgs, username, fullname, username))
+	err := util.RunInChroot(targetRoot, "useradd", append(adduserArgs, username)...)
+	if err != nil {
+		return fmt.Errorf("failed to create user: %s", err)
 	}
+
+	err = util.RunInChroot(targetRoot, "usermod", "-c", fullname, username)
 	if err != nil {
 		return fmt.Errorf("failed to create user: %s", err)
 	}
 
 	if password != "" {
-		passwdCmd := "echo \"%s:%s\" | chpasswd"
-		if targetRoot != "" {
-			err = util.RunInChroot(targetRoot, fmt.Sprintf(passwdCmd, username, password))
-		} else {
-			err = util.RunCommand(fmt.Sprintf(passwdCmd, username, password))
-		}
+		passwdCmd := util.NewCommand("chpasswd")
+		passwdCmd.Chroot = targetRoot
+		passwdCmd.Stdin = fmt.Sprintf("%s:%s\n", username, password)
+		err = util.Run(passwdCmd)
 		if err != nil {
 			return fmt.Errorf("failed to set password: %s", err)
 		}
@@ -72,13 +63,8 @@ func AddUser(targetRoot, username, fullname string, groups []string, password st
 		return nil
 	}
 
-	addGroupCmd := "usermod -a -G %s %s"
 	groupList := strings.Join(groups, ",")
-	if targetRoot != "" {
-		err = util.RunInChroot(targetRoot, fmt.Sprintf(addGroupCmd, groupList, username))
-	} else {
-		err = util.RunCommand(fmt.Sprintf(addGroupCmd, groupList, username))
-	}
+	err = util.RunInChroot(targetRoot, "usermod", "-a", "-G", groupList, username)
 	if err != nil {
 		return fmt.Errorf("failed to add groups to user: %s", err)
 	}
@@ -92,13 +78,12 @@ func RemovePackages(targetRoot, pkgRemovePath, removeCmd string) error {
 		return fmt.Errorf("failed to read package removal file: %s", err)
 	}
 
-	pkgList := strings.ReplaceAll(string(pkgRemoveContent), "\n", " ")
-	completeCmd := fmt.Sprintf("%s %s", removeCmd, pkgList)
-	if targetRoot != "" {
-		err = util.RunInChroot(targetRoot, completeCmd)
-	} else {
-		err = util.RunCommand(completeCmd)
+	completeCmd := append(strings.Fields(removeCmd), strings.Fields(string(pkgRemoveContent))...)
+	if len(completeCmd) == 0 {
+		return fmt.Errorf("failed to remove packages: no removal command given")
 	}
+
+	err = util.RunInChroot(targetRoot, completeCmd[0], completeCmd[1:]...)
 	if err != nil {
 		return fmt.Errorf("failed to remove packages: %s", err)
 	}
@@ -108,7 +93,7 @@ func RemovePackages(targetRoot, pkgRemovePath, removeCmd string) error {
 
 func ChangeHostname(targetRoot, hostname string) error {
 	hostnamePath := targetRoot + "/etc/hostname"
-	err := os.WriteFile(hostnamePath, []byte(hostname+"\n"), 0o644)
+	err := util.WriteFile(hostnamePath, []byte(hostname+"\n"), 0o644)
 	if err != nil {
 		return fmt.Errorf("failed to change hostname: %s", err)
 	}
@@ -118,7 +103,7 @@ func ChangeHostname(targetRoot, hostname string) error {
 127.0.1.1	%s.localdomain	%s
 `
 	hostsPath := targetRoot + "/etc/hosts"
-	err = os.WriteFile(hostsPath, []byte(fmt.Sprintf(hostsContents, hostname, hostname)), 0o644)
+	err = util.WriteFile(hostsPath, []byte(fmt.Sprintf(hostsContents, hostname, hostname)), 0o644)
 	if err != nil {
 		return fmt.Errorf("failed to change hosts file: %s", err)
 	}
@@ -127,21 +112,17 @@ func ChangeHostname(targetRoot, hostname string) error {
 }
 
 func SetLocale(targetRoot, locale string) error {
-	err := util.RunCommand(fmt.Sprintf("grep %s %s/usr/share/i18n/SUPPORTED", locale, targetRoot))
+	err := util.RunCommand("grep", "-q", "--", locale, targetRoot+"/usr/share/i18n/SUPPORTED")
 	if err != nil {
 		return fmt.Errorf("locale %s is invalid", locale)
 	}
 
-	err = util.RunCommand(fmt.Sprintf("sed -i 's/^\\# \\(%s\\)/\\1/' %s/etc/locale.gen", regexp.QuoteMeta(locale), targetRoot))
+	err = util.RunCommand("sed", "-i", fmt.Sprintf(`s/^\# \(%s\)/\1/`, regexp.QuoteMeta(locale)), targetRoot+"/etc/locale.gen")
 	if err != nil {
 		return fmt.Errorf("failed to set locale: %s", err)
 	}
 
-	if targetRoot != "" {
-		err = util.RunInChroot(targetRoot, "locale-gen")
-	} else {
-		err = util.RunCommand("locale-gen")
-	}
+	err = util.RunInChroot(targetRoot, "locale-gen")
 	if err != nil {
 		return fmt.Errorf("failed to set locale: %s", err)
 	}
@@ -158,7 +139,7 @@ LC_MEASUREMENT=__lang__
 LC_IDENTIFICATION=__lang__
 `
 	localePath := targetRoot + "/etc/default/locale"
-	err = os.WriteFile(localePath, []byte(strings.ReplaceAll(localeContents, "__lang__", locale)), 0o644)
+	err = util.WriteFile(localePath, []byte(strings.ReplaceAll(localeContents, "__lang__", locale)), 0o644)
 	if err != nil {
 		return fmt.Errorf("failed to set locale: %s", err)
 	}
@@ -167,12 +148,7 @@ LC_IDENTIFICATION=__lang__
 }
 
 func Swapon(targetRoot, swapPart string) error {
-	swaponCmd := "swapon %s"
-	if targetRoot != "" {
-		return util.RunInChroot(targetRoot, fmt.Sprintf(swaponCmd, swapPart))
-	} else {
-		return util.RunCommand(fmt.Sprintf(swaponCmd, swapPart))
-	}
+	return util.RunInChroot(targetRoot, "swapon", swapPart)
 }
 
 func SetKeyboardLayout(targetRoot, kbLayout, kbModel, kbVariant string) error {
@@ -184,16 +160,12 @@ XKBVARIANT="%s"
 BACKSPACE="guess"
 `
 	keyboardPath := targetRoot + "/etc/default/keyboard"
-	err := os.WriteFile(keyboardPath, []byte(fmt.Sprintf(keyboardContents, kbModel, kbLayout, kbVariant)), 0o644)
+	err := util.WriteFile(keyboardPath, []byte(fmt.Sprintf(keyboardContents, kbModel, kbLayout, kbVariant)), 0o644)
 	if err != nil {
 		return fmt.Errorf("failed to set keyboard layout: %s", err)
 	}
 
-	if targetRoot != "" {
-		err = util.RunInChroot(targetRoot, "setupcon --save-only")
-	} else {
-		err = util.RunCommand("setupcon --save-only")
-	}
+	err = util.RunInChroot(targetRoot, "setupcon", "--save-only")
 	if err != nil {
 		return fmt.Errorf("failed to set keyboard layout: %s", err)
 	}
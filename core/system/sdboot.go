@@ -0,0 +1,132 @@
+package system
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/vanilla-os/albius/core/util"
+)
+
+// GetSystemdBootFile returns the file EFI boot entries for systemd-boot must
+// load, from \EFI\systemd.
+func GetSystemdBootFile() (string, error) {
+	platform, err := getEFIPlatform()
+	if err != nil {
+		return "", err
+	}
+
+	return platform.systemdBoot, nil
+}
+
+// RunBootctlInstall installs systemd-boot in the EFI partition efiDevice,
+// mounted on espPath in targetRoot, and adds a boot entry named entryName
+// for it. loader.conf is written with the given timeout, in seconds.
+func RunBootctlInstall(targetRoot, espPath, efiDevice, entryName string, timeout int) error {
+	err := bindChrootMounts(targetRoot)
+	if err != nil {
+		return err
+	}
+
+	// Like grub-install --no-nvram, the boot entry is created below
+	err = util.RunInChroot(targetRoot, "bootctl", "install", "--esp-path="+espPath, "--no-variables")
+	if err != nil {
+		return fmt.Errorf("failed to run bootctl install: %s", err)
+	}
+
+	loaderConf := fmt.Sprintf("timeout %d\neditor no\n", timeout)
+	err = util.WriteFile(filepath.Join(targetRoot, espPath, "loader/loader.conf"), []byte(loaderConf), 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write loader.conf: %s", err)
+	}
+
+	bootloaderFile, err := GetSystemdBootFile()
+	if err != nil {
+		return err
+	}
+	err = CreateEFIBootEntry(efiDevice, entryName, `\EFI\systemd\`+bootloaderFile)
+	if err != nil {
+		return fmt.Errorf("failed to create boot entry for systemd-boot: %s", err)
+	}
+
+	return nil
+}
+
+// kernel is a kernel installed in /boot, as vmlinuz-<version>.
+type kernel struct {
+	version string
+	// initrd tells whether the kernel has an initramfs, as
+	// initrd.img-<version>
+	initrd bool
+}
+
+// installedKernels returns the kernels installed in targetRoot's /boot.
+func installedKernels(targetRoot string) ([]kernel, error) {
+	bootDir := filepath.Join("/", targetRoot, "boot")
+	output, err := util.OutputCommand("ls", "-1", bootDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %s", bootDir, err)
+	}
+
+	files := strings.Split(output, "\n")
+	kernels := []kernel{}
+	for _, file := range files {
+		version, ok := strings.CutPrefix(file, "vmlinuz-")
+		if ok {
+			kernels = append(kernels, kernel{
+				version: version,
+				initrd:  slices.Contains(files, "initrd.img-"+version),
+			})
+		}
+	}
+
+	if len(kernels) == 0 {
+		return nil, fmt.Errorf("no kernel found in %s", bootDir)
+	}
+
+	return kernels, nil
+}
+
+// WriteBootEntries copies every kernel installed in targetRoot, along with
+// its initramfs, to the EFI partition mounted on espPath and writes a Boot
+// Loader Specification entry for it, named entryName-<version>.conf. The
+// kernels are booted with the options in cmdline.
+func WriteBootEntries(targetRoot, espPath, entryName, title, cmdline string) error {
+	kernels, err := installedKernels(targetRoot)
+	if err != nil {
+		return err
+	}
+
+	for _, kernel := range kernels {
+		version := kernel.version
+		// systemd-boot can only read files from the EFI partition
+		entryDir := filepath.Join("/", entryName, version)
+		entry := fmt.Sprintf("title %s\nversion %s\nlinux %s\n", title, version, filepath.Join(entryDir, "vmlinuz"))
+		files := [][2]string{{"vmlinuz-" + version, "vmlinuz"}}
+
+		if kernel.initrd {
+			entry += fmt.Sprintf("initrd %s\n", filepath.Join(entryDir, "initrd.img"))
+			files = append(files, [2]string{"initrd.img-" + version, "initrd.img"})
+		}
+		entry += fmt.Sprintf("options %s\n", cmdline)
+
+		for _, file := range files {
+			err = util.RunInChroot(targetRoot, "install", "-D", "-m", "0644",
+				filepath.Join("/boot", file[0]),
+				filepath.Join(espPath, entryDir, file[1]),
+			)
+			if err != nil {
+				return fmt.Errorf("failed to copy %s to the EFI partition: %s", file[0], err)
+			}
+		}
+
+		entryPath := filepath.Join(targetRoot, espPath, "loader/entries", fmt.Sprintf("%s-%s.conf", entryName, version))
+		err = util.WriteFile(entryPath, []byte(entry), 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to write boot entry for %s: %s", version, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package system
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/vanilla-os/albius/core/util"
+)
+
+// ukiDir is where UKIs are placed in the EFI partition, which is also where
+// systemd-boot looks for them
+const ukiDir = "/EFI/Linux"
+
+// BuildUKIs builds a Unified Kernel Image with ukify for every kernel
+// installed in targetRoot, bundling it with its initramfs and cmdline. The
+// images are written to the EFI partition efiDevice, mounted on espPath, and
+// get a boot entry named after entryName and the kernel version.
+//
+// If keyPath and certPath are set, the images are signed for Secure Boot
+// with sbsign. The key is read on the host, so it never ends up in the
+// installed system.
+func BuildUKIs(targetRoot, espPath, efiDevice, entryName, cmdline, keyPath, certPath string) error {
+	kernels, err := installedKernels(targetRoot)
+	if err != nil {
+		return err
+	}
+
+	err = util.RunInChroot(targetRoot, "mkdir", "-p", filepath.Join(espPath, ukiDir))
+	if err != nil {
+		return fmt.Errorf("failed to create %s in the EFI partition: %s", ukiDir, err)
+	}
+
+	for _, kernel := range kernels {
+		version := kernel.version
+		ukiName := fmt.Sprintf("%s-%s.efi", entryName, version)
+		ukiPath := filepath.Join(espPath, ukiDir, ukiName)
+
+		ukifyArgs := []string{"build",
+			"--linux=/boot/vmlinuz-" + version,
+			"--uname=" + version,
+			"--cmdline=" + cmdline,
+			"--output=" + ukiPath,
+		}
+		if kernel.initrd {
+			ukifyArgs = append(ukifyArgs, "--initrd=/boot/initrd.img-"+version)
+		}
+		err = util.RunInChroot(targetRoot, "ukify", ukifyArgs...)
+		if err != nil {
+			return fmt.Errorf("failed to build UKI for %s: %s", version, err)
+		}
+
+		if keyPath != "" {
+			hostPath := filepath.Join(targetRoot, ukiPath)
+			err = util.RunCommand("sbsign", "--key", keyPath, "--cert", certPath, "--output", hostPath, hostPath)
+			if err != nil {
+				return fmt.Errorf("failed to sign UKI for %s: %s", version, err)
+			}
+		}
+
+		label := fmt.Sprintf("%s (%s)", entryName, version)
+		err = CreateEFIBootEntry(efiDevice, label, `\EFI\Linux\`+ukiName)
+		if err != nil {
+			return fmt.Errorf("failed to create boot entry for UKI %s: %s", ukiName, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// cleanup reverts a single action, such as a mount or an open LUKS mapping.
+type cleanup struct {
+	key         string
+	description string
+	undo        func() error
+}
+
+var (
+	cleanupMu sync.Mutex
+	cleanups  []cleanup
+)
+
+// AddCleanup registers undo as the way to revert the action identified by
+// key (e.g. "mount:/mnt/a"), which must be unique among the actions that
+// are currently in effect. Registering a key again replaces the previous
+// cleanup.
+func AddCleanup(key, description string, undo func() error) {
+	cleanupMu.Lock()
+	defer cleanupMu.Unlock()
+
+	cleanups = removeCleanup(cleanups, key)
+	cleanups = append(cleanups, cleanup{key, description, undo})
+}
+
+// RemoveCleanup forgets the cleanup registered for key, which should be
+// called once the action has been reverted by other means.
+func RemoveCleanup(key string) {
+	cleanupMu.Lock()
+	defer cleanupMu.Unlock()
+
+	cleanups = removeCleanup(cleanups, key)
+}
+
+func removeCleanup(list []cleanup, key string) []cleanup {
+	for i, c := range list {
+		if c.key == key {
+			return append(list[:i:i], list[i+1:]...)
+		}
+	}
+
+	return list
+}
+
+// PendingCleanups returns the description of every registered cleanup, in
+// the order RunCleanups would run them.
+func PendingCleanups() []string {
+	cleanupMu.Lock()
+	defer cleanupMu.Unlock()
+
+	descriptions := make([]string, 0, len(cleanups))
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		descriptions = append(descriptions, cleanups[i].description)
+	}
+
+	return descriptions
+}
+
+// RunCleanups reverts every registered action in the reverse order they were
+// registered, so that e.g. nested mounts are unmounted before their parents.
+// Every cleanup is attempted even if previous ones fail, and the registry is
+// empty afterwards.
+func RunCleanups() error {
+	cleanupMu.Lock()
+	pending := cleanups
+	cleanups = nil
+	cleanupMu.Unlock()
+
+	errs := []error{}
+	for i := len(pending) - 1; i >= 0; i-- {
+		err := pending[i].undo()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to %s: %s", pending[i].description, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// IsolateCleanups empties the registry, returning a function which restores
+// its previous contents. It is used when simulating a run, whose actions
+// never take effect.
+func IsolateCleanups() (restore func()) {
+	cleanupMu.Lock()
+	saved := cleanups
+	cleanups = nil
+	cleanupMu.Unlock()
+
+	return func() {
+		cleanupMu.Lock()
+		cleanups = saved
+		cleanupMu.Unlock()
+	}
+}
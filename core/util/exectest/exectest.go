@@ -0,0 +1,150 @@
+// Package exectest provides a scripted util.Executor for testing code which
+// runs external commands without root privileges or real block devices.
+package exectest
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/vanilla-os/albius/core/util"
+)
+
+type response struct {
+	output string
+	err    error
+}
+
+// Fake is an util.Executor which never touches the system. Commands are
+// matched against the responses registered with Expect and ExpectError, and
+// files are kept in memory.
+//
+// A command with no registered response succeeds with empty output.
+type Fake struct {
+	mu        sync.Mutex
+	responses map[string][]response
+	prefixes  []string
+	// Commands holds every command received, in order, as returned by
+	// util.Command.String
+	Commands []string
+	// Stdin holds the input fed to commands, in order
+	Stdin []string
+	// Files holds the contents of every file written
+	Files map[string][]byte
+}
+
+// New returns an empty Fake.
+func New() *Fake {
+	return &Fake{
+		responses: map[string][]response{},
+		Files:     map[string][]byte{},
+	}
+}
+
+// Expect registers output as the response for command, which is compared
+// against util.Command.String (e.g. "chroot /mnt/a useradd -m user"). If
+// command ends
+// with "*", it matches every command starting with the text before it.
+//
+// Multiple responses for the same command are returned in the order they
+// were registered, with the last one being repeated once the others have
+// been consumed.
+func (f *Fake) Expect(command, output string) *Fake {
+	return f.add(command, response{output: output})
+}
+
+// ExpectError is like Expect, but makes command fail with err. Use
+// *util.ExitError to simulate a command exiting with a non-zero status.
+func (f *Fake) ExpectError(command, output string, err error) *Fake {
+	return f.add(command, response{output: output, err: err})
+}
+
+func (f *Fake) add(command string, resp response) *Fake {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if prefix, ok := strings.CutSuffix(command, "*"); ok {
+		f.prefixes = append(f.prefixes, prefix)
+	}
+	f.responses[command] = append(f.responses[command], resp)
+	return f
+}
+
+func (f *Fake) respond(cmd util.Command) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	command := cmd.String()
+	f.Commands = append(f.Commands, command)
+	if cmd.Stdin != "" {
+		f.Stdin = append(f.Stdin, cmd.Stdin)
+	}
+
+	key := command
+	if _, ok := f.responses[key]; !ok {
+		key = ""
+		for _, prefix := range f.prefixes {
+			if strings.HasPrefix(command, prefix) && len(prefix) >= len(key) {
+				key = prefix + "*"
+			}
+		}
+	}
+
+	queue := f.responses[key]
+	if len(queue) == 0 {
+		return "", nil
+	}
+
+	resp := queue[0]
+	if len(queue) > 1 {
+		f.responses[key] = queue[1:]
+	}
+	return resp.output, resp.err
+}
+
+// DryRun reports true, as nothing is performed on the system and code
+// waiting for devices to appear should not wait for them.
+func (f *Fake) DryRun() bool {
+	return true
+}
+
+// Run responds like Output, writing the scripted output to cmd.Stdout if
+// set so code parsing a command's output while it runs can be tested.
+func (f *Fake) Run(cmd util.Command) error {
+	output, err := f.respond(cmd)
+	if cmd.Stdout != nil && output != "" {
+		_, _ = io.WriteString(cmd.Stdout, output)
+	}
+	return err
+}
+
+func (f *Fake) Output(cmd util.Command) (string, error) {
+	return f.respond(cmd)
+}
+
+func (f *Fake) WriteFile(name string, data []byte, perm os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Files[name] = data
+	return nil
+}
+
+func (f *Fake) Remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.Files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(f.Files, name)
+	return nil
+}
+
+// Install makes f the package-level executor until the returned function
+// is called.
+func (f *Fake) Install() (restore func()) {
+	prev := util.SetExecutor(f)
+	return func() { util.SetExecutor(prev) }
+}
@@ -0,0 +1,50 @@
+package util
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Reporter receives the log lines produced while applying a recipe. The
+// default implementation prints them to stdout, but it can be swapped with
+// SetReporter so that frontends receive them as events (see Recipe.OnEvent).
+type Reporter interface {
+	// Log reports a human readable message.
+	Log(message string)
+}
+
+// StdoutReporter is the default Reporter.
+type StdoutReporter struct{}
+
+func (StdoutReporter) Log(message string) {
+	fmt.Println(message)
+}
+
+var (
+	reporterMu sync.Mutex
+	reporter   Reporter = StdoutReporter{}
+)
+
+// SetReporter replaces the Reporter, returning the previous one so it can be
+// restored.
+func SetReporter(r Reporter) Reporter {
+	reporterMu.Lock()
+	defer reporterMu.Unlock()
+
+	prev := reporter
+	reporter = r
+	return prev
+}
+
+func currentReporter() Reporter {
+	reporterMu.Lock()
+	defer reporterMu.Unlock()
+
+	return reporter
+}
+
+// Logf formats a message and reports it through the current Reporter, with
+// any secret masked (see AddSecret).
+func Logf(format string, args ...any) {
+	currentReporter().Log(MaskSecrets(fmt.Sprintf(format, args...)))
+}
@@ -0,0 +1,46 @@
+package util
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+// secretMask replaces secrets in everything Albius prints or reports
+const secretMask = "********"
+
+var (
+	secretsMu sync.Mutex
+	secrets   []string
+)
+
+// AddSecret registers a value, such as a password, which must never be
+// shown to the user. Logs, plans, events and errors pass through
+// MaskSecrets before being printed.
+func AddSecret(secret string) {
+	if secret == "" {
+		return
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	if !slices.Contains(secrets, secret) {
+		secrets = append(secrets, secret)
+		// Mask longer secrets first, in case one contains another
+		slices.SortFunc(secrets, func(a, b string) int { return len(b) - len(a) })
+	}
+}
+
+// MaskSecrets returns s with every value registered with AddSecret
+// replaced by asterisks.
+func MaskSecrets(s string) string {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, secretMask)
+	}
+
+	return s
+}
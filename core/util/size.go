@@ -0,0 +1,217 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SizeKind tells how a Size is measured.
+type SizeKind int
+
+const (
+	// SizeAbsolute is a number of bytes, counted from the start
+	SizeAbsolute SizeKind = iota
+	// SizeFromEnd is a number of bytes counted back from the end
+	SizeFromEnd
+	// SizePercent is a percentage of the whole
+	SizePercent
+	// SizeRest is everything up to the end
+	SizeRest
+)
+
+const (
+	KiB int64 = 1 << (10 * (iota + 1))
+	MiB
+	GiB
+	TiB
+	PiB
+)
+
+// Size is a size or position read from a recipe, see ParseSize. What it is
+// relative to (e.g. a disk or a volume group) is up to the operation using
+// it.
+type Size struct {
+	Kind SizeKind
+	// Bytes is the size for SizeAbsolute and SizeFromEnd
+	Bytes int64
+	// Percent is the percentage for SizePercent
+	Percent float64
+	// PercentOf is what Percent refers to for LVM sizes ("FREE", "VG",
+	// "PVS" or "ORIGIN", see lvcreate(8)), or empty for the whole
+	PercentOf string
+}
+
+// MiBSize returns an absolute Size of n MiB.
+func MiBSize(n float64) Size {
+	return Size{Kind: SizeAbsolute, Bytes: int64(n * float64(MiB))}
+}
+
+// RestSize returns a Size spanning everything up to the end.
+func RestSize() Size {
+	return Size{Kind: SizeRest}
+}
+
+// sizeExpr matches sizes with an optional unit, e.g. "512", "1.5GiB",
+// "-2GiB" or "1TB"
+var sizeExpr = regexp.MustCompile(`^(-?)(\d+(?:\.\d+)?)\s*([KMGTP]I?B|B)?$`)
+
+// percentExpr matches percentages, optionally followed by what they refer to
+// in LVM, e.g. "50%" or "100%FREE"
+var percentExpr = regexp.MustCompile(`^(\d+(?:\.\d+)?)%(FREE|VG|PVS|ORIGIN)?$`)
+
+var sizeUnits = map[string]int64{
+	"B":   1,
+	"KB":  1e3,
+	"MB":  1e6,
+	"GB":  1e9,
+	"TB":  1e12,
+	"PB":  1e15,
+	"KIB": KiB,
+	"MIB": MiB,
+	"GIB": GiB,
+	"TIB": TiB,
+	"PIB": PiB,
+}
+
+// ParseSize reads a size from a recipe parameter, which is one of:
+//   - a number of MiB, either a JSON number or a string without unit. -1
+//     means the rest, and other negative numbers count back from the end;
+//   - a string with a unit, either binary (KiB, MiB, GiB, TiB, PiB), decimal
+//     (KB, MB, GB, TB, PB) or B for bytes, e.g. "512MiB" or "1TB". Negative
+//     sizes (e.g. "-2GiB") count back from the end;
+//   - a percentage, e.g. "50%". LVM sizes may also say what it refers to,
+//     e.g. "100%FREE";
+//   - "rest", meaning everything up to the end.
+func ParseSize(value any) (Size, error) {
+	switch v := value.(type) {
+	case float64:
+		return mibSize(v), nil
+	case int:
+		return mibSize(float64(v)), nil
+	case string:
+		return parseSizeString(v)
+	default:
+		return Size{}, fmt.Errorf("invalid size %v: expected a number or a string", value)
+	}
+}
+
+func mibSize(n float64) Size {
+	switch {
+	case n == -1:
+		return RestSize()
+	case n < 0:
+		return Size{Kind: SizeFromEnd, Bytes: int64(-n * float64(MiB))}
+	default:
+		return MiBSize(n)
+	}
+}
+
+func parseSizeString(s string) (Size, error) {
+	s = strings.TrimSpace(s)
+	if strings.EqualFold(s, "rest") {
+		return RestSize(), nil
+	}
+
+	if match := percentExpr.FindStringSubmatch(strings.ToUpper(s)); match != nil {
+		percent, _ := strconv.ParseFloat(match[1], 64)
+		if percent > 100 && match[2] == "" {
+			return Size{}, fmt.Errorf("invalid size %q: percentage cannot exceed 100%%", s)
+		}
+		return Size{Kind: SizePercent, Percent: percent, PercentOf: match[2]}, nil
+	}
+
+	match := sizeExpr.FindStringSubmatch(strings.ToUpper(s))
+	if match == nil {
+		return Size{}, fmt.Errorf("invalid size %q: expected e.g. 512MiB, 20GiB, 50%%, -2GiB or rest", s)
+	}
+	n, _ := strconv.ParseFloat(match[2], 64)
+	if match[3] == "" {
+		if match[1] == "-" {
+			n = -n
+		}
+		return mibSize(n), nil
+	}
+
+	bytes := int64(math.Round(n * float64(sizeUnits[match[3]])))
+	if match[1] == "-" {
+		return Size{Kind: SizeFromEnd, Bytes: bytes}, nil
+	}
+	return Size{Kind: SizeAbsolute, Bytes: bytes}, nil
+}
+
+// Resolve returns the position in bytes s refers to within total bytes.
+// Percentages of anything other than the whole cannot be resolved.
+func (s Size) Resolve(total int64) (int64, error) {
+	var pos int64
+	switch s.Kind {
+	case SizeAbsolute:
+		pos = s.Bytes
+	case SizeFromEnd:
+		pos = total - s.Bytes
+	case SizePercent:
+		if s.PercentOf != "" {
+			return 0, fmt.Errorf("size %s is only supported for LVM volumes", s)
+		}
+		pos = int64(float64(total) * s.Percent / 100)
+	case SizeRest:
+		pos = total
+	}
+
+	if pos < 0 || pos > total {
+		return 0, fmt.Errorf("size %s is out of range (0 to %s)", s, Size{Bytes: total})
+	}
+
+	return pos, nil
+}
+
+// String formats s the same way ParseSize reads it, using the largest
+// binary unit which represents it exactly.
+func (s Size) String() string {
+	switch s.Kind {
+	case SizePercent:
+		return strconv.FormatFloat(s.Percent, 'f', -1, 64) + "%" + s.PercentOf
+	case SizeRest:
+		return "rest"
+	}
+
+	prefix := ""
+	if s.Kind == SizeFromEnd {
+		prefix = "-"
+	}
+	for _, unit := range []struct {
+		name string
+		size int64
+	}{{"PiB", PiB}, {"TiB", TiB}, {"GiB", GiB}, {"MiB", MiB}, {"KiB", KiB}} {
+		if s.Bytes != 0 && s.Bytes%unit.size == 0 {
+			return fmt.Sprintf("%s%d%s", prefix, s.Bytes/unit.size, unit.name)
+		}
+	}
+
+	return fmt.Sprintf("%s%dB", prefix, s.Bytes)
+}
+
+// MarshalJSON encodes s as a string ParseSize can read back.
+func (s Size) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON reads any value accepted by ParseSize.
+func (s *Size) UnmarshalJSON(data []byte) error {
+	var value any
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+
+	size, err := ParseSize(value)
+	if err != nil {
+		return err
+	}
+
+	*s = size
+	return nil
+}
@@ -0,0 +1,49 @@
+package util
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	for _, test := range []struct {
+		value    any
+		expected Size
+		resolved int64
+	}{
+		{float64(512), MiBSize(512), 512 * MiB},
+		{float64(-1), RestSize(), 100 * GiB},
+		{"512MiB", MiBSize(512), 512 * MiB},
+		{"20gib", Size{Bytes: 20 * GiB}, 20 * GiB},
+		{"1TB", Size{Bytes: 1e12}, 0},
+		{"-2GiB", Size{Kind: SizeFromEnd, Bytes: 2 * GiB}, 98 * GiB},
+		{"50%", Size{Kind: SizePercent, Percent: 50}, 50 * GiB},
+		{"100%FREE", Size{Kind: SizePercent, Percent: 100, PercentOf: "FREE"}, -1},
+		{"rest", RestSize(), 100 * GiB},
+		{"150%", Size{}, 0},
+		{"one", Size{}, 0},
+		{true, Size{}, 0},
+	} {
+		size, err := ParseSize(test.value)
+		if test.expected == (Size{}) {
+			if err == nil {
+				t.Errorf("%v: expected an error, got %s", test.value, size)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %s", test.value, err)
+			continue
+		}
+		if size != test.expected {
+			t.Errorf("%v: expected %+v, got %+v", test.value, test.expected, size)
+		}
+
+		// Resolve within a 100GiB disk; 0 means out of range and -1 not
+		// resolvable
+		resolved, err := size.Resolve(100 * GiB)
+		switch {
+		case test.resolved > 0 && (err != nil || resolved != test.resolved):
+			t.Errorf("%v: expected to resolve to %d, got %d (%v)", test.value, test.resolved, resolved, err)
+		case test.resolved <= 0 && err == nil:
+			t.Errorf("%v: expected Resolve to fail, got %d", test.value, resolved)
+		}
+	}
+}
@@ -2,68 +2,249 @@ package util
 
 import (
 	"bytes"
-	"errors"
+	"io"
 	"os"
 	"os/exec"
 	"regexp"
 	"strings"
 )
 
-// RunCommand executes a command in a subshell
-//
-// envVars are environement variables in the form MYVAR=myvalue that will be passed to the command
-func RunCommand(command string, envVars ...string) error {
+// Command is an external program to be executed, along with its arguments.
+// Arguments are passed to the program as-is, without going through a shell,
+// so they never need to be quoted or escaped.
+type Command struct {
+	Name string
+	Args []string
+	// Env holds extra environment variables in the form MYVAR=myvalue
+	Env []string
+	// Stdin is fed to the program's standard input. Use it for passwords
+	// and other secrets, which must never be part of Args.
+	Stdin string
+	// Chroot is the root the program is executed in, if any
+	Chroot string
+	// Stdout, if set, receives the program's standard output while it runs,
+	// instead of Albius' own stdout. Only used by Executor.Run.
+	Stdout io.Writer
+}
+
+// NewCommand returns a Command which executes name with args.
+func NewCommand(name string, args ...string) Command {
+	return Command{Name: name, Args: args}
+}
+
+// shellSafeExpr matches strings which do not need quoting in a shell
+var shellSafeExpr = regexp.MustCompile(`^[\w@%+=:,./-]+$`)
+
+// Quote quotes s so that it is read as a single word by a POSIX shell.
+func Quote(s string) string {
+	if shellSafeExpr.MatchString(s) {
+		return s
+	}
+
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// String returns the command as it would be typed in a shell. Stdin is
+// never included.
+func (c Command) String() string {
+	words := []string{}
+	if c.Chroot != "" {
+		words = append(words, "chroot", Quote(c.Chroot))
+	}
+	words = append(words, Quote(c.Name))
+	for _, arg := range c.Args {
+		words = append(words, Quote(arg))
+	}
+
+	return strings.Join(words, " ")
+}
+
+// argv returns the program and arguments to execute, taking Chroot into
+// account.
+func (c Command) argv() (string, []string) {
+	if c.Chroot == "" {
+		return c.Name, c.Args
+	}
+
+	return "chroot", append([]string{c.Chroot, c.Name}, c.Args...)
+}
+
+// Executor performs every side effect Albius has on the system: running
+// external commands and writing files. The default implementation executes
+// them directly, but it can be swapped with SetExecutor (or per recipe with
+// Recipe.Executor) so that the same code path records what would be done
+// instead (see Recipe.Plan), or returns scripted output in tests (see
+// package exectest).
+type Executor interface {
+	// Run executes cmd, forwarding its stdout to cmd.Stdout or Albius'
+	// stdout.
+	Run(cmd Command) error
+	// Output executes cmd and returns its trimmed stdout.
+	Output(cmd Command) (string, error)
+	// WriteFile writes data to the named file, creating it if necessary.
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	// Remove removes the named file or empty directory.
+	Remove(name string) error
+}
+
+// ExitError is returned when a command exits with a non-zero status.
+type ExitError struct {
+	Code   int
+	Stderr string
+}
+
+func (e *ExitError) Error() string {
+	return e.Stderr
+}
+
+// SystemExecutor is the default Executor, which runs commands and writes
+// files directly on the host.
+type SystemExecutor struct{}
+
+func exitError(err error, stderr string) error {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return &ExitError{Code: exitErr.ExitCode(), Stderr: stderr}
+	}
+
+	return err
+}
+
+func (SystemExecutor) command(c Command) *exec.Cmd {
+	name, args := c.argv()
+	cmd := exec.Command(name, args...)
+	cmd.Env = append(os.Environ(), c.Env...)
+	if c.Stdin != "" {
+		cmd.Stdin = strings.NewReader(c.Stdin)
+	}
+
+	return cmd
+}
+
+func (e SystemExecutor) Run(c Command) error {
 	stderr := new(bytes.Buffer)
 
-	cmd := exec.Command("sh", "-c", command)
-	cmd.Env = append(os.Environ(), envVars...)
+	cmd := e.command(c)
 	cmd.Stdout = os.Stdout
+	if c.Stdout != nil {
+		cmd.Stdout = c.Stdout
+	}
 	cmd.Stderr = stderr
 
 	err := cmd.Run()
 	if err != nil {
-		return errors.New(stderr.String())
+		return exitError(err, stderr.String())
 	}
 
 	return nil
 }
 
-// OutputCommand executes a command in a subshell and returns its output
-func OutputCommand(command string) (string, error) {
-	cmd := exec.Command("sh", "-c", command)
+func (e SystemExecutor) Output(c Command) (string, error) {
+	stderr := new(bytes.Buffer)
+
+	cmd := e.command(c)
+	cmd.Stderr = stderr
+
 	out, err := cmd.Output()
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return strings.TrimSpace(string(out)), errors.New(string(exitErr.Stderr))
-		}
-		return strings.TrimSpace(string(out)), err
+		return strings.TrimSpace(string(out)), exitError(err, stderr.String())
 	}
 
-	return strings.TrimSpace(string(out)), err
+	return strings.TrimSpace(string(out)), nil
 }
 
-// RunInChroot executes a command in a subshell while chrooted into the specified root
-func RunInChroot(root, command string) error {
-	cmd := exec.Command("chroot", root, "sh", "-c", command)
-	cmd.Stdout = os.Stdout
-	err := cmd.Run()
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return errors.New(string(exitErr.Stderr))
-		}
-		return err
-	}
+func (SystemExecutor) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
 
-	return nil
+func (SystemExecutor) Remove(name string) error {
+	return os.Remove(name)
+}
+
+var executor Executor = SystemExecutor{}
+
+// SetExecutor replaces the Executor used by every command and file
+// operation, returning the previous one so it can be restored.
+func SetExecutor(e Executor) Executor {
+	prev := executor
+	executor = e
+	return prev
+}
+
+// DryRun reports whether the current Executor only records operations
+// instead of performing them. Code which waits for the system to reflect a
+// change (e.g. a new partition appearing) should not wait in this case.
+func DryRun() bool {
+	dr, ok := executor.(interface{ DryRun() bool })
+	return ok && dr.DryRun()
+}
+
+// RunCommand executes a program with the specified arguments
+func RunCommand(name string, args ...string) error {
+	return executor.Run(NewCommand(name, args...))
+}
+
+// OutputCommand executes a program with the specified arguments and returns its output
+func OutputCommand(name string, args ...string) (string, error) {
+	return executor.Output(NewCommand(name, args...))
+}
+
+// RunInChroot executes a program while chrooted into the specified root. If
+// root is empty, the program is executed on the host
+func RunInChroot(root, name string, args ...string) error {
+	cmd := NewCommand(name, args...)
+	cmd.Chroot = root
+	return executor.Run(cmd)
+}
+
+// Run executes cmd, allowing for environment variables, stdin and chroot
+// to be set
+func Run(cmd Command) error {
+	return executor.Run(cmd)
+}
+
+// Output executes cmd and returns its output
+func Output(cmd Command) (string, error) {
+	return executor.Output(cmd)
+}
+
+// RunShell executes a command line in a subshell, chrooted into root if it
+// is not empty. This is only meant for commands written by the user, such as
+// the "shell" post-installation operation, and must never be used with
+// interpolated values.
+func RunShell(root, command string) error {
+	cmd := NewCommand("sh", "-c", command)
+	cmd.Chroot = root
+	return executor.Run(cmd)
 }
 
+// WriteFile writes data to a file through the current Executor
+func WriteFile(name string, data []byte, perm os.FileMode) error {
+	return executor.WriteFile(name, data, perm)
+}
+
+// RemoveFile removes a file through the current Executor
+func RemoveFile(name string) error {
+	return executor.Remove(name)
+}
+
+// digitDiskExpr matches disks whose name ends with a digit (e.g.
+// /dev/nvme0n1, /dev/mmcblk0 or /dev/loop0), which separate the number of
+// their partitions with a "p"
+var digitDiskExpr = regexp.MustCompile(`^(/dev/(?:nvme\d+n\d+|mmcblk\d+|loop\d+|md\d+|nbd\d+))(?:p(\d+))?$`)
+
+// partSuffixExpr matches other disks and partitions, e.g. /dev/sda1
+var partSuffixExpr = regexp.MustCompile(`^(/dev/.*?)(\d*)$`)
+
 // SeparateDiskPart receives a path (e.g. /dev/sda1) and separates it into
-// the device root and partition number
+// the device root and partition number, which is empty for disks. Paths
+// must use the kernel name of the device, see disk.ResolveDevice.
 func SeparateDiskPart(path string) (string, string) {
-	diskExpr := regexp.MustCompile("^/dev/[a-zA-Z]+([0-9]+[a-z][0-9]+)?")
-	partExpr := regexp.MustCompile("[0-9]+$")
-	disk := diskExpr.FindString(path)
-	part := partExpr.FindString(path)
+	if match := digitDiskExpr.FindStringSubmatch(path); match != nil {
+		return match[1], match[2]
+	}
+	if match := partSuffixExpr.FindStringSubmatch(path); match != nil {
+		return match[1], match[2]
+	}
 
-	return disk, part
+	return "", ""
 }
@@ -0,0 +1,23 @@
+package util
+
+import "testing"
+
+func TestSeparateDiskPart(t *testing.T) {
+	for _, tc := range []struct {
+		path, disk, part string
+	}{
+		{"/dev/sda", "/dev/sda", ""},
+		{"/dev/sda12", "/dev/sda", "12"},
+		{"/dev/vdb1", "/dev/vdb", "1"},
+		{"/dev/nvme0n1", "/dev/nvme0n1", ""},
+		{"/dev/nvme0n1p3", "/dev/nvme0n1", "3"},
+		{"/dev/mmcblk0p1", "/dev/mmcblk0", "1"},
+		{"/dev/loop7p2", "/dev/loop7", "2"},
+		{"/dev/loop7", "/dev/loop7", ""},
+	} {
+		diskPath, part := SeparateDiskPart(tc.path)
+		if diskPath != tc.disk || part != tc.part {
+			t.Errorf("SeparateDiskPart(%q) = %q, %q, expected %q, %q", tc.path, diskPath, part, tc.disk, tc.part)
+		}
+	}
+}
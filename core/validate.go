@@ -0,0 +1,1136 @@
+package albius
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/vanilla-os/albius/core/disk"
+	"github.com/vanilla-os/albius/core/system"
+	"github.com/vanilla-os/albius/core/util"
+)
+
+type paramType int
+
+const (
+	paramString paramType = iota
+	paramBool
+	// paramNumber only accepts JSON numbers
+	paramNumber
+	// paramInt accepts JSON numbers or strings containing an integer, see jsonFieldToInt
+	paramInt
+	// paramSize accepts sizes read by util.ParseSize
+	paramSize
+	// paramPosition accepts sizes or free regions, see partitionPositions
+	paramPosition
+	paramStringList
+	paramObject
+)
+
+func (t paramType) String() string {
+	switch t {
+	case paramString:
+		return "a string"
+	case paramBool:
+		return "a boolean"
+	case paramNumber:
+		return "a number"
+	case paramInt:
+		return "an integer"
+	case paramSize:
+		return "a size (e.g. 512MiB, 20GiB, 50%, -2GiB or rest)"
+	case paramPosition:
+		return "a size (e.g. 512MiB, 20GiB, 50%, -2GiB or rest) or a free region (e.g. free:largest)"
+	case paramStringList:
+		return "a list of strings"
+	case paramObject:
+		return "an object"
+	default:
+		return "unknown"
+	}
+}
+
+type paramSpec struct {
+	name     string
+	kind     paramType
+	optional bool
+	// variadic params consume all remaining arguments
+	variadic bool
+}
+
+// setupOperationParams describes the parameters accepted by each setup
+// operation. It must be kept in sync with runSetupOperation.
+var setupOperationParams = map[string][]paramSpec{
+	"label": {
+		{name: "LabelType", kind: paramString},
+	},
+	"auto-layout": {
+		{name: "Firmware", kind: paramString},
+		{name: "LUKSPassword", kind: paramString, optional: true},
+		{name: "Policy", kind: paramObject, optional: true},
+	},
+	"mkpart": {
+		{name: "Name", kind: paramString},
+		{name: "FsType", kind: paramString},
+		{name: "Start", kind: paramPosition},
+		{name: "End", kind: paramPosition},
+		{name: "LUKSPassword", kind: paramString, optional: true},
+	},
+	"rm": {
+		{name: "PartNum", kind: paramInt},
+	},
+	"resizepart": {
+		{name: "PartNum", kind: paramInt},
+		{name: "PartNewSize", kind: paramSize},
+	},
+	"shrink-for-install": {
+		{name: "PartNum", kind: paramInt},
+		{name: "NewSize", kind: paramSize},
+	},
+	"namepart": {
+		{name: "PartNum", kind: paramInt},
+		{name: "PartNewName", kind: paramString},
+	},
+	"setlabel": {
+		{name: "PartNum", kind: paramInt},
+		{name: "Label", kind: paramString},
+	},
+	"setflag": {
+		{name: "PartNum", kind: paramInt},
+		{name: "FlagName", kind: paramString},
+		{name: "State", kind: paramBool},
+	},
+	"format": {
+		{name: "PartNum", kind: paramInt},
+		{name: "FsType", kind: paramString},
+		{name: "Label", kind: paramString, optional: true},
+	},
+	"luks-format": {
+		{name: "PartNum", kind: paramInt},
+		{name: "FsType", kind: paramString},
+		{name: "Password", kind: paramString},
+		{name: "Label", kind: paramString, optional: true},
+	},
+	"pvcreate": {
+		{name: "Partition", kind: paramString},
+	},
+	"pvresize": {
+		{name: "PV", kind: paramString},
+		{name: "Size", kind: paramSize, optional: true},
+	},
+	"pvremove": {
+		{name: "PV", kind: paramString},
+	},
+	"vgcreate": {
+		{name: "Name", kind: paramString},
+		{name: "PVs", kind: paramStringList, optional: true},
+	},
+	"vgrename": {
+		{name: "OldName", kind: paramString},
+		{name: "NewName", kind: paramString},
+	},
+	"vgextend": {
+		{name: "Name", kind: paramString},
+		{name: "PVs", kind: paramStringList},
+	},
+	"vgreduce": {
+		{name: "Name", kind: paramString},
+		{name: "PVs", kind: paramStringList},
+	},
+	"vgremove": {
+		{name: "Name", kind: paramString},
+	},
+	"lvcreate": {
+		{name: "Name", kind: paramString},
+		{name: "VG", kind: paramString},
+		{name: "Type", kind: paramString},
+		{name: "Size", kind: paramSize},
+	},
+	"lvrename": {
+		{name: "OldName", kind: paramString},
+		{name: "NewName", kind: paramString},
+		{name: "VG", kind: paramString},
+	},
+	"lvremove": {
+		{name: "Name", kind: paramString},
+	},
+	"make-thin-pool": {
+		{name: "ThinDataLV", kind: paramString},
+		{name: "ThinMetaLV", kind: paramString},
+	},
+	"lvcreate-thin": {
+		{name: "Name", kind: paramString},
+		{name: "VG", kind: paramString},
+		{name: "Size", kind: paramSize},
+		{name: "Thinpool", kind: paramString},
+	},
+	"lvm-format": {
+		{name: "Name", kind: paramString},
+		{name: "FsType", kind: paramString},
+		{name: "Label", kind: paramString, optional: true},
+	},
+	"lvm-luks-format": {
+		{name: "Name", kind: paramString},
+		{name: "FsType", kind: paramString},
+		{name: "Password", kind: paramString},
+		{name: "Label", kind: paramString, optional: true},
+	},
+}
+
+// postInstallOperationParams describes the parameters accepted by each
+// post-installation operation. It must be kept in sync with
+// runPostInstallOperation.
+var postInstallOperationParams = map[string][]paramSpec{
+	"adduser": {
+		{name: "Username", kind: paramString},
+		{name: "Fullname", kind: paramString},
+		{name: "Groups", kind: paramStringList},
+		{name: "Password", kind: paramString, optional: true},
+		{name: "UID", kind: paramNumber, optional: true},
+		{name: "GID", kind: paramNumber, optional: true},
+	},
+	"timezone": {
+		{name: "TZ", kind: paramString},
+	},
+	"shell": {
+		{name: "Command", kind: paramString, variadic: true},
+	},
+	"pkgremove": {
+		{name: "PkgRemovePath", kind: paramString},
+		{name: "RemoveCmd", kind: paramString},
+	},
+	"hostname": {
+		{name: "NewHostname", kind: paramString},
+	},
+	"locale": {
+		{name: "LocaleCode", kind: paramString},
+	},
+	"swapon": {
+		{name: "Partition", kind: paramString},
+	},
+	"keyboard": {
+		{name: "Layout", kind: paramString},
+		{name: "Model", kind: paramString},
+		{name: "Variant", kind: paramString},
+	},
+	"grub-install": {
+		{name: "BootDirectory", kind: paramString},
+		{name: "InstallDevice", kind: paramString},
+		{name: "Target", kind: paramString},
+		{name: "EntryName", kind: paramString},
+		{name: "Removable", kind: paramBool},
+		{name: "EFIDevice", kind: paramString, optional: true},
+	},
+	"grub-default-config": {
+		{name: "KV", kind: paramString, variadic: true},
+	},
+	"grub-add-script": {
+		{name: "ScriptPath", kind: paramString, variadic: true},
+	},
+	"grub-remove-script": {
+		{name: "ScriptPath", kind: paramString, variadic: true},
+	},
+	"grub-mkconfig": {
+		{name: "OutputPath", kind: paramString},
+	},
+	"sdboot-install": {
+		{name: "ESPPath", kind: paramString},
+		{name: "EFIDevice", kind: paramString},
+		{name: "EntryName", kind: paramString},
+		{name: "Timeout", kind: paramInt, optional: true},
+	},
+	"sdboot-entry": {
+		{name: "ESPPath", kind: paramString},
+		{name: "EntryName", kind: paramString},
+		{name: "Title", kind: paramString},
+		{name: "Options", kind: paramString, optional: true},
+	},
+	"uki-install": {
+		{name: "ESPPath", kind: paramString},
+		{name: "EFIDevice", kind: paramString},
+		{name: "EntryName", kind: paramString},
+		{name: "Options", kind: paramString, optional: true},
+		{name: "SigningKey", kind: paramString, optional: true},
+		{name: "SigningCert", kind: paramString, optional: true},
+	},
+}
+
+// entryNameExpr matches the names of boot entries, which are used in file
+// names
+var entryNameExpr = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+var validFilesystems = []disk.PartitionFs{
+	disk.BTRFS, disk.EXT2, disk.EXT3, disk.EXT4, disk.FAT16, disk.FAT32,
+	disk.LINUX_SWAP, disk.NTFS, disk.REISERFS, disk.UDF, disk.XFS,
+}
+
+// ValidationError describes a single problem found in a recipe.
+type ValidationError struct {
+	// Section is the recipe section the problem was found in (e.g. "setup")
+	Section string
+	// Step is the index of the offending entry inside Section, or -1 if the
+	// problem concerns the section as a whole
+	Step      int
+	Operation string
+	Message   string
+}
+
+func (e ValidationError) Error() string {
+	location := e.Section
+	if e.Step >= 0 {
+		location = fmt.Sprintf("%s[%d]", e.Section, e.Step)
+	}
+	if e.Operation != "" {
+		location += " " + e.Operation
+	}
+
+	return fmt.Sprintf("%s: %s", location, e.Message)
+}
+
+// ValidationErrors holds every problem found while validating a recipe.
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		msgs = append(msgs, e.Error())
+	}
+
+	return fmt.Sprintf("recipe has %d problem(s):\n%s", len(errs), strings.Join(msgs, "\n"))
+}
+
+// diskState tracks what we know about a disk's partition table while
+// walking the setup steps. If the disk is never labeled by the recipe, its
+// existing partitions are unknown and partition numbers cannot be checked.
+type diskState struct {
+	labeled    bool
+	partitions []int
+	// label is the type of partition table, if labeled
+	label string
+	// biosBoot are the partitions with the bios_grub flag, if labeled
+	biosBoot []int
+	// freed tells whether a region was freed by shrink-for-install
+	freed bool
+}
+
+type validator struct {
+	errs  ValidationErrors
+	disks map[string]*diskState
+	// partitions created by the recipe, by path
+	partitions map[string]bool
+	// VGs and LVs (in `vg_name/lv_name` format) created or removed by the recipe
+	vgs, removedVgs map[string]bool
+	lvs, removedLvs map[string]bool
+	// ids of the setup steps seen so far, along with the path their device
+	// is expected to have
+	ids map[string]string
+	// firmware and arch the recipe is validated for, the latter being
+	// empty if unknown. They resolve the auto target of grub-install and
+	// tell which steps are skipped.
+	firmware disk.Firmware
+	arch     string
+}
+
+func (v *validator) addError(section string, step int, operation, msg string, args ...any) {
+	v.errs = append(v.errs, ValidationError{
+		Section:   section,
+		Step:      step,
+		Operation: operation,
+		Message:   util.MaskSecrets(fmt.Sprintf(msg, args...)),
+	})
+}
+
+// Validate checks every step of the recipe for unknown operations, wrong
+// number or types of parameters, and references to disks, partitions, VGs,
+// LVs or mount targets which cannot exist at the time they are used.
+// Every step is checked, but those whose firmware or arch condition cannot
+// match Facts, or the firmware the system booted with, do not change the
+// disks, devices and ids later steps are checked against.
+//
+// No command is executed and no disk is touched. If any problem is found,
+// the returned error is a ValidationErrors containing all of them.
+func (recipe *Recipe) Validate() error {
+	v := validator{
+		disks:      map[string]*diskState{},
+		partitions: map[string]bool{},
+		vgs:        map[string]bool{},
+		removedVgs: map[string]bool{},
+		lvs:        map[string]bool{},
+		removedLvs: map[string]bool{},
+		ids:        map[string]string{},
+		firmware:   disk.DetectFirmware(),
+	}
+	if recipe.Facts != nil {
+		v.firmware = recipe.Facts.Firmware
+		v.arch = recipe.Facts.Arch
+	}
+
+	// Values are unknown until variables are set, so nothing else can be
+	// checked
+	v.validateVariables(recipe)
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+
+	for i, step := range recipe.Setup {
+		step.Params = v.expandParams("setup", i, step.Operation, step.Params)
+		v.validateCondition("setup", i, step.Operation, step.When, true)
+		if v.skipped(step.When) {
+			saved := v.snapshot()
+			v.validateSetupStep(i, step)
+			v.restore(saved)
+			continue
+		}
+		v.validateSetupStep(i, step)
+	}
+	mountpoints := recipe.mountpoints()
+	for i, mnt := range mountpoints {
+		partition, _ := v.expandRefs("mountpoints", i, "", mnt.Partition).(string)
+		mountpoints[i].Partition = partition
+	}
+	v.validateMountpoints(mountpoints)
+	v.validateInstallation(recipe.Installation)
+	for i, step := range recipe.PostInstallation {
+		step.Params = v.expandParams("postInstallation", i, step.Operation, step.Params)
+		v.validateCondition("postInstallation", i, step.Operation, step.When, false)
+		v.validatePostStep(i, step)
+	}
+
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+
+	return nil
+}
+
+// expandRefs replaces the references to setup steps in value with the path
+// their device is expected to have, so it can be checked like any other
+// value. Invalid references are reported and left as they are.
+func (v *validator) expandRefs(section string, step int, operation string, value any) any {
+	expanded, err := expandRefs(value, func(id, field string) (string, error) {
+		path, ok := v.ids[id]
+		if !ok {
+			return "", fmt.Errorf("no previous setup step has id %q", id)
+		}
+
+		switch field {
+		case "uuid":
+			return "<uuid of " + id + ">", nil
+		case "mapper":
+			return "/dev/mapper/luks-<uuid of " + id + ">", nil
+		default:
+			return path, nil
+		}
+	})
+	if err != nil {
+		v.addError(section, step, operation, "%s", err)
+	}
+
+	return expanded
+}
+
+func (v *validator) expandParams(section string, step int, operation string, params []interface{}) []interface{} {
+	if params == nil {
+		return nil
+	}
+
+	return v.expandRefs(section, step, operation, params).([]interface{})
+}
+
+// addID records the id of a setup step, whose device is expected to have
+// path.
+func (v *validator) addID(step int, operation, id, path string) {
+	switch {
+	case !slices.Contains(idOperations, operation):
+		v.addError("setup", step, operation, "only %s steps can have an id", strings.Join(idOperations, ", "))
+	case !idExpr.MatchString(id):
+		v.addError("setup", step, operation, "invalid id %q: ids can only contain letters, digits, - and _", id)
+	case v.ids[id] != "":
+		v.addError("setup", step, operation, "id %q is used by more than one step", id)
+	default:
+		v.ids[id] = path
+	}
+}
+
+// checkParams validates args against specs, returning false if the step
+// cannot be inspected any further.
+func (v *validator) checkParams(section string, step int, operation string, args []interface{}, specs []paramSpec) bool {
+	ok := true
+	argIdx := 0
+	for _, spec := range specs {
+		if spec.variadic {
+			if argIdx >= len(args) && !spec.optional {
+				v.addError(section, step, operation, "expected at least one %s parameter", spec.name)
+				return false
+			}
+			for ; argIdx < len(args); argIdx++ {
+				if !paramMatches(args[argIdx], spec.kind) {
+					v.addError(section, step, operation, "parameter %d (%s) must be %s, got %s", argIdx, spec.name, spec.kind, jsonTypeName(args[argIdx]))
+					ok = false
+				}
+			}
+			return ok
+		}
+
+		if argIdx >= len(args) {
+			if !spec.optional {
+				v.addError(section, step, operation, "missing required parameter %s", spec.name)
+				ok = false
+			}
+			argIdx++
+			continue
+		}
+
+		if !paramMatches(args[argIdx], spec.kind) {
+			v.addError(section, step, operation, "parameter %d (%s) must be %s, got %s", argIdx, spec.name, spec.kind, jsonTypeName(args[argIdx]))
+			ok = false
+		}
+		argIdx++
+	}
+
+	if len(args) > len(specs) {
+		v.addError(section, step, operation, "expected at most %d parameters, got %d", len(specs), len(args))
+		ok = false
+	}
+
+	return ok
+}
+
+func paramMatches(value any, kind paramType) bool {
+	switch kind {
+	case paramString:
+		_, ok := value.(string)
+		return ok
+	case paramBool:
+		_, ok := value.(bool)
+		return ok
+	case paramNumber:
+		_, ok := value.(float64)
+		return ok
+	case paramInt:
+		_, err := jsonFieldToInt(value)
+		return err == nil
+	case paramSize:
+		_, err := util.ParseSize(value)
+		return err == nil
+	case paramPosition:
+		return isRegionPosition(value) || paramMatches(value, paramSize)
+	case paramStringList:
+		list, ok := value.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, item := range list {
+			if _, ok := item.(string); !ok {
+				return false
+			}
+		}
+		return true
+	case paramObject:
+		_, ok := value.(map[string]interface{})
+		return ok
+	default:
+		return false
+	}
+}
+
+func jsonTypeName(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func stringList(value any) []string {
+	list := []string{}
+	for _, item := range value.([]interface{}) {
+		list = append(list, item.(string))
+	}
+
+	return list
+}
+
+func isValidFilesystem(fs string) bool {
+	return slices.Contains(validFilesystems, disk.PartitionFs(fs))
+}
+
+// sizeIsBefore reports whether start may come before end on a disk. Sizes
+// measured differently can only be compared once the disk size is known.
+func sizeIsBefore(start, end util.Size) bool {
+	if end.Kind == util.SizeRest || start.Kind != end.Kind {
+		return true
+	}
+
+	switch start.Kind {
+	case util.SizeAbsolute:
+		return start.Bytes < end.Bytes
+	case util.SizeFromEnd:
+		return start.Bytes > end.Bytes
+	case util.SizePercent:
+		return start.Percent < end.Percent
+	}
+
+	return true
+}
+
+func isDevicePath(path string) bool {
+	return strings.HasPrefix(path, "/dev/")
+}
+
+// partitionPath returns the path of partition partNum on the disk at
+// diskPath. The partitions of disks referenced through udev symlinks (e.g.
+// /dev/disk/by-id/...) have the same link followed by "-partN".
+func partitionPath(diskPath string, partNum int) string {
+	if strings.HasPrefix(diskPath, "/dev/disk/") {
+		return fmt.Sprintf("%s-part%d", diskPath, partNum)
+	}
+
+	part := disk.Partition{Number: partNum}
+	part.FillPath(diskPath)
+	return part.Path
+}
+
+func (v *validator) diskState(diskPath string) *diskState {
+	state, ok := v.disks[diskPath]
+	if !ok {
+		state = &diskState{}
+		v.disks[diskPath] = state
+	}
+
+	return state
+}
+
+// checkPartNum ensures partNum exists on diskPath, if we know the disk's
+// partition table.
+func (v *validator) checkPartNum(step int, operation, diskPath string, partNum int) {
+	state := v.diskState(diskPath)
+	if state.labeled && !slices.Contains(state.partitions, partNum) {
+		v.addError("setup", step, operation, "partition %d does not exist on %s at this point", partNum, diskPath)
+	}
+}
+
+// checkPv ensures a PV path refers to a partition which may exist.
+func (v *validator) checkPv(step int, operation, path string) {
+	if refExpr.MatchString(path) {
+		// Invalid reference, which was already reported
+		return
+	}
+	if !isDevicePath(path) {
+		v.addError("setup", step, operation, "%s is not a device path", path)
+		return
+	}
+
+	diskPath, _ := splitPartitionPath(path)
+	if state, ok := v.disks[diskPath]; ok && state.labeled && !v.partitions[path] {
+		v.addError("setup", step, operation, "partition %s does not exist at this point", path)
+	}
+}
+
+// splitPartitionPath separates a partition path into its disk and partition
+// number, returning empty strings if path does not look like a partition.
+func splitPartitionPath(path string) (string, string) {
+	diskPath, partName := util.SeparateDiskPart(path)
+	if partName == "" || diskPath == path {
+		return "", ""
+	}
+
+	return diskPath, partName
+}
+
+func (v *validator) checkVg(step int, operation, name string) {
+	if name == "" {
+		v.addError("setup", step, operation, "VG name cannot be empty")
+		return
+	}
+	if v.removedVgs[name] && !v.vgs[name] {
+		v.addError("setup", step, operation, "VG %s was removed by a previous step", name)
+	}
+}
+
+// checkLv ensures fullName (in `vg_name/lv_name` format) refers to an LV
+// which may exist.
+func (v *validator) checkLv(step int, operation, fullName string) {
+	vgName, lvName, found := strings.Cut(fullName, "/")
+	if !found || vgName == "" || lvName == "" {
+		v.addError("setup", step, operation, "%s is not in the vg_name/lv_name format", fullName)
+		return
+	}
+
+	v.checkVg(step, operation, vgName)
+	if v.removedLvs[fullName] && !v.lvs[fullName] {
+		v.addError("setup", step, operation, "LV %s was removed by a previous step", fullName)
+	} else if v.vgs[vgName] && !v.lvs[fullName] {
+		v.addError("setup", step, operation, "LV %s does not exist at this point", fullName)
+	}
+}
+
+func (v *validator) validateSetupStep(i int, step SetupStep) {
+	const section = "setup"
+	operation := step.Operation
+	args := step.Params
+
+	specs, ok := setupOperationParams[operation]
+	if !ok {
+		v.addError(section, i, operation, "unrecognized operation %q", operation)
+		return
+	}
+
+	if !disk.IsDeviceRef(step.Disk) {
+		v.addError(section, i, operation, "disk %q is not a device path or reference", step.Disk)
+	}
+
+	// Path of the device created by the step, if it has an id
+	device := "PARTLABEL=" + step.ID
+	if step.ID != "" {
+		defer func() { v.addID(i, operation, step.ID, device) }()
+	}
+
+	state := v.diskState(step.Disk)
+	if !v.checkParams(section, i, operation, args, specs) {
+		// We can no longer reason about the disk's partition table
+		state.labeled = false
+		return
+	}
+
+	switch operation {
+	case "label":
+		label := args[0].(string)
+		if label != disk.GPT && label != disk.MSDOS {
+			v.addError(section, i, operation, "unsupported label type %q, expected %q or %q", label, disk.GPT, disk.MSDOS)
+		}
+		for _, partNum := range state.partitions {
+			delete(v.partitions, partitionPath(step.Disk, partNum))
+		}
+		state.labeled = true
+		state.label = label
+		state.partitions = []int{}
+		state.biosBoot = []int{}
+		state.freed = false
+	case "auto-layout":
+		if disk.IsDeviceRef(step.Disk) && !isDevicePath(step.Disk) {
+			v.addError(section, i, operation, "the partitions of %s cannot be referenced in mountpoints, use a path in /dev (e.g. /dev/disk/by-id/...) instead", step.Disk)
+		}
+		firmware := disk.Firmware(args[0].(string))
+		if firmware != disk.EFI && firmware != disk.BIOS {
+			v.addError(section, i, operation, "unsupported firmware %q, expected %q or %q", firmware, disk.EFI, disk.BIOS)
+		}
+		policy, err := layoutPolicy(args)
+		if err == nil {
+			err = policy.Check()
+		}
+		if err != nil {
+			v.addError(section, i, operation, "%s", err)
+		}
+		for _, part := range policy.Partitions {
+			if part.Filesystem != "" && !isValidFilesystem(string(part.Filesystem)) {
+				v.addError(section, i, operation, "partition %s: unsupported filesystem %q", part.Name, part.Filesystem)
+			}
+			if part.Mountpoint != "" && !filepath.IsAbs(part.Mountpoint) {
+				v.addError(section, i, operation, "partition %s: mountpoint %q is not an absolute path", part.Name, part.Mountpoint)
+			}
+		}
+		for _, partNum := range state.partitions {
+			delete(v.partitions, partitionPath(step.Disk, partNum))
+		}
+		state.labeled = true
+		state.label = disk.GPT
+		state.partitions = []int{}
+		state.biosBoot = []int{}
+		state.freed = false
+		for n, part := range policy.ForFirmware(firmware) {
+			state.partitions = append(state.partitions, n+1)
+			v.partitions[partitionPath(step.Disk, n+1)] = true
+			if slices.Contains(part.Flags, "bios_grub") {
+				state.biosBoot = append(state.biosBoot, n+1)
+			}
+		}
+	case "mkpart":
+		fsType := args[1].(string)
+		isLuks := strings.HasPrefix(fsType, "luks-")
+		innerFs := strings.TrimPrefix(fsType, "luks-")
+		if !(fsType == "none" && !isLuks) && !isValidFilesystem(innerFs) {
+			v.addError(section, i, operation, "unsupported filesystem %q", fsType)
+		}
+		if isLuks && len(args) < 5 {
+			v.addError(section, i, operation, "encrypted partition requires a LUKSPassword")
+		}
+		if (args[2] == freedPosition || args[3] == freedPosition) && !state.freed {
+			v.addError(section, i, operation, "no region was freed on %s by a previous shrink-for-install step", step.Disk)
+		}
+		start, startErr := util.ParseSize(args[2])
+		end, endErr := util.ParseSize(args[3])
+		if startErr == nil && start.Kind == util.SizeRest {
+			v.addError(section, i, operation, "start position cannot be rest")
+		}
+		for _, pos := range []util.Size{start, end} {
+			if pos.PercentOf != "" {
+				v.addError(section, i, operation, "%s can only be used for LVM volumes", pos)
+			}
+		}
+		if startErr == nil && endErr == nil && !sizeIsBefore(start, end) {
+			v.addError(section, i, operation, "end position (%s) must be greater than start position (%s)", end, start)
+		}
+		// Partitions created on disks with unknown partition tables can
+		// only be found by name
+		device = "PARTLABEL=" + args[0].(string)
+		if state.labeled {
+			partNum := 1
+			if len(state.partitions) > 0 {
+				partNum = slices.Max(state.partitions) + 1
+			}
+			state.partitions = append(state.partitions, partNum)
+			device = partitionPath(step.Disk, partNum)
+			v.partitions[device] = true
+		}
+	case "rm":
+		partNum, _ := jsonFieldToInt(args[0])
+		v.checkPartNum(i, operation, step.Disk, partNum)
+		if state.labeled {
+			state.partitions = slices.DeleteFunc(state.partitions, func(n int) bool { return n == partNum })
+			state.biosBoot = slices.DeleteFunc(state.biosBoot, func(n int) bool { return n == partNum })
+			delete(v.partitions, partitionPath(step.Disk, partNum))
+		}
+	case "resizepart":
+		partNum, _ := jsonFieldToInt(args[0])
+		v.checkPartNum(i, operation, step.Disk, partNum)
+		if size, _ := util.ParseSize(args[1]); size.PercentOf != "" {
+			v.addError(section, i, operation, "%s can only be used for LVM volumes", size)
+		}
+	case "shrink-for-install":
+		partNum, _ := jsonFieldToInt(args[0])
+		v.checkPartNum(i, operation, step.Disk, partNum)
+		size, _ := util.ParseSize(args[1])
+		if size.Kind == util.SizeRest || size.PercentOf != "" {
+			v.addError(section, i, operation, "new size cannot be %s", size)
+		} else if (size.Kind == util.SizeAbsolute && size.Bytes <= 0) || (size.Kind == util.SizePercent && size.Percent <= 0) {
+			v.addError(section, i, operation, "new size must be greater than zero")
+		}
+		state.freed = true
+	case "namepart", "setlabel":
+		partNum, _ := jsonFieldToInt(args[0])
+		v.checkPartNum(i, operation, step.Disk, partNum)
+	case "setflag":
+		partNum, _ := jsonFieldToInt(args[0])
+		v.checkPartNum(i, operation, step.Disk, partNum)
+		if state.labeled && args[1].(string) == "bios_grub" {
+			state.biosBoot = slices.DeleteFunc(state.biosBoot, func(n int) bool { return n == partNum })
+			if args[2].(bool) {
+				state.biosBoot = append(state.biosBoot, partNum)
+			}
+		}
+	case "format", "luks-format":
+		partNum, _ := jsonFieldToInt(args[0])
+		v.checkPartNum(i, operation, step.Disk, partNum)
+		device = partitionPath(step.Disk, partNum)
+		if fs := args[1].(string); !isValidFilesystem(fs) {
+			v.addError(section, i, operation, "unsupported filesystem %q", fs)
+		}
+	case "pvcreate", "pvresize", "pvremove":
+		v.checkPv(i, operation, args[0].(string))
+		if operation == "pvresize" && len(args) > 1 {
+			if size, _ := util.ParseSize(args[1]); size.PercentOf != "" {
+				v.addError(section, i, operation, "%s can only be used for LVs", size)
+			}
+		}
+	case "vgcreate":
+		name := args[0].(string)
+		if name == "" {
+			v.addError(section, i, operation, "VG name cannot be empty")
+		}
+		if v.vgs[name] {
+			v.addError(section, i, operation, "VG %s was already created by a previous step", name)
+		}
+		if len(args) > 1 {
+			for _, pv := range stringList(args[1]) {
+				v.checkPv(i, operation, pv)
+			}
+		}
+		v.vgs[name] = true
+		delete(v.removedVgs, name)
+	case "vgrename":
+		oldName := args[0].(string)
+		newName := args[1].(string)
+		v.checkVg(i, operation, oldName)
+		if newName == "" {
+			v.addError(section, i, operation, "VG name cannot be empty")
+		}
+		if v.vgs[oldName] {
+			delete(v.vgs, oldName)
+			v.vgs[newName] = true
+			for lv := range v.lvs {
+				if vgName, lvName, _ := strings.Cut(lv, "/"); vgName == oldName {
+					delete(v.lvs, lv)
+					v.lvs[newName+"/"+lvName] = true
+				}
+			}
+		}
+	case "vgextend", "vgreduce":
+		v.checkVg(i, operation, args[0].(string))
+		for _, pv := range stringList(args[1]) {
+			v.checkPv(i, operation, pv)
+		}
+	case "vgremove":
+		name := args[0].(string)
+		v.checkVg(i, operation, name)
+		delete(v.vgs, name)
+		v.removedVgs[name] = true
+		for lv := range v.lvs {
+			if vgName, _, _ := strings.Cut(lv, "/"); vgName == name {
+				delete(v.lvs, lv)
+				v.removedLvs[lv] = true
+			}
+		}
+	case "lvcreate", "lvcreate-thin":
+		name := args[0].(string)
+		vg := args[1].(string)
+		v.checkVg(i, operation, vg)
+		if name == "" {
+			v.addError(section, i, operation, "LV name cannot be empty")
+		}
+		if operation == "lvcreate" {
+			size, _ := util.ParseSize(args[3])
+			if (size.Kind == util.SizeAbsolute && size.Bytes <= 0) || (size.Kind == util.SizePercent && size.Percent <= 0) {
+				v.addError(section, i, operation, "LV size must be greater than zero")
+			}
+		} else {
+			size, _ := util.ParseSize(args[2])
+			if size.Kind != util.SizeAbsolute {
+				v.addError(section, i, operation, "thin LV size must be absolute, got %s", size)
+			} else if size.Bytes <= 0 {
+				v.addError(section, i, operation, "LV size must be greater than zero")
+			}
+			v.checkLv(i, operation, vg+"/"+args[3].(string))
+		}
+		v.lvs[vg+"/"+name] = true
+		delete(v.removedLvs, vg+"/"+name)
+		device = fmt.Sprintf("/dev/%s/%s", vg, name)
+	case "lvrename":
+		oldName := args[0].(string)
+		newName := args[1].(string)
+		vg := args[2].(string)
+		v.checkLv(i, operation, vg+"/"+oldName)
+		if v.lvs[vg+"/"+oldName] {
+			delete(v.lvs, vg+"/"+oldName)
+			v.lvs[vg+"/"+newName] = true
+		}
+	case "lvremove":
+		name := args[0].(string)
+		v.checkLv(i, operation, name)
+		delete(v.lvs, name)
+		v.removedLvs[name] = true
+	case "make-thin-pool":
+		v.checkLv(i, operation, args[0].(string))
+		v.checkLv(i, operation, args[1].(string))
+		// The metadata LV is merged into the pool
+		delete(v.lvs, args[1].(string))
+	case "lvm-format", "lvm-luks-format":
+		v.checkLv(i, operation, args[0].(string))
+		if fs := args[1].(string); !isValidFilesystem(fs) {
+			v.addError(section, i, operation, "unsupported filesystem %q", fs)
+		}
+	}
+}
+
+func (v *validator) validateMountpoints(mountpoints []Mountpoint) {
+	const section = "mountpoints"
+
+	rootCount := 0
+	seenTargets := map[string]bool{}
+	for i, mnt := range mountpoints {
+		if mnt.Target == "" || !filepath.IsAbs(mnt.Target) {
+			v.addError(section, i, "", "target %q is not an absolute path", mnt.Target)
+		} else if mnt.Target == "/" {
+			rootCount++
+		} else if seenTargets[mnt.Target] {
+			v.addError(section, i, "", "target %s is mounted more than once", mnt.Target)
+		}
+		seenTargets[mnt.Target] = true
+
+		if refExpr.MatchString(mnt.Partition) {
+			// Invalid reference, which was already reported
+			continue
+		}
+		if !disk.IsDeviceRef(mnt.Partition) {
+			v.addError(section, i, "", "partition %q is not a device path or reference", mnt.Partition)
+			continue
+		}
+		if disk.IsStableRef(mnt.Partition) {
+			// Only resolved when mounting, since the partition may be
+			// created during setup
+			continue
+		}
+
+		if matches := lvmPathExpr.FindStringSubmatch(mnt.Partition); matches != nil {
+			fullName := matches[1] + "/" + matches[2]
+			if v.removedLvs[fullName] && !v.lvs[fullName] {
+				v.addError(section, i, "", "LV %s was removed during setup", fullName)
+			} else if v.vgs[matches[1]] && !v.lvs[fullName] {
+				v.addError(section, i, "", "LV %s is not created during setup", fullName)
+			}
+			continue
+		}
+
+		diskPath, partName := splitPartitionPath(mnt.Partition)
+		if diskPath == "" {
+			v.addError(section, i, "", "%s does not look like a partition", mnt.Partition)
+			continue
+		}
+		if state, ok := v.disks[diskPath]; ok && state.labeled && !v.partitions[mnt.Partition] {
+			v.addError(section, i, "", "partition %s (number %s) does not exist after setup", mnt.Partition, partName)
+		}
+	}
+
+	if len(mountpoints) > 0 && rootCount == 0 {
+		v.addError(section, -1, "", "no mountpoint targets /")
+	}
+	if rootCount > 2 {
+		v.addError(section, -1, "", "at most two partitions can target / (A and B roots), got %d", rootCount)
+	}
+}
+
+func (v *validator) validateInstallation(installation Installation) {
+	const section = "installation"
+
+	switch installation.Method {
+	case UNSQUASHFS, OCI:
+	default:
+		v.addError(section, -1, "", "unsupported installation method %q", installation.Method)
+	}
+	if installation.Source == "" {
+		v.addError(section, -1, "", "installation source cannot be empty")
+	} else if installation.Method == OCI {
+		if _, err := disk.ParseOCISource(installation.Source); err != nil {
+			v.addError(section, -1, "", "%s", err)
+		}
+	}
+
+	if installation.Method != OCI && (installation.Digest != "" || installation.SignaturePolicy != "") {
+		v.addError(section, -1, "", "digest and signaturePolicy are only supported by the %s method", OCI)
+	}
+	if installation.Digest != "" {
+		if _, err := digest.Parse(installation.Digest); err != nil {
+			v.addError(section, -1, "", "invalid digest %q: %s", installation.Digest, err)
+		}
+	}
+}
+
+func (v *validator) validatePostStep(i int, step PostStep) {
+	const section = "postInstallation"
+	operation := step.Operation
+	args := step.Params
+
+	specs, ok := postInstallOperationParams[operation]
+	if !ok {
+		v.addError(section, i, operation, "unrecognized operation %q", operation)
+		return
+	}
+
+	if !v.checkParams(section, i, operation, args, specs) {
+		return
+	}
+
+	switch operation {
+	case "adduser":
+		if args[0].(string) == "" {
+			v.addError(section, i, operation, "username cannot be empty")
+		}
+		for _, idx := range []int{4, 5} {
+			if len(args) > idx {
+				if id := args[idx].(float64); id < 0 || id != float64(int(id)) {
+					v.addError(section, i, operation, "parameter %d must be a non-negative integer", idx)
+				}
+			}
+		}
+	case "grub-install":
+		target := args[2].(string)
+		removable := args[4].(bool)
+		firmware := disk.Firmware(target)
+		if target == system.FirmwareAuto {
+			firmware = v.firmware
+		}
+		switch firmware {
+		case disk.BIOS:
+			// The disk must be labeled by the recipe for its partitions to
+			// be known, otherwise this is checked by grub-install
+			if state, ok := v.disks[args[1].(string)]; ok && state.labeled && state.label == disk.GPT && len(state.biosBoot) == 0 {
+				v.addError(section, i, operation, "%s has a GPT partition table but no partition with the bios_grub flag", args[1])
+			}
+		case disk.EFI:
+			if !removable && (len(args) < 6 || args[5].(string) == "") {
+				v.addError(section, i, operation, "EFIDevice is required for non-removable EFI installations")
+			}
+		default:
+			v.addError(section, i, operation, "unrecognized firmware type %q, expected \"bios\", \"efi\" or \"auto\"", target)
+		}
+		if firmware == disk.BIOS || firmware == disk.EFI {
+			if _, err := system.GetGrubTarget(string(firmware)); err != nil {
+				v.addError(section, i, operation, "%s", err)
+			}
+		}
+		if !disk.IsDeviceRef(args[1].(string)) {
+			v.addError(section, i, operation, "install device %q is not a device path or reference", args[1])
+		}
+		if len(args) > 5 && args[5].(string) != "" && !disk.IsDeviceRef(args[5].(string)) {
+			v.addError(section, i, operation, "EFI device %q is not a device path or reference", args[5])
+		}
+	case "grub-default-config":
+		for j, arg := range args {
+			if !strings.Contains(arg.(string), "=") {
+				v.addError(section, i, operation, "parameter %d (%q) is not a KEY=value pair", j, arg)
+			}
+		}
+	case "swapon":
+		if !isDevicePath(args[0].(string)) {
+			v.addError(section, i, operation, "%q is not a device path", args[0])
+		}
+	case "sdboot-install", "sdboot-entry", "uki-install":
+		if !filepath.IsAbs(args[0].(string)) {
+			v.addError(section, i, operation, "ESP path %q is not an absolute path", args[0])
+		}
+		entryName := args[1].(string)
+		if operation != "sdboot-entry" {
+			if !disk.IsDeviceRef(args[1].(string)) {
+				v.addError(section, i, operation, "EFI device %q is not a device path or reference", args[1])
+			}
+			entryName = args[2].(string)
+		}
+		// Only used in file names by sdboot-entry and uki-install
+		if operation != "sdboot-install" && !entryNameExpr.MatchString(entryName) {
+			v.addError(section, i, operation, "invalid entry name %q: names can only contain letters, digits, ., - and _ and cannot start with .", entryName)
+		}
+		if operation == "sdboot-install" && len(args) > 3 {
+			if timeout, _ := jsonFieldToInt(args[3]); timeout < 0 {
+				v.addError(section, i, operation, "timeout cannot be negative")
+			}
+		}
+		if operation == "uki-install" && len(args) > 4 {
+			key, cert := args[4].(string), ""
+			if len(args) > 5 {
+				cert = args[5].(string)
+			}
+			if (key == "") != (cert == "") {
+				v.addError(section, i, operation, "SigningKey and SigningCert must be given together")
+			}
+			for _, path := range []string{key, cert} {
+				if path != "" && !filepath.IsAbs(path) {
+					v.addError(section, i, operation, "%q is not an absolute path", path)
+				}
+			}
+		}
+	}
+}
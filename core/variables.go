@@ -0,0 +1,210 @@
+package albius
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/vanilla-os/albius/core/util"
+)
+
+// VariableType tells how the value of a variable is handled.
+type VariableType string
+
+const (
+	VariableString VariableType = "string"
+	// VariableSecret values (e.g. passwords) are masked in logs, plans,
+	// events and errors
+	VariableSecret VariableType = "secret"
+)
+
+// VariableEnvPrefix is followed by the name of a variable in the
+// environment variable holding its value.
+const VariableEnvPrefix = "ALBIUS_VAR_"
+
+// varExpr matches references to recipe variables, e.g. ${disk}
+var varExpr = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// varNameExpr matches valid variable names
+var varNameExpr = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Variable is declared in the Variables section of a recipe, and referenced
+// as ${name} in any string of the recipe.
+type Variable struct {
+	// Type is VariableString if empty
+	Type        VariableType `json:",omitempty"`
+	Description string       `json:",omitempty"`
+	// Default is the value used if none is given, if set
+	Default *string `json:",omitempty"`
+}
+
+// VariableSources are where SetVariables looks for the value of each
+// variable, in order: Values, Files, the VariableEnvPrefix environment
+// variable, the variable's default and finally Prompt.
+type VariableSources struct {
+	// Values holds values given directly, e.g. on the command line
+	Values map[string]string
+	// Files holds the path of a file containing the value of a variable,
+	// whose trailing newline is ignored
+	Files map[string]string
+	// Prompt, if set, asks for the value of a variable given no other way
+	Prompt func(name string, variable Variable) (string, error)
+}
+
+func (sources VariableSources) lookup(name string, variable Variable) (string, bool, error) {
+	if value, ok := sources.Values[name]; ok {
+		return value, true, nil
+	}
+	if path, ok := sources.Files[name]; ok {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to read variable %s: %s", name, err)
+		}
+		value := strings.TrimSuffix(string(content), "\n")
+		return strings.TrimSuffix(value, "\r"), true, nil
+	}
+	if value, ok := os.LookupEnv(VariableEnvPrefix + name); ok {
+		return value, true, nil
+	}
+	if variable.Default != nil {
+		return *variable.Default, true, nil
+	}
+	if sources.Prompt != nil {
+		value, err := sources.Prompt(name, variable)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to read variable %s: %s", name, err)
+		}
+		return value, true, nil
+	}
+
+	return "", false, nil
+}
+
+// SetVariables finds the value of every variable declared by the recipe and
+// replaces the references to them in the recipe. The values of secret
+// variables are registered with util.AddSecret. References to undeclared
+// variables are left alone, so shell commands can still use e.g. ${HOME}.
+func (recipe *Recipe) SetVariables(sources VariableSources) error {
+	for _, given := range []map[string]string{sources.Values, sources.Files} {
+		for name := range given {
+			if _, ok := recipe.Variables[name]; !ok {
+				return fmt.Errorf("variable %s is not declared by the recipe", name)
+			}
+		}
+	}
+
+	values := map[string]string{}
+	missing := []string{}
+	for _, name := range slices.Sorted(maps.Keys(recipe.Variables)) {
+		variable := recipe.Variables[name]
+		value, ok, err := sources.lookup(name, variable)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		if variable.Type == VariableSecret {
+			util.AddSecret(value)
+		}
+		values[name] = value
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("no value given for variable(s) %s", strings.Join(missing, ", "))
+	}
+
+	recipe.walkStrings(func(_ string, _ int, s string) string {
+		return varExpr.ReplaceAllStringFunc(s, func(ref string) string {
+			if value, ok := values[varExpr.FindStringSubmatch(ref)[1]]; ok {
+				return value
+			}
+			return ref
+		})
+	})
+
+	return nil
+}
+
+// walkStrings calls fn with every string of the recipe which can reference
+// variables, along with the section and index of the step it belongs to,
+// and replaces it with the result.
+func (recipe *Recipe) walkStrings(fn func(section string, step int, s string) string) {
+	var walk func(section string, step int, value any) any
+	walk = func(section string, step int, value any) any {
+		switch v := value.(type) {
+		case string:
+			return fn(section, step, v)
+		case []interface{}:
+			for i, item := range v {
+				v[i] = walk(section, step, item)
+			}
+		case map[string]interface{}:
+			for key, item := range v {
+				v[key] = walk(section, step, item)
+			}
+		}
+		return value
+	}
+
+	for i := range recipe.Setup {
+		step := &recipe.Setup[i]
+		step.Disk = fn("setup", i, step.Disk)
+		walk("setup", i, step.Params)
+		if step.When != nil {
+			step.When.Disk = fn("setup", i, step.When.Disk)
+		}
+	}
+	for i := range recipe.Mountpoints {
+		mnt := &recipe.Mountpoints[i]
+		mnt.Partition = fn("mountpoints", i, mnt.Partition)
+		mnt.Target = fn("mountpoints", i, mnt.Target)
+	}
+
+	installation := &recipe.Installation
+	installation.Method = InstallationMethod(fn("installation", -1, string(installation.Method)))
+	for _, field := range []*string{&installation.Source, &installation.Digest, &installation.SignaturePolicy} {
+		*field = fn("installation", -1, *field)
+	}
+	for _, hooks := range [][]string{installation.InitramfsPre, installation.InitramfsPost} {
+		for i := range hooks {
+			hooks[i] = fn("installation", -1, hooks[i])
+		}
+	}
+
+	for i := range recipe.PostInstallation {
+		step := &recipe.PostInstallation[i]
+		walk("postInstallation", i, step.Params)
+		if step.When != nil {
+			step.When.Disk = fn("postInstallation", i, step.When.Disk)
+		}
+	}
+}
+
+// validateVariables checks the variable declarations, and that every
+// declared variable referenced by the recipe was given a value.
+func (v *validator) validateVariables(recipe *Recipe) {
+	for _, name := range slices.Sorted(maps.Keys(recipe.Variables)) {
+		variable := recipe.Variables[name]
+		if !varNameExpr.MatchString(name) {
+			v.addError("variables", -1, "", "invalid variable name %q: names can only contain letters, digits and _, and cannot start with a digit", name)
+		}
+		switch variable.Type {
+		case "", VariableString, VariableSecret:
+		default:
+			v.addError("variables", -1, "", "variable %s has unsupported type %q, expected %q or %q", name, variable.Type, VariableString, VariableSecret)
+		}
+	}
+
+	recipe.walkStrings(func(section string, step int, s string) string {
+		for _, match := range varExpr.FindAllStringSubmatch(s, -1) {
+			if _, ok := recipe.Variables[match[1]]; ok {
+				v.addError(section, step, "", "variable %s has no value, see SetVariables", match[1])
+			}
+		}
+		return s
+	})
+}